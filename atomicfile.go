@@ -0,0 +1,177 @@
+package keyman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	atomicTempPrefix = ".keyman-tmp-"
+	// atomicTempSeparator separates the target's name from the random
+	// suffix in the names of temp files
+	atomicTempSeparator = "~"
+)
+
+// atomicFile is a file to be written by writeFilesAtomic.
+type atomicFile struct {
+	name string
+	data []byte
+	perm os.FileMode
+
+	tmpName string
+}
+
+// writeFileAtomic writes data to filename such that readers see either the
+// old or the new contents, even if the process crashes or the disk fills up
+// halfway through.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	return writeFilesAtomic(atomicFile{name: filename, data: data, perm: perm})
+}
+
+// writeFilesAtomic writes all of the given files. Every file is first written
+// in full to a temp file in its target directory and synced to disk. Only once
+// all of them are durable are they renamed over their targets, in the given
+// order, and the containing directories synced. If anything fails before the
+// first rename, none of the targets are touched and the temp files are
+// removed. Each file is replaced atomically, but the files aren't replaced as
+// a unit: a crash or a concurrent reader can see the first files replaced and
+// the remaining ones not yet. If a later rename fails, the remaining staged
+// temp files are kept and the error says that the write is partial, so that
+// completeStagedFile can finish it.
+func writeFilesAtomic(files ...atomicFile) (err error) {
+	renamed := 0
+	defer func() {
+		if err != nil && renamed == 0 {
+			for _, file := range files {
+				if file.tmpName == "" {
+					continue
+				}
+				if err := os.Remove(file.tmpName); err != nil && !os.IsNotExist(err) {
+					log.Debugf("Unable to remove temp file: %v", err)
+				}
+			}
+		}
+	}()
+
+	for i := range files {
+		if err := files[i].stage(); err != nil {
+			return err
+		}
+	}
+
+	dirs := make(map[string]bool)
+	for i := range files {
+		file := &files[i]
+		if err := os.Rename(file.tmpName, file.name); err != nil {
+			if renamed > 0 {
+				return fmt.Errorf("Partially written, unable to replace %s after %s, keeping %s: %w", file.name, files[renamed-1].name, file.tmpName, err)
+			}
+			return fmt.Errorf("Unable to replace %s: %w", file.name, err)
+		}
+		file.tmpName = ""
+		renamed++
+		dirs[filepath.Dir(file.name)] = true
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("Unable to sync directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// completeStagedFile finishes an interrupted writeFilesAtomic by replacing
+// filename with a temp file staged for it, if there's one whose contents are
+// accepted. It indicates whether the file was replaced.
+func completeStagedFile(filename string, accept func(data []byte) bool) (bool, error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isStagedFor(entry.Name(), base) {
+			continue
+		}
+		staged := filepath.Join(dir, entry.Name())
+		data, err := ioutil.ReadFile(staged)
+		if err != nil || !accept(data) {
+			continue
+		}
+		if err := os.Rename(staged, filename); err != nil {
+			return false, fmt.Errorf("Unable to replace %s: %w", filename, err)
+		}
+		if err := syncDir(dir); err != nil {
+			return false, fmt.Errorf("Unable to sync directory %s: %w", dir, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// isStagedFor determines whether name is a temp file staged for a file with
+// the given base name, as opposed to one whose name starts with base.
+func isStagedFor(name string, base string) bool {
+	suffix := strings.TrimPrefix(name, atomicTempPrefix+base+atomicTempSeparator)
+	if suffix == name || suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// stage writes the file's data to a synced temp file next to its target.
+func (file *atomicFile) stage() error {
+	dir, base := filepath.Split(file.name)
+	if dir == "" {
+		dir = "."
+	}
+	// TempFile appends a random number
+	tmp, err := ioutil.TempFile(dir, atomicTempPrefix+base+atomicTempSeparator)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s for writing: %w", file.name, err)
+	}
+	file.tmpName = tmp.Name()
+	_, err = tmp.Write(file.data)
+	if err == nil {
+		err = tmp.Chmod(file.perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write %s: %w", file.name, err)
+	}
+	return nil
+}
+
+// syncDir flushes directory entries (i.e. renames) to disk. Windows doesn't
+// support syncing directories, and renames there are already durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
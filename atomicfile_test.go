@@ -0,0 +1,153 @@
+package keyman
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFilesAtomic(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "missing", "b")
+	if !assert.NoError(t, ioutil.WriteFile(a, []byte("old"), 0644)) {
+		return
+	}
+
+	err := writeFilesAtomic(
+		atomicFile{name: a, data: []byte("new"), perm: 0600},
+		atomicFile{name: b, data: []byte("new"), perm: 0600},
+	)
+	assert.Error(t, err, "Writing into a missing directory should fail")
+	data, _ := ioutil.ReadFile(a)
+	assert.Equal(t, "old", string(data), "No file should be replaced if any fails to stage")
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1, "Temp files should be cleaned up")
+
+	assert.NoError(t, writeFileAtomic(a, []byte("new"), 0600))
+	data, _ = ioutil.ReadFile(a)
+	assert.Equal(t, "new", string(data))
+}
+
+func TestWriteFilesAtomicPartial(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	// A non-empty directory can't be replaced by renaming a file over it
+	assert.NoError(t, os.MkdirAll(filepath.Join(b, "sub"), 0700))
+
+	err := writeFilesAtomic(
+		atomicFile{name: a, data: []byte("new a"), perm: 0600},
+		atomicFile{name: b, data: []byte("new b"), perm: 0600},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Partially written")
+	}
+	data, _ := ioutil.ReadFile(a)
+	assert.Equal(t, "new a", string(data), "First file should be replaced")
+
+	// The staged file for b is kept so that the write can be completed
+	assert.NoError(t, os.RemoveAll(b))
+	completed, err := completeStagedFile(b, func(data []byte) bool { return string(data) == "new b" })
+	if assert.NoError(t, err) && assert.True(t, completed) {
+		data, _ = ioutil.ReadFile(b)
+		assert.Equal(t, "new b", string(data))
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 2, "No temp files should be left")
+}
+
+func TestCompleteStagedFileMatchesExactName(t *testing.T) {
+	dir := t.TempDir()
+	certfile := filepath.Join(dir, "cert.pem")
+	for _, name := range []string{"cert.pem.bak" + atomicTempSeparator + "123", "cert.pem" + atomicTempSeparator + "5" + atomicTempSeparator + "123", "cert.pem123"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, atomicTempPrefix+name), []byte("other"), 0600))
+	}
+	completed, err := completeStagedFile(certfile, func(data []byte) bool { return true })
+	assert.NoError(t, err)
+	assert.False(t, completed, "Files staged for other names should be ignored")
+
+	tmp := atomicFile{name: certfile, data: []byte("cert"), perm: 0600}
+	if assert.NoError(t, tmp.stage()) {
+		assert.True(t, isStagedFor(filepath.Base(tmp.tmpName), "cert.pem"), tmp.tmpName)
+	}
+	completed, err = completeStagedFile(certfile, func(data []byte) bool { return true })
+	if assert.NoError(t, err) && assert.True(t, completed) {
+		data, _ := ioutil.ReadFile(certfile)
+		assert.Equal(t, "cert", string(data))
+	}
+}
+
+func TestWritePKAndCertToFiles(t *testing.T) {
+	dir := t.TempDir()
+	pkfile := filepath.Join(dir, "pk.pem")
+	certfile := filepath.Join(dir, "cert.pem")
+
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(TWO_WEEKS), true, nil, "Test Org", "TestCommonName")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, WritePKAndCertToFiles(pk, cert, pkfile, certfile)) {
+		return
+	}
+	_, err = tls.LoadX509KeyPair(certfile, pkfile)
+	assert.NoError(t, err, "Written key and cert should form a key pair")
+
+	// Losing the key must not leave the old cert paired with a new key
+	assert.NoError(t, os.Remove(pkfile))
+	pk2, cert2, err := StoredPKAndCert(pkfile, certfile, "Test Org", "127.0.0.1", "TestCommonName")
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, pk.PEMEncoded(), pk2.PEMEncoded())
+		assert.NotEqual(t, cert.PEMEncoded(), cert2.PEMEncoded(), "New key should get a new cert")
+		_, err = tls.LoadX509KeyPair(certfile, pkfile)
+		assert.NoError(t, err, "Stored key and cert should form a key pair")
+	}
+}
+
+func TestStoredPKAndCertCompletesInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	pkfile := filepath.Join(dir, "pk.pem")
+	certfile := filepath.Join(dir, "cert.pem")
+	_, _, err := StoredPKAndCert(pkfile, certfile, "Test Org", "127.0.0.1", "TestCommonName")
+	if !assert.NoError(t, err) {
+		return
+	}
+	other := t.TempDir()
+	pk, cert, err := StoredPKAndCert(filepath.Join(other, "pk.pem"), filepath.Join(other, "cert.pem"), "Test Org", "127.0.0.1", "TestCommonName")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Simulate a crash after replacing the key but before replacing the cert
+	staged := filepath.Join(dir, atomicTempPrefix+"cert.pem"+atomicTempSeparator+"123456")
+	assert.NoError(t, ioutil.WriteFile(pkfile, pk.PEMEncoded(), 0600))
+	assert.NoError(t, ioutil.WriteFile(staged, cert.PEMEncoded(), 0600))
+
+	pk2, cert2, err := StoredPKAndCert(pkfile, certfile, "Test Org", "127.0.0.1", "TestCommonName")
+	if assert.NoError(t, err) {
+		assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded())
+		assert.Equal(t, cert.DER(), cert2.DER(), "Staged cert should complete the pair")
+		_, err = tls.LoadX509KeyPair(certfile, pkfile)
+		assert.NoError(t, err, "Stored key and cert should form a key pair")
+	}
+	_, err = os.Stat(staged)
+	assert.True(t, os.IsNotExist(err), "Staged cert should be moved into place")
+
+	// Without a staged cert, a mismatched pair is still reported
+	other2 := t.TempDir()
+	pk3, _, err := StoredPKAndCert(filepath.Join(other2, "pk.pem"), filepath.Join(other2, "cert.pem"), "Test Org", "127.0.0.1", "TestCommonName")
+	if assert.NoError(t, err) {
+		assert.NoError(t, ioutil.WriteFile(pkfile, pk3.PEMEncoded(), 0600))
+		_, _, err = StoredPKAndCert(pkfile, certfile, "Test Org", "127.0.0.1", "TestCommonName")
+		assert.ErrorIs(t, err, ErrKeyMismatch)
+	}
+}
@@ -0,0 +1,421 @@
+package keyman
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupKeyName is the name of the CA's private key in a backup
+	BackupKeyName = "key.pem"
+	// BackupChainName is the name of the CA's certificate chain in a backup,
+	// starting with the CA's own certificate
+	BackupChainName = "chain.pem"
+	// BackupLedgerName is the name of the CA's issuance ledger in a backup, in
+	// the format used by FileLedger
+	BackupLedgerName = "ledger.jsonl"
+	// BackupConfigDir is the directory under which configuration files are
+	// kept in a backup
+	BackupConfigDir = "config"
+
+	backupManifestName   = "manifest.json"
+	backupSignatureName  = "manifest.sig"
+	backupEncryptionName = "encryption.json"
+	backupSealedName     = "backup.tar.sealed"
+	backupVersion1       = 1
+
+	// maxBackupEntrySize bounds the size of any single entry read from a
+	// backup archive.
+	maxBackupEntrySize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrBackupCorrupt is returned when a backup's contents don't match its
+	// manifest or the manifest's signature doesn't verify.
+	ErrBackupCorrupt = errors.New("Backup is corrupt or has been tampered with")
+
+	// ErrBackupUnauthenticated is returned when restoring a backup without a
+	// RestoreOptions.Signer or Fingerprint to authenticate it, unless
+	// IntegrityOnly is set.
+	ErrBackupUnauthenticated = errors.New("No trusted signer to authenticate backup")
+
+	// ErrWouldOverwrite is returned when restoring a backup would replace
+	// existing entries and RestoreOptions.Force isn't set.
+	ErrWouldOverwrite = errors.New("Restoring would overwrite existing entries")
+)
+
+// BackupOptions controls how a backup is made.
+type BackupOptions struct {
+	// Chain holds any intermediate and root certificates above the CA's own
+	// certificate.
+	Chain []*Certificate
+
+	// Config holds configuration files to include, by name.
+	Config map[string][]byte
+
+	// Passphrase, if set, encrypts the whole archive.
+	Passphrase []byte
+
+	// KDFParams controls how the encryption key is derived from the
+	// passphrase, defaults to DefaultKDFParams.
+	KDFParams *KDFParams
+}
+
+// RestoreOptions controls how a backup is restored.
+type RestoreOptions struct {
+	// Passphrase decrypts an encrypted backup.
+	Passphrase []byte
+
+	// Signer is the trusted certificate whose key must have signed the
+	// backup, usually the CA's own certificate.
+	Signer *Certificate
+
+	// Fingerprint pins the certificate contained in the backup by the hex
+	// encoded SHA-256 digest of its DER encoding, as an alternative to Signer.
+	// The backup must be signed by that certificate's key.
+	Fingerprint string
+
+	// IntegrityOnly allows restoring without a Signer or Fingerprint, by
+	// checking the backup against the certificate it contains. This only
+	// detects corruption, not forgery, since anyone can make a backup that
+	// passes this check.
+	IntegrityOnly bool
+
+	// Force allows existing entries in the target Store to be overwritten.
+	Force bool
+}
+
+// BackupManifest describes the contents of a backup.
+type BackupManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Subject string    `json:"subject"`
+	// Files maps every file in the backup to the hex encoded SHA-256 digest
+	// of its contents.
+	Files map[string]string `json:"files"`
+	// Pairs lists the private keys in the backup along with their
+	// certificates.
+	Pairs []BackupPair `json:"pairs"`
+}
+
+// BackupPair names a private key file and the certificate file that goes with
+// it.
+type BackupPair struct {
+	Key  string `json:"key"`
+	Cert string `json:"cert"`
+}
+
+// Backup writes the CA's key, certificate chain and issuance ledger, plus any
+// configuration in opts, to w as a tar archive. The archive includes a
+// manifest of SHA-256 digests, signed with the CA's key. If opts.Passphrase is
+// set, the whole archive is encrypted.
+func (ca *CA) Backup(w io.Writer, opts *BackupOptions) error {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	chain := ca.Cert.PEMEncoded()
+	for _, cert := range opts.Chain {
+		chain = append(chain, cert.PEMEncoded()...)
+	}
+	files := map[string][]byte{
+		BackupKeyName:   ca.Key.PEMEncoded(),
+		BackupChainName: chain,
+	}
+	if ca.Ledger != nil {
+		entries, err := ca.Ledger.Query()
+		if err != nil {
+			return fmt.Errorf("Unable to read ledger: %w", err)
+		}
+		if files[BackupLedgerName], err = encodeLedgerEntries(entries); err != nil {
+			return err
+		}
+	}
+	for name, data := range opts.Config {
+		files[path.Join(BackupConfigDir, name)] = data
+	}
+
+	manifest := &BackupManifest{
+		Version: backupVersion1,
+		Created: ca.Generator.Now().UTC(),
+		Subject: ca.Cert.X509().Subject.String(),
+		Files:   make(map[string]string, len(files)),
+		Pairs:   []BackupPair{{Key: BackupKeyName, Cert: BackupChainName}},
+	}
+	for name, data := range files {
+		manifest.Files[name] = sha256Hex(data)
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(manifestBytes)
+	sig, err := rsa.SignPKCS1v15(ca.Generator.rand(), ca.Key.rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return fmt.Errorf("Unable to sign backup manifest: %w", err)
+	}
+	files[backupManifestName] = manifestBytes
+	files[backupSignatureName] = sig
+
+	if len(opts.Passphrase) == 0 {
+		return writeTar(w, manifest.Created, files)
+	}
+	var inner bytes.Buffer
+	if err := writeTar(&inner, manifest.Created, files); err != nil {
+		return err
+	}
+	params := opts.KDFParams
+	if params == nil {
+		params = &DefaultKDFParams
+	}
+	meta, key, err := newPassphraseMeta(ca.Generator.rand(), opts.Passphrase, *params)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if meta.Check, err = sealFrom(ca.Generator.rand(), aead, checkName(meta), nil); err != nil {
+		return err
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealFrom(ca.Generator.rand(), aead, backupSealedName, inner.Bytes())
+	if err != nil {
+		return err
+	}
+	return writeTar(w, manifest.Created, map[string][]byte{
+		backupEncryptionName: metaBytes,
+		backupSealedName:     sealed,
+	})
+}
+
+// RestoreBackup reads a backup made by CA.Backup from r and writes its files
+// into store under the names in the manifest (BackupKeyName etc). Before
+// writing anything, it verifies the manifest's signature and every file's
+// digest, and checks that each key matches its certificate. The signature is
+// authenticated with opts.Signer or opts.Fingerprint; without either, it fails
+// with ErrBackupUnauthenticated unless opts.IntegrityOnly is set. Unless
+// opts.Force is set, it refuses to overwrite existing entries. The entries are
+// locked (see Locker) while they're checked and written.
+func RestoreBackup(r io.Reader, store Store, opts *RestoreOptions) (*BackupManifest, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	if opts.Signer == nil && opts.Fingerprint == "" && !opts.IntegrityOnly {
+		return nil, ErrBackupUnauthenticated
+	}
+	files, err := readTar(r)
+	if err != nil {
+		return nil, err
+	}
+	if metaBytes, encrypted := files[backupEncryptionName]; encrypted {
+		if files, err = decryptBackup(metaBytes, files[backupSealedName], opts.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	manifestBytes, sig := files[backupManifestName], files[backupSignatureName]
+	if manifestBytes == nil || sig == nil {
+		return nil, fmt.Errorf("%w: missing manifest or signature", ErrBackupCorrupt)
+	}
+	delete(files, backupManifestName)
+	delete(files, backupSignatureName)
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, fmt.Errorf("%w: unable to decode manifest: %s", ErrBackupCorrupt, err)
+	}
+	if manifest.Version != backupVersion1 {
+		return nil, fmt.Errorf("Unsupported backup version %d", manifest.Version)
+	}
+	if err := manifest.verifyFiles(files); err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*Certificate, len(manifest.Pairs))
+	for i, pair := range manifest.Pairs {
+		pk, err := LoadPKFromPEMBytes(files[pair.Key])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load %s from backup: %w", pair.Key, err)
+		}
+		cert, err := LoadCertificateFromPEMBytes(files[pair.Cert])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load %s from backup: %w", pair.Cert, err)
+		}
+		if !cert.MatchesKey(pk) {
+			return nil, fmt.Errorf("%w: %s doesn't match %s", ErrKeyMismatch, pair.Key, pair.Cert)
+		}
+		pairs[i] = cert
+	}
+
+	signer := opts.Signer
+	if signer == nil {
+		if len(pairs) == 0 {
+			return nil, fmt.Errorf("%w: no key to verify signature", ErrBackupCorrupt)
+		}
+		signer = pairs[0]
+		if opts.Fingerprint != "" && !strings.EqualFold(sha256Hex(signer.DER()), opts.Fingerprint) {
+			return nil, fmt.Errorf("%w: certificate doesn't match fingerprint", ErrBackupCorrupt)
+		}
+	}
+	if err := signer.X509().CheckSignature(x509.SHA256WithRSA, manifestBytes, sig); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupCorrupt, err)
+	}
+
+	// Hold the locks that writers of these entries use, so that nothing can be
+	// written between checking for existing entries and restoring them
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	unlock, err := lockStoreEntries(store, names, DefaultLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if !opts.Force {
+		for name := range files {
+			if _, err := store.Get(name); err == nil {
+				return nil, fmt.Errorf("%w: %s", ErrWouldOverwrite, name)
+			}
+		}
+	}
+	if err := store.PutAll(files); err != nil {
+		return nil, fmt.Errorf("Unable to restore backup: %w", err)
+	}
+	return manifest, nil
+}
+
+// verifyFiles checks that files contains exactly the files listed in the
+// manifest, with the right digests.
+func (manifest *BackupManifest) verifyFiles(files map[string][]byte) error {
+	for name, data := range files {
+		expected, found := manifest.Files[name]
+		if !found {
+			return fmt.Errorf("%w: %s isn't listed in manifest", ErrBackupCorrupt, name)
+		}
+		if sha256Hex(data) != expected {
+			return fmt.Errorf("%w: digest mismatch for %s", ErrBackupCorrupt, name)
+		}
+	}
+	for name := range manifest.Files {
+		if _, found := files[name]; !found {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, name)
+		}
+	}
+	for _, pair := range manifest.Pairs {
+		if _, found := files[pair.Key]; !found {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, pair.Key)
+		}
+		if _, found := files[pair.Cert]; !found {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, pair.Cert)
+		}
+	}
+	return nil
+}
+
+func decryptBackup(metaBytes []byte, sealed []byte, passphrase []byte) (map[string][]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, &Error{Op: "decrypt backup", Kind: ErrWrongPassphrase, Err: errors.New("backup is encrypted, but no passphrase was given")}
+	}
+	meta := &keystoreMeta{}
+	if err := json.Unmarshal(metaBytes, meta); err != nil {
+		return nil, fmt.Errorf("Unable to decode backup encryption metadata: %w", err)
+	}
+	key, err := deriveMasterKey(passphrase, meta.Salt, meta.KDF)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unseal(aead, checkName(meta), meta.Check); err != nil {
+		return nil, &Error{Op: "decrypt backup", Kind: ErrWrongPassphrase}
+	}
+	inner, err := unseal(aead, backupSealedName, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupCorrupt, err)
+	}
+	return readTar(bytes.NewReader(inner))
+}
+
+// writeTar writes files to w as a tar archive, in sorted order.
+func writeTar(w io.Writer, modTime time.Time, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		data := files[name]
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0600,
+			Size:     int64(len(data)),
+			ModTime:  modTime,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("Unable to write backup: %w", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("Unable to write backup: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("Unable to write backup: %w", err)
+	}
+	return nil
+}
+
+// readTar reads all regular files from the tar archive in r.
+func readTar(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%w: invalid file name %q", ErrBackupCorrupt, hdr.Name)
+		}
+		if hdr.Size > maxBackupEntrySize {
+			return nil, fmt.Errorf("%w: %s is too large", ErrBackupCorrupt, name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBackupEntrySize))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read backup: %w", err)
+		}
+		files[name] = data
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,179 @@
+package keyman
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackupCA(t *testing.T) *CA {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(TWO_WEEKS), true, nil, "Test Org", "Test CA")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ca := NewCA(pk, cert, nil)
+	leafKey, _ := GeneratePK(1024)
+	_, err = ca.TLSCertificateFor(&leafKey.rsaKey.PublicKey, "tester", time.Now().Add(ONE_WEEK), "Test Org", "leaf", "leaf.example.com")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return ca
+}
+
+func TestBackupRestore(t *testing.T) {
+	ca := testBackupCA(t)
+	var archive bytes.Buffer
+	err := ca.Backup(&archive, &BackupOptions{Config: map[string][]byte{"ca.json": []byte(`{"name":"test"}`)}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir := t.TempDir()
+	store := NewDirStore(dir)
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), store, nil)
+	assert.ErrorIs(t, err, ErrBackupUnauthenticated, "Restoring should require a trusted signer")
+	manifest, err := RestoreBackup(bytes.NewReader(archive.Bytes()), store, &RestoreOptions{Signer: ca.Cert})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "CN=Test CA,O=Test Org", manifest.Subject)
+	names, _ := store.List()
+	assert.Equal(t, []string{BackupChainName, "config/ca.json", BackupKeyName, BackupLedgerName}, names)
+
+	pk, err := LoadPKFromStore(store, BackupKeyName)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ca.Key.PEMEncoded(), pk.PEMEncoded())
+	}
+	entries, err := NewFileLedger(filepath.Join(dir, BackupLedgerName)).Query()
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{"leaf.example.com", "leaf"}, entries[0].DNSNames)
+	}
+
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), store, &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrWouldOverwrite)
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), store, &RestoreOptions{Signer: ca.Cert, Force: true})
+	assert.NoError(t, err, "Force should allow overwriting")
+
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{Fingerprint: sha256Hex(ca.Cert.DER())})
+	assert.NoError(t, err, "Pinned fingerprint should authenticate backup")
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{IntegrityOnly: true})
+	assert.NoError(t, err)
+
+	other := testBackupCA(t)
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{Signer: other.Cert})
+	assert.ErrorIs(t, err, ErrBackupCorrupt, "Backup signed by someone else should be refused")
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{Fingerprint: sha256Hex(other.Cert.DER())})
+	assert.ErrorIs(t, err, ErrBackupCorrupt, "Backup of another CA should be refused")
+}
+
+func TestRestoreTamperedBackup(t *testing.T) {
+	ca := testBackupCA(t)
+	other := testBackupCA(t)
+	var archive bytes.Buffer
+	if !assert.NoError(t, ca.Backup(&archive, nil)) {
+		return
+	}
+	files, err := readTar(&archive)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rewrite := func(change func(files map[string][]byte)) *bytes.Buffer {
+		copied := make(map[string][]byte)
+		for name, data := range files {
+			copied[name] = data
+		}
+		change(copied)
+		var buf bytes.Buffer
+		assert.NoError(t, writeTar(&buf, time.Now(), copied))
+		return &buf
+	}
+
+	_, err = RestoreBackup(rewrite(func(files map[string][]byte) {
+		files[BackupLedgerName] = append(files[BackupLedgerName], '\n')
+	}), NewMemStore(), &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrBackupCorrupt, "Modified file should be detected")
+
+	_, err = RestoreBackup(rewrite(func(files map[string][]byte) {
+		files["extra"] = []byte("extra")
+	}), NewMemStore(), &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrBackupCorrupt, "Unlisted file should be detected")
+
+	_, err = RestoreBackup(rewrite(func(files map[string][]byte) {
+		files[BackupChainName] = other.Cert.PEMEncoded()
+		manifest := files[backupManifestName]
+		files[backupManifestName] = bytes.Replace(manifest, []byte(sha256Hex(ca.Cert.PEMEncoded())), []byte(sha256Hex(other.Cert.PEMEncoded())), 1)
+	}), NewMemStore(), &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrKeyMismatch, "Key should be checked against cert")
+
+	_, err = RestoreBackup(rewrite(func(files map[string][]byte) {
+		files[BackupLedgerName] = nil
+		manifest := files[backupManifestName]
+		files[backupManifestName] = bytes.Replace(manifest, []byte(sha256Hex(manifestLedger(t, ca))), []byte(sha256Hex(nil)), 1)
+	}), NewMemStore(), &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrBackupCorrupt, "Modified manifest should fail signature check")
+}
+
+func manifestLedger(t *testing.T, ca *CA) []byte {
+	entries, _ := ca.Ledger.Query()
+	data, err := encodeLedgerEntries(entries)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	ca := testBackupCA(t)
+	var archive bytes.Buffer
+	err := ca.Backup(&archive, &BackupOptions{Passphrase: []byte("secret"), KDFParams: testKDFParams})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, bytes.Contains(archive.Bytes(), []byte("PRIVATE KEY")), "Key should not appear in the clear")
+
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{Signer: ca.Cert})
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), NewMemStore(), &RestoreOptions{Signer: ca.Cert, Passphrase: []byte("wrong")})
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	store := NewMemStore()
+	_, err = RestoreBackup(bytes.NewReader(archive.Bytes()), store, &RestoreOptions{Signer: ca.Cert, Passphrase: []byte("secret")})
+	if assert.NoError(t, err) {
+		cert, err := LoadCertificateFromStore(store, BackupChainName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ca.Cert.PEMEncoded(), cert.PEMEncoded())
+		}
+	}
+}
+
+func TestRestoreWaitsForWriters(t *testing.T) {
+	ca := testBackupCA(t)
+	var archive bytes.Buffer
+	if !assert.NoError(t, ca.Backup(&archive, nil)) {
+		return
+	}
+
+	store := NewDirStore(t.TempDir())
+	unlock, err := store.Lock(BackupKeyName, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	restored := make(chan error, 1)
+	go func() {
+		_, err := RestoreBackup(bytes.NewReader(archive.Bytes()), store, &RestoreOptions{Signer: ca.Cert})
+		restored <- err
+	}()
+	// A writer holding the lock creates the entry while the restore waits
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, store.Put(BackupKeyName, []byte("written concurrently")))
+	unlock()
+
+	assert.ErrorIs(t, <-restored, ErrWouldOverwrite, "Restore should see entries written while it waited")
+	data, _ := store.Get(BackupKeyName)
+	assert.Equal(t, []byte("written concurrently"), data)
+}
@@ -0,0 +1,85 @@
+package keyman
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// CA issues certificates signed by a PrivateKey and its Certificate, and
+// records every certificate it issues in a Ledger.
+type CA struct {
+	Key    *PrivateKey
+	Cert   *Certificate
+	Ledger Ledger
+	// Generator determines the time and entropy used for issuance,
+	// revocation, CRLs and backups, defaults to using the system clock and
+	// crypto/rand.
+	Generator *Generator
+}
+
+// NewCA constructs a CA. If ledger is nil, issued certificates are recorded in
+// a MemLedger.
+func NewCA(key *PrivateKey, cert *Certificate, ledger Ledger) *CA {
+	if ledger == nil {
+		ledger = NewMemLedger()
+	}
+	return &CA{Key: key, Cert: cert, Ledger: ledger}
+}
+
+// Issue generates a certificate for the given public key based on the given
+// template and records it in the Ledger on behalf of requester. Serial numbers
+// that have already been issued are refused with ErrDuplicateSerial by the
+// Ledger when recording, so that concurrent calls can't both issue the same
+// serial number. A refused certificate is never returned.
+func (ca *CA) Issue(template *x509.Certificate, publicKey interface{}, requester string) (*Certificate, error) {
+	cert, err := ca.Generator.CertificateForKey(ca.Key, template, ca.Cert, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.Ledger.Record(NewLedgerEntry(cert, requester)); err != nil {
+		return nil, fmt.Errorf("Unable to record issued certificate: %w", err)
+	}
+	emitCert(EventCertCreated, "", cert)
+	return cert, nil
+}
+
+// TLSCertificateFor issues a TLS certificate for the given public key, like
+// PrivateKey.TLSCertificateFor does for its own key.
+func (ca *CA) TLSCertificateFor(publicKey interface{}, requester string, validUntil time.Time, organization string, commonName string, hosts ...string) (*Certificate, error) {
+	serial, err := ca.Generator.serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	return ca.Issue(tlsTemplate(serial, ca.Generator.Now(), validUntil, false, false, organization, commonName, hosts...), publicKey, requester)
+}
+
+// Revoke marks the certificate with the given serial number as revoked.
+func (ca *CA) Revoke(serial *big.Int, reason int) error {
+	return ca.Ledger.Revoke(serial, ca.Generator.Now(), reason)
+}
+
+// CRL generates a DER-encoded CRL of all certificates revoked by this CA,
+// valid until nextUpdate. The CA's certificate must allow signing CRLs, see
+// PrivateKey.CRLIssuerCertificateFor. The CRL number is drawn at random, like
+// serial numbers, so that CRLs generated at the same time are still told
+// apart.
+func (ca *CA) CRL(nextUpdate time.Time) ([]byte, error) {
+	number, err := ca.Generator.serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	return ca.Generator.CRL(ca.Key, ca.Cert, ca.Ledger, number, ca.Generator.Now(), nextUpdate)
+}
+
+// WriteOpenSSLIndex writes every certificate recorded in the CA's Ledger in
+// the format of OpenSSL's index.txt, as of the Generator's Clock.
+func (ca *CA) WriteOpenSSLIndex(w io.Writer) error {
+	entries, err := ca.Ledger.Query()
+	if err != nil {
+		return err
+	}
+	return ca.Generator.WriteOpenSSLIndex(w, entries)
+}
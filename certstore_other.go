@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package keyman
+
+// listCertStore fails with ErrNotSupported, since system certificate stores
+// only exist on Windows.
+func listCertStore(storeName string) ([]*Certificate, error) {
+	return nil, &Error{Op: "open certificate store", Path: storeName, Kind: ErrNotSupported}
+}
+
+// certimporterPath returns the name of certimporter.exe, which is only bundled
+// on Windows.
+func certimporterPath() string {
+	return "certimporter.exe"
+}
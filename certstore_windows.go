@@ -0,0 +1,46 @@
+package keyman
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// listCertStore enumerates the named system certificate store using crypt32.
+func listCertStore(storeName string) ([]*Certificate, error) {
+	name, err := windows.UTF16PtrFromString(storeName)
+	if err != nil {
+		return nil, err
+	}
+	store, err := windows.CertOpenSystemStore(0, name)
+	if err != nil {
+		return nil, &Error{Op: "open certificate store", Path: storeName, Err: err}
+	}
+	defer func() {
+		if err := windows.CertCloseStore(store, 0); err != nil {
+			log.Debugf("Unable to close certificate store: %v", err)
+		}
+	}()
+
+	var certs []*Certificate
+	var certCtx *windows.CertContext
+	for {
+		// Passing the previous context frees it
+		certCtx, _ = windows.CertEnumCertificatesInStore(store, certCtx)
+		if certCtx == nil {
+			return certs, nil
+		}
+		der := append([]byte(nil), unsafe.Slice(certCtx.EncodedCert, certCtx.Length)...)
+		cert, err := LoadCertificateFromDERBytes(der)
+		if err != nil {
+			log.Debugf("Skipping unparseable certificate in %v: %v", storeName, err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// certimporterPath returns the path of the bundled certimporter.exe.
+func certimporterPath() string {
+	return cebe.Filename
+}
@@ -0,0 +1,133 @@
+package keyman
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+var (
+	// SystemClock tells the time using time.Now.
+	SystemClock Clock = ClockFunc(time.Now)
+
+	defaultGenerator = &Generator{}
+
+	// serialNumberLimit bounds random serial numbers to 128 bits, like
+	// crypto/tls does
+	serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// FixedClock constructs a Clock that always tells the given time.
+func FixedClock(t time.Time) Clock {
+	return ClockFunc(func() time.Time { return t })
+}
+
+// Generator generates keys and issues certificates using a Clock and an
+// entropy source, which CA also uses for CRLs and backups. The time determines NotBefore backdating and default
+// validity periods, and serial numbers are drawn from the entropy source, so a
+// Generator with a fixed Clock and a deterministic Rand issues byte-identical
+// certificates for the same key and parameters.
+//
+// The zero value uses SystemClock and crypto/rand.Reader. Note that recent
+// versions of crypto/rsa deliberately don't generate keys deterministically,
+// even from a deterministic Rand.
+type Generator struct {
+	Clock Clock
+	Rand  io.Reader
+}
+
+// Now returns the current time according to the Generator's Clock.
+func (g *Generator) Now() time.Time {
+	if g == nil || g.Clock == nil {
+		return time.Now()
+	}
+	return g.Clock.Now()
+}
+
+func (g *Generator) rand() io.Reader {
+	if g == nil || g.Rand == nil {
+		return rand.Reader
+	}
+	return g.Rand
+}
+
+// serialNumber draws a random 128-bit serial number from the Generator's
+// entropy source.
+func (g *Generator) serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(g.rand(), serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// TenYearsFromNow returns the default expiration for stored certificates,
+// computed from the current time so that it doesn't go stale in long running
+// processes.
+func (g *Generator) TenYearsFromNow() time.Time {
+	return g.Now().AddDate(10, 0, 0)
+}
+
+// GeneratePK generates a PrivateKey with a specified size in bits.
+func (g *Generator) GeneratePK(bits int) (*PrivateKey, error) {
+	rsaKey, err := rsa.GenerateKey(g.rand(), bits)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{rsaKey: rsaKey}, nil
+}
+
+// CertificateForKey is like PrivateKey.CertificateForKey, using the
+// Generator's entropy source.
+func (g *Generator) CertificateForKey(key *PrivateKey, template *x509.Certificate, issuer *Certificate, publicKey interface{}) (*Certificate, error) {
+	var issuerCert *x509.Certificate
+	if issuer == nil {
+		issuerCert = template
+	} else {
+		issuerCert = issuer.cert
+	}
+	derBytes, err := x509.CreateCertificate(g.rand(), template, issuerCert, publicKey, key.rsaKey)
+	if err != nil {
+		return nil, err
+	}
+	return bytesToCert(derBytes)
+}
+
+// TLSCertificateFor is like PrivateKey.TLSCertificateFor, using the
+// Generator's Clock and entropy source.
+func (g *Generator) TLSCertificateFor(key *PrivateKey, validUntil time.Time, isCA bool, issuer *Certificate, organization string, commonName string, hosts ...string) (*Certificate, error) {
+	serial, err := g.serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := tlsTemplate(serial, g.Now(), validUntil, isCA, issuer == nil, organization, commonName, hosts...)
+	return g.CertificateForKey(key, template, issuer, &key.rsaKey.PublicKey)
+}
+
+// CRLIssuerCertificateFor is like PrivateKey.CRLIssuerCertificateFor, using
+// the Generator's Clock and entropy source.
+func (g *Generator) CRLIssuerCertificateFor(key *PrivateKey, validUntil time.Time, issuer *Certificate, organization string, commonName string, hosts ...string) (*Certificate, error) {
+	serial, err := g.serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := tlsTemplate(serial, g.Now(), validUntil, true, issuer == nil, organization, commonName, hosts...)
+	template.KeyUsage = template.KeyUsage | x509.KeyUsageCRLSign
+	return g.CertificateForKey(key, template, issuer, &key.rsaKey.PublicKey)
+}
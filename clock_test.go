@@ -0,0 +1,145 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/x509"
+	mathrand "math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeterministicIssuance(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	gen := &Generator{Clock: FixedClock(now)}
+	pk, err := gen.GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	issue := func(gen *Generator) *Certificate {
+		cert, err := gen.TLSCertificateFor(pk, now.Add(ONE_WEEK), true, nil, "Test Org", "TestCommonName", "127.0.0.1")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return cert
+	}
+	seeded := func() *Generator {
+		return &Generator{Clock: gen.Clock, Rand: mathrand.New(mathrand.NewSource(1))}
+	}
+	cert1 := issue(seeded())
+	assert.Equal(t, cert1.DER(), issue(seeded()).DER(), "Same clock, entropy and key should give byte-identical certs")
+	assert.Equal(t, now.AddDate(0, -1, 0), cert1.X509().NotBefore)
+
+	// Serial numbers are random even though the time is fixed
+	cert2 := issue(gen)
+	assert.NotEqual(t, cert1.X509().SerialNumber, cert2.X509().SerialNumber)
+	assert.True(t, cert2.X509().SerialNumber.BitLen() <= 128)
+	assert.NotEqual(t, cert2.X509().SerialNumber, issue(gen).X509().SerialNumber)
+
+	store := NewMemStore()
+	_, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", &PKAndCertOptions{
+		Organization: "Test Org",
+		CommonName:   "TestCommonName",
+		Generator:    gen,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, now.AddDate(10, 0, 0), cert.X509().NotAfter, "Default validity should be computed from the clock")
+	}
+
+	ca := NewCA(pk, cert1, nil)
+	ca.Generator = gen
+	leaf1, err := ca.TLSCertificateFor(&pk.RSA().PublicKey, "tester", now.Add(ONE_WEEK), "Test Org", "leaf")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, now.AddDate(0, -1, 0), leaf1.X509().NotBefore)
+	if assert.NoError(t, ca.Revoke(leaf1.X509().SerialNumber, 1)) {
+		entry, err := ca.Ledger.Get(leaf1.X509().SerialNumber)
+		if assert.NoError(t, err) {
+			assert.Equal(t, &now, entry.RevokedAt)
+		}
+	}
+}
+
+func TestGeneratorInCAPaths(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	seeded := func() *Generator {
+		return &Generator{Clock: FixedClock(now), Rand: mathrand.New(mathrand.NewSource(1))}
+	}
+	caCert, err := seeded().CRLIssuerCertificateFor(pk, now.AddDate(1, 0, 0), nil, "Test Org", "Test CA")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ca := NewCA(pk, caCert, nil)
+	ca.Generator = seeded()
+	leaf, err := ca.TLSCertificateFor(&pk.RSA().PublicKey, "tester", now.Add(ONE_WEEK), "Test Org", "leaf")
+	if !assert.NoError(t, err) || !assert.NoError(t, ca.Revoke(leaf.X509().SerialNumber, 1)) {
+		return
+	}
+
+	crl1, err := ca.CRL(now.Add(ONE_WEEK))
+	if !assert.NoError(t, err) {
+		return
+	}
+	crl2, _ := ca.CRL(now.Add(ONE_WEEK))
+	parsed1, err := x509.ParseRevocationList(crl1)
+	parsed2, err2 := x509.ParseRevocationList(crl2)
+	if assert.NoError(t, err) && assert.NoError(t, err2) {
+		assert.Equal(t, now, parsed1.ThisUpdate)
+		assert.NotEqual(t, parsed1.Number, parsed2.Number, "CRLs generated at the same time should have different numbers")
+	}
+
+	backup := func() []byte {
+		ca.Generator = seeded()
+		var archive bytes.Buffer
+		if !assert.NoError(t, ca.Backup(&archive, &BackupOptions{Passphrase: []byte("secret"), KDFParams: testKDFParams})) {
+			t.FailNow()
+		}
+		return archive.Bytes()
+	}
+	assert.Equal(t, backup(), backup(), "Same clock and entropy should give identical backups")
+	manifest, err := RestoreBackup(bytes.NewReader(backup()), NewMemStore(), &RestoreOptions{Passphrase: []byte("secret"), Signer: caCert})
+	if assert.NoError(t, err) {
+		assert.Equal(t, now, manifest.Created)
+	}
+
+	// Expiry is judged by the clock rather than the system time
+	var index bytes.Buffer
+	ca.Generator = &Generator{Clock: FixedClock(now.AddDate(1, 0, 0))}
+	if assert.NoError(t, ca.WriteOpenSSLIndex(&index)) {
+		assert.True(t, strings.HasPrefix(index.String(), "R\t"), index.String())
+	}
+	dir := t.TempDir()
+	assert.NoError(t, caCert.WriteToFile(filepath.Join(dir, "ca.pem")))
+	expiring, err := (&Generator{Clock: FixedClock(now)}).ScanForExpiring(dir, ONE_WEEK)
+	if assert.NoError(t, err) {
+		assert.Empty(t, expiring, "CA cert doesn't expire within a week of the clock")
+	}
+	expiring, err = (&Generator{Clock: FixedClock(now.AddDate(1, 0, 0))}).ScanForExpiring(dir, ONE_WEEK)
+	if assert.NoError(t, err) {
+		assert.Len(t, expiring, 1, "CA cert has expired by the clock")
+	}
+}
+
+func TestTenYearsFromNow(t *testing.T) {
+	clock := &movingClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	gen := &Generator{Clock: clock}
+	first := gen.TenYearsFromNow()
+	clock.now = clock.now.AddDate(0, 6, 0)
+	assert.Equal(t, first.AddDate(0, 6, 0), gen.TenYearsFromNow(), "Default validity should not go stale")
+}
+
+type movingClock struct {
+	now time.Time
+}
+
+func (c *movingClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,78 @@
+package keyman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefaultTrustTimeout limits how long each external command run by trust
+	// operations may take, unless the operation's context has a deadline. It
+	// needs to leave users enough time to answer elevation prompts.
+	DefaultTrustTimeout = 2 * time.Minute
+
+	// terminationGracePeriod is how long a command has to exit after being
+	// asked to terminate before it's killed.
+	terminationGracePeriod = 5 * time.Second
+)
+
+// runCommand runs the given command until it completes or the context is done,
+// returning its combined output. If the context is done, the command is asked
+// to terminate and killed if it doesn't, and the context's error is returned.
+// If the context has no deadline, the command is terminated after
+// DefaultTrustTimeout and fails with ErrTimeout.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	cmdCtx := ctx
+	if _, ok := ctx.Deadline(); !ok && DefaultTrustTimeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, DefaultTrustTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-cmdCtx.Done():
+		terminate(cmd, done)
+		if err := ctx.Err(); err != nil {
+			return out.Bytes(), err
+		}
+		return out.Bytes(), fmt.Errorf("%w after %v", ErrTimeout, DefaultTrustTimeout)
+	}
+}
+
+// terminate asks the command's process to terminate, giving it
+// terminationGracePeriod to clean up before killing it, and waits for it to
+// exit. done receives the result of waiting for the command.
+func terminate(cmd *exec.Cmd, done <-chan error) {
+	// Windows doesn't support SIGTERM, so the process is killed right away
+	if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-done:
+			return
+		case <-time.After(terminationGracePeriod):
+		}
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		log.Debugf("Unable to kill %v: %v", cmd.Path, err)
+	}
+	<-done
+}
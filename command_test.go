@@ -0,0 +1,88 @@
+package keyman
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test commands need a POSIX shell")
+	}
+
+	out, err := runCommand(context.Background(), exec.Command("sh", "-c", "echo out; echo err >&2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "out\nerr\n", string(out))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = runCommand(ctx, exec.Command("sleep", "10"))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, IsCanceled(err))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "Canceled command should be terminated")
+
+	_, err = runCommand(ctx, exec.Command("true"))
+	assert.True(t, IsCanceled(err), "Command should not be started with a done context")
+
+	oldTimeout, oldGracePeriod := DefaultTrustTimeout, terminationGracePeriod
+	defer func() {
+		DefaultTrustTimeout, terminationGracePeriod = oldTimeout, oldGracePeriod
+	}()
+	DefaultTrustTimeout, terminationGracePeriod = 50*time.Millisecond, 50*time.Millisecond
+	start = time.Now()
+	// Ignores SIGTERM, so needs to be killed
+	_, err = runCommand(context.Background(), exec.Command("sh", "-c", `trap "" TERM; exec sleep 10`))
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.False(t, IsCanceled(err), "Timing out should be a failure, not a cancellation")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "Command ignoring SIGTERM should be killed")
+	assert.True(t, errors.Is(trustCommandError("sleep", err, nil), ErrTimeout))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = runCommand(ctx, exec.Command("sleep", "0.2"))
+	assert.NoError(t, err, "Deadline of context should replace the default timeout")
+}
+
+func TestInstallTrustedRootCanceled(t *testing.T) {
+	cert := testRoot(t, "Test Root")
+	ctx, cancel := context.WithCancel(context.Background())
+	first, second := NewFakeTrustStore("first"), NewFakeTrustStore("second")
+	stores := []TrustStore{first, &cancelingTrustStore{first, cancel}, second}
+
+	result, err := cert.InstallTrustedRoot(ctx, stores, nil)
+	assert.True(t, IsCanceled(err))
+	var outcomes []TrustOutcome
+	for _, target := range result.Targets {
+		outcomes = append(outcomes, target.Outcome)
+	}
+	assert.Equal(t, []TrustOutcome{TrustInstalled, TrustCanceled, TrustCanceled}, outcomes)
+	assert.Empty(t, result.Failed(), "Cancellation is not a failure")
+	installed, _ := second.Contains(context.Background(), cert)
+	assert.False(t, installed, "Nothing should be installed after cancellation")
+}
+
+// cancelingTrustStore cancels the operation when installing in it.
+type cancelingTrustStore struct {
+	*FakeTrustStore
+	cancel context.CancelFunc
+}
+
+func (s *cancelingTrustStore) Name() string {
+	return "canceling"
+}
+
+func (s *cancelingTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	return false, nil
+}
+
+func (s *cancelingTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	s.cancel()
+	return ctx.Err()
+}
@@ -0,0 +1,161 @@
+package keyman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+)
+
+// Errors returned by keyman can be classified with errors.Is using the
+// sentinels below, as well as ErrKeyMismatch and ErrWrongPassphrase, and
+// inspected with errors.As using *Error and *PermissionError. Wrapped errors
+// always keep their underlying cause.
+var (
+	// ErrNotFound means that a key, certificate or store entry doesn't exist.
+	// It is fs.ErrNotExist, so the *fs.PathError returned for missing entries
+	// matches it and still satisfies os.IsNotExist.
+	ErrNotFound = fs.ErrNotExist
+
+	// ErrMalformedPEM means that data couldn't be decoded as the expected
+	// PEM encoded key or certificate.
+	ErrMalformedPEM = errors.New("Malformed PEM data")
+
+	// ErrUnsupportedKeyType means that a key was decoded but is of a type that
+	// keyman doesn't support.
+	ErrUnsupportedKeyType = errors.New("Unsupported key type")
+
+	// ErrUnsupportedKeyEncoding means that a key is of a supported type, but
+	// is encoded in a way that keyman doesn't support, like PKCS#8.
+	ErrUnsupportedKeyEncoding = errors.New("Unsupported key encoding")
+
+	// ErrInsecurePermissions means that a private key file, or the directory
+	// that holds it, is accessible by someone other than the current user.
+	// Such errors are *PermissionError.
+	ErrInsecurePermissions = errors.New("Insecure permissions")
+
+	// ErrNotSupported means that an operation isn't supported on this
+	// platform or by this TrustStore.
+	ErrNotSupported = errors.New("Operation not supported")
+
+	// ErrTrustToolMissing means that the command line tool needed to manage a
+	// trust store (e.g. certutil or security) isn't installed.
+	ErrTrustToolMissing = errors.New("Trust store tool not found")
+
+	// ErrElevationDeclined means that the user declined to grant the
+	// privileges needed to modify a trust store.
+	ErrElevationDeclined = errors.New("User declined elevation")
+
+	// ErrTrustStoreLocked means that a trust store is locked or in use and
+	// can't be modified right now.
+	ErrTrustStoreLocked = errors.New("Trust store is locked")
+
+	// ErrTimeout means that an external command took longer than
+	// DefaultTrustTimeout and was terminated.
+	ErrTimeout = errors.New("Timed out")
+
+	// ErrStaleRoot means that a trust store contains a different certificate
+	// with the same common name as the one being installed.
+	ErrStaleRoot = errors.New("Trust store contains a stale root with the same name")
+
+	// elevationDeclinedMarkers and trustStoreLockedMarkers are error codes
+	// found in the output of trust store tools and elevation helpers when they
+	// fail for the corresponding reason. Only codes are used, since messages
+	// are localized.
+	elevationDeclinedMarkers = []string{
+		"(-128)", // userCanceledErr, from AppleScript prompts
+		"-60006", // errAuthorizationCanceled, from security
+	}
+	trustStoreLockedMarkers = []string{
+		"SEC_ERROR_LOCKED_DATABASE", // from certutil
+		"-25308",                    // errSecInteractionNotAllowed, from security on a locked keychain
+	}
+)
+
+const (
+	// pkexecDismissedExitCode is the documented exit status of pkexec when
+	// the user dismissed the authentication dialog.
+	pkexecDismissedExitCode = 126
+)
+
+// Error describes a failed keyman operation. Kind is one of the sentinel
+// errors above if the failure could be classified, and Err is the underlying
+// cause, if any. errors.Is matches both.
+type Error struct {
+	// Op describes the operation, e.g. "decode PEM encoded private key data"
+	Op string
+	// Path is the file, store entry or trust store involved, if any
+	Path string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	msg := "Unable to " + e.Op
+	if e.Path != "" {
+		msg += " " + e.Path
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of this Error.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && errors.Is(e.Kind, target)
+}
+
+// trustCommandError classifies the failure of a trust store tool, which may
+// have been run with elevated privileges, based on its error (see
+// ExecRunner.Run) and any error codes in its output.
+func trustCommandError(tool string, err error, out []byte) error {
+	e := &Error{Op: "run " + tool + " command", Err: fmt.Errorf("%w\n%s", err, out)}
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		e.Kind = ErrTrustToolMissing
+	case errors.Is(err, ErrTimeout):
+		e.Kind = ErrTimeout
+	case errors.Is(err, ErrElevationDeclined):
+		e.Kind = ErrElevationDeclined
+	case containsAny(out, elevationDeclinedMarkers):
+		e.Kind = ErrElevationDeclined
+	case containsAny(out, trustStoreLockedMarkers):
+		e.Kind = ErrTrustStoreLocked
+	}
+	return e
+}
+
+// IsCanceled reports whether err is due to the context of an operation being
+// canceled or reaching its deadline, rather than the operation failing.
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func containsAny(out []byte, markers []string) bool {
+	for _, marker := range markers {
+		if bytes.Contains(out, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCode returns the exit status of the process that failed with err, or -1
+// if err isn't an *exec.ExitError.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,129 @@
+package keyman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadErrors(t *testing.T) {
+	_, err := LoadPKFromFile(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.True(t, os.IsNotExist(err), "Missing file should still satisfy os.IsNotExist")
+
+	_, err = LoadPKFromPEMBytes([]byte("garbage"))
+	assert.ErrorIs(t, err, ErrMalformedPEM)
+	assert.NotContains(t, err.Error(), "%!", "Error should not format a nil error")
+	var kerr *Error
+	if assert.True(t, errors.As(err, &kerr)) {
+		assert.Equal(t, "decode PEM encoded private key data", kerr.Op)
+	}
+
+	_, err = LoadPKFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: PEM_HEADER_PRIVATE_KEY, Bytes: []byte("garbage")}))
+	assert.ErrorIs(t, err, ErrMalformedPEM)
+
+	_, err = LoadCertificateFromPEMBytes([]byte("garbage"))
+	assert.ErrorIs(t, err, ErrMalformedPEM)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	_, err = LoadPKFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+	assert.ErrorIs(t, err, ErrUnsupportedKeyType)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	_, err = LoadPKFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	assert.ErrorIs(t, err, ErrUnsupportedKeyType)
+
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pkcs8, _ = x509.MarshalPKCS8PrivateKey(pk.RSA())
+	_, err = LoadPKFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	assert.ErrorIs(t, err, ErrUnsupportedKeyEncoding, "Only PKCS#1 encoded RSA keys are supported")
+	assert.False(t, errors.Is(err, ErrUnsupportedKeyType), "RSA keys are supported")
+
+	_, err = ParseJWK([]byte(`{"kty":"oct","k":"c2VjcmV0"}`))
+	assert.ErrorIs(t, err, ErrUnsupportedKeyType)
+}
+
+func TestErrorKinds(t *testing.T) {
+	backing := NewMemStore()
+	_, err := OpenSealedStore(backing, []byte("secret"), testKDFParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = OpenSealedStore(backing, []byte("wrong"), nil)
+	var kerr *Error
+	if assert.True(t, errors.As(err, &kerr), "Wrong passphrase should be an *Error") {
+		assert.Equal(t, ErrWrongPassphrase, kerr.Kind)
+	}
+
+	err = &PermissionError{Path: "pk.pem", Mode: 0644, Problem: "accessible by group or others"}
+	assert.ErrorIs(t, err, ErrInsecurePermissions)
+}
+
+func TestKeyPairMismatchError(t *testing.T) {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, _ := GeneratePK(1024)
+	cert, err := other.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "TestCommonName")
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := NewMemStore()
+	assert.NoError(t, store.PutAll(map[string][]byte{"pk.pem": pk.PEMEncoded(), "cert.pem": cert.PEMEncoded()}))
+	_, err = KeyPairIn(store, "127.0.0.1", "TestCommonName", "pk.pem", "cert.pem")
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+	var kerr *Error
+	if assert.True(t, errors.As(err, &kerr)) {
+		assert.Equal(t, "cert.pem and pk.pem", kerr.Path)
+		assert.NotNil(t, kerr.Err, "Underlying cause should be kept")
+	}
+}
+
+func TestTrustCommandError(t *testing.T) {
+	out, err := exec.Command("keyman-missing-trust-tool").CombinedOutput()
+	err = trustCommandError("keyman-missing-trust-tool", err, out)
+	assert.ErrorIs(t, err, ErrTrustToolMissing)
+	assert.ErrorIs(t, err, exec.ErrNotFound, "Underlying cause should be kept")
+
+	cause := errors.New("exit status 1")
+	for out, kind := range map[string]error{
+		"execution error: User canceled. (-128)":                                   ErrElevationDeclined,
+		"SecTrustSettingsSetTrustSettings: (-60006)":                               ErrElevationDeclined,
+		"certutil: function failed: SEC_ERROR_LOCKED_DATABASE: database is locked": ErrTrustStoreLocked,
+		"SecKeychainItemImport: (-25308)":                                          ErrTrustStoreLocked,
+	} {
+		err = trustCommandError("security", cause, []byte(out))
+		assert.ErrorIs(t, err, kind, out)
+		assert.ErrorIs(t, err, cause)
+	}
+	err = trustCommandError("security", cause, []byte("SecTrustSettingsSetTrustSettings: The authorization was canceled by the user."))
+	assert.True(t, strings.HasPrefix(err.Error(), "Unable to run security command: "))
+	assert.False(t, errors.Is(err, ErrElevationDeclined), "Messages shouldn't be classified, since they're localized")
+
+	err = trustCommandError("certutil", cause, []byte("certutil: something else"))
+	assert.False(t, errors.Is(err, ErrTrustStoreLocked) || errors.Is(err, ErrElevationDeclined) || errors.Is(err, ErrTrustToolMissing))
+
+	// pkexec's exit status is classified by ExecRunner
+	exitErr := exec.Command("sh", "-c", "exit 126").Run()
+	assert.Equal(t, pkexecDismissedExitCode, exitCode(exitErr))
+	assert.Equal(t, -1, exitCode(cause))
+	declined := &Error{Op: "elevate privileges for certutil", Kind: ErrElevationDeclined, Err: exitErr}
+	err = trustCommandError("certutil", declined, nil)
+	assert.ErrorIs(t, err, ErrElevationDeclined)
+	assert.ErrorIs(t, err, exitErr)
+}
@@ -0,0 +1,184 @@
+package keyman
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventKeyGenerated is emitted when a new private key is generated and
+	// stored.
+	EventKeyGenerated EventType = "key_generated"
+	// EventCertCreated is emitted when a certificate is issued where there was
+	// none before.
+	EventCertCreated EventType = "cert_created"
+	// EventLoaded is emitted when an existing key pair is loaded and used.
+	EventLoaded EventType = "loaded"
+	// EventRenewed is emitted when a stored certificate is reissued.
+	EventRenewed EventType = "renewed"
+	// EventTrustInstalled is emitted after an attempt to install a certificate
+	// as a trusted root. Err is set if the attempt failed.
+	EventTrustInstalled EventType = "trust_installed"
+	// EventTrustRemoved is emitted after an attempt to remove a trusted root.
+	// Err is set if the attempt failed.
+	EventTrustRemoved EventType = "trust_removed"
+	// EventTrustCheckFailed is emitted when a trust store is checked and the
+	// certificate isn't trusted there, or the check itself failed.
+	EventTrustCheckFailed EventType = "trust_check_failed"
+)
+
+var (
+	// StdoutObserver prints events to stdout. It isn't registered by default,
+	// use AddObserver(StdoutObserver) to opt in.
+	StdoutObserver = NewWriterObserver(os.Stdout)
+
+	observers   []*observerEntry
+	observersMx sync.RWMutex
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+// Event describes something that happened to a key, certificate or trust
+// store. Fields that don't apply to an event are left empty.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Name is the store entry or file involved
+	Name string
+
+	// Subject, Hosts, NotAfter and Fingerprint (hex encoded SHA-256 of the
+	// DER) describe the certificate involved
+	Subject     string
+	Hosts       []string
+	NotAfter    time.Time
+	Fingerprint string
+
+	// Target is the trust store involved
+	Target string
+
+	// Err is set if the operation failed
+	Err error
+}
+
+// String formats the Event on a single line.
+func (event *Event) String() string {
+	var b strings.Builder
+	b.WriteString(string(event.Type))
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(&b, " %s=%v", name, value)
+	}
+	if event.Name != "" {
+		field("name", event.Name)
+	}
+	if event.Subject != "" {
+		field("subject", event.Subject)
+	}
+	if len(event.Hosts) > 0 {
+		field("hosts", strings.Join(event.Hosts, ","))
+	}
+	if !event.NotAfter.IsZero() {
+		field("notAfter", event.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if event.Target != "" {
+		field("target", event.Target)
+	}
+	if event.Err != nil {
+		field("error", event.Err)
+	}
+	return b.String()
+}
+
+// Observer is notified of Events.
+type Observer interface {
+	Observe(event *Event)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(event *Event)
+
+func (f ObserverFunc) Observe(event *Event) {
+	f(event)
+}
+
+type observerEntry struct {
+	observer Observer
+}
+
+// AddObserver registers an Observer for all Events emitted by keyman.
+// Observers are called synchronously, in the order they were added. The
+// returned function unregisters the Observer.
+func AddObserver(observer Observer) (remove func()) {
+	entry := &observerEntry{observer}
+	observersMx.Lock()
+	observers = append(observers, entry)
+	observersMx.Unlock()
+	return func() {
+		observersMx.Lock()
+		defer observersMx.Unlock()
+		for i, e := range observers {
+			if e == entry {
+				observers = append(observers[:i:i], observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// NewWriterObserver constructs an Observer that writes each Event to w on its
+// own line.
+func NewWriterObserver(w io.Writer) Observer {
+	var mx sync.Mutex
+	return ObserverFunc(func(event *Event) {
+		mx.Lock()
+		defer mx.Unlock()
+		fmt.Fprintln(w, event)
+	})
+}
+
+func emit(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.Debugf("Event: %v", event)
+	observersMx.RLock()
+	current := observers
+	observersMx.RUnlock()
+	for _, entry := range current {
+		entry.observer.Observe(event)
+	}
+}
+
+// emitCert emits an event about the given certificate, which may be nil.
+func emitCert(eventType EventType, name string, cert *Certificate) {
+	event := &Event{Type: eventType, Name: name}
+	if cert != nil {
+		x := cert.X509()
+		event.Subject = x.Subject.CommonName
+		event.Hosts = append(event.Hosts, x.DNSNames...)
+		for _, ip := range x.IPAddresses {
+			event.Hosts = append(event.Hosts, ip.String())
+		}
+		event.NotAfter = x.NotAfter
+		event.Fingerprint = sha256Hex(cert.DER())
+	}
+	emit(event)
+}
+
+// emitTrust emits an event about a trust store operation on the given
+// certificate, which may be nil when only its common name is known.
+func emitTrust(eventType EventType, cert *Certificate, commonName string, target string, err error) {
+	event := &Event{Type: eventType, Subject: commonName, Target: target, Err: err}
+	if cert != nil {
+		x := cert.X509()
+		event.Subject = x.Subject.CommonName
+		event.NotAfter = x.NotAfter
+		event.Fingerprint = sha256Hex(cert.DER())
+	}
+	emit(event)
+}
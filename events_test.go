@@ -0,0 +1,77 @@
+package keyman
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingObserver struct {
+	events []*Event
+	mx     sync.Mutex
+}
+
+func (o *recordingObserver) Observe(event *Event) {
+	o.mx.Lock()
+	o.events = append(o.events, event)
+	o.mx.Unlock()
+}
+
+func (o *recordingObserver) types() []EventType {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	var types []EventType
+	for _, event := range o.events {
+		types = append(types, event.Type)
+	}
+	o.events = nil
+	return types
+}
+
+func TestStoredPKAndCertEvents(t *testing.T) {
+	observer := &recordingObserver{}
+	defer AddObserver(observer)()
+
+	store := NewMemStore()
+	opts := &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName", Hosts: []string{"127.0.0.1"}}
+	_, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	events := observer.events
+	assert.Equal(t, []EventType{EventKeyGenerated, EventCertCreated}, observer.types())
+	assert.Equal(t, "pk.pem", events[0].Name)
+	assert.Equal(t, "cert.pem", events[1].Name)
+	assert.Equal(t, "TestCommonName", events[1].Subject)
+	assert.Equal(t, []string{"TestCommonName", "127.0.0.1"}, events[1].Hosts)
+	assert.Equal(t, cert.X509().NotAfter, events[1].NotAfter)
+	assert.Equal(t, sha256Hex(cert.DER()), events[1].Fingerprint)
+
+	_, _, err = StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventLoaded}, observer.types())
+
+	opts.Hosts = []string{"127.0.0.2"}
+	_, _, err = StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventRenewed}, observer.types())
+
+	_, err = KeyPairIn(store, "127.0.0.2", "TestCommonName", "pk.pem", "cert.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventLoaded}, observer.types())
+
+	_, err = KeyPairIn(store, "127.0.0.1", "TestCommonName", "pk2.pem", "cert2.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventKeyGenerated, EventCertCreated}, observer.types())
+}
+
+func TestObserverRemoval(t *testing.T) {
+	var buf bytes.Buffer
+	remove := AddObserver(NewWriterObserver(&buf))
+	emitCert(EventLoaded, "cert.pem", nil)
+	remove()
+	emitCert(EventLoaded, "other.pem", nil)
+	assert.Equal(t, "loaded name=cert.pem\n", buf.String())
+}
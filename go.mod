@@ -7,6 +7,8 @@ require (
 	github.com/getlantern/elevate v0.0.0-20220903142053-479ab992b264
 	github.com/getlantern/golog v0.0.0-20230503153817-8e72de7e0a65
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0
 )
 
 require (
@@ -0,0 +1,541 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	jwkTypeRSA = "RSA"
+	jwkTypeEC  = "EC"
+	jwkTypeOKP = "OKP"
+
+	jwkCurveEd25519 = "Ed25519"
+)
+
+// JWK is a JSON Web Key (RFC 7517). Key holds one of *rsa.PrivateKey,
+// *rsa.PublicKey, *ecdsa.PrivateKey, *ecdsa.PublicKey, ed25519.PrivateKey or
+// ed25519.PublicKey.
+type JWK struct {
+	Key          interface{}
+	KeyID        string
+	Use          string
+	Algorithm    string
+	Certificates []*Certificate
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// jwkJSON is the wire representation of a JWK.
+type jwkJSON struct {
+	Kty     string   `json:"kty"`
+	Use     string   `json:"use,omitempty"`
+	Kid     string   `json:"kid,omitempty"`
+	Alg     string   `json:"alg,omitempty"`
+	Crv     string   `json:"crv,omitempty"`
+	N       string   `json:"n,omitempty"`
+	E       string   `json:"e,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	D       string   `json:"d,omitempty"`
+	P       string   `json:"p,omitempty"`
+	Q       string   `json:"q,omitempty"`
+	Dp      string   `json:"dp,omitempty"`
+	Dq      string   `json:"dq,omitempty"`
+	Qi      string   `json:"qi,omitempty"`
+	X5c     []string `json:"x5c,omitempty"`
+	X5tS256 string   `json:"x5t#S256,omitempty"`
+}
+
+// NewJWK wraps the given crypto key in a JWK whose key ID is its RFC 7638
+// thumbprint.
+func NewJWK(key interface{}) (*JWK, error) {
+	jwk := &JWK{Key: key}
+	kid, err := jwk.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = kid
+	jwk.Algorithm = defaultJWKAlgorithm(key)
+	jwk.Use = "sig"
+	return jwk, nil
+}
+
+// JWK returns this PrivateKey, including its private parts, as a JWK.
+func (key *PrivateKey) JWK() (*JWK, error) {
+	return NewJWK(key.rsaKey)
+}
+
+// PublicJWK returns the public half of this PrivateKey as a JWK.
+func (key *PrivateKey) PublicJWK() (*JWK, error) {
+	return NewJWK(&key.rsaKey.PublicKey)
+}
+
+// JWK returns the public key of this Certificate as a JWK that carries the
+// certificate in x5c.
+func (cert *Certificate) JWK() (*JWK, error) {
+	return CertificateChainJWK(cert)
+}
+
+// CertificateChainJWK returns the public key of the first certificate in the
+// given chain as a JWK that carries the whole chain in x5c.
+func CertificateChainJWK(chain ...*Certificate) (*JWK, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("Unable to create JWK from empty certificate chain")
+	}
+	jwk, err := NewJWK(chain[0].X509().PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk.Certificates = chain
+	return jwk, nil
+}
+
+// ParseJWK parses a JSON encoded JWK.
+func ParseJWK(data []byte) (*JWK, error) {
+	jwk := &JWK{}
+	if err := json.Unmarshal(data, jwk); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+// ParseJWKS parses a JSON encoded JWK Set. As recommended by RFC 7517
+// section 5, keys with a type or curve that isn't supported are skipped.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	in := &struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, in); err != nil {
+		return nil, fmt.Errorf("Unable to decode JWK Set: %w", err)
+	}
+	jwks := &JWKS{}
+	for _, data := range in.Keys {
+		jwk, err := ParseJWK(data)
+		if errors.Is(err, ErrUnsupportedKeyType) {
+			log.Debugf("Skipping key in JWK Set: %v", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// IsPrivate indicates whether this JWK holds a private key.
+func (jwk *JWK) IsPrivate() bool {
+	switch jwk.Key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return true
+	}
+	return false
+}
+
+// Public returns a copy of this JWK with the private parts removed.
+func (jwk *JWK) Public() *JWK {
+	pub := *jwk
+	pub.Key = publicKeyOf(jwk.Key)
+	return &pub
+}
+
+// PublicKey returns the public key held by this JWK.
+func (jwk *JWK) PublicKey() crypto.PublicKey {
+	return publicKeyOf(jwk.Key)
+}
+
+// PrivateKey returns the key held by this JWK as a keyman PrivateKey. Only
+// private RSA keys can be converted.
+func (jwk *JWK) PrivateKey() (*PrivateKey, error) {
+	rsaKey, ok := jwk.Key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Unable to convert JWK holding %T to PrivateKey", jwk.Key)
+	}
+	return &PrivateKey{rsaKey: rsaKey}, nil
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 thumbprint of this JWK.
+func (jwk *JWK) Thumbprint() (string, error) {
+	// The required members must appear in lexicographic order without
+	// whitespace, which is exactly how encoding/json writes these structs.
+	var canonical interface{}
+	switch key := publicKeyOf(jwk.Key).(type) {
+	case *rsa.PublicKey:
+		canonical = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{b64(big.NewInt(int64(key.E)).Bytes()), jwkTypeRSA, b64(key.N.Bytes())}
+	case *ecdsa.PublicKey:
+		crv, size, err := jwkCurve(key.Curve)
+		if err != nil {
+			return "", err
+		}
+		canonical = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{crv, jwkTypeEC, b64(padded(key.X, size)), b64(padded(key.Y, size))}
+	case ed25519.PublicKey:
+		canonical = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwkCurveEd25519, jwkTypeOKP, b64(key)}
+	default:
+		return "", fmt.Errorf("Unsupported JWK key type %T", jwk.Key)
+	}
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return b64(sum[:]), nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (jwk *JWK) MarshalJSON() ([]byte, error) {
+	out := &jwkJSON{Kid: jwk.KeyID, Use: jwk.Use, Alg: jwk.Algorithm}
+	switch key := jwk.Key.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return nil, fmt.Errorf("Unable to encode multi-prime RSA key as JWK")
+		}
+		// The CRT values are computed here rather than with Precompute, which
+		// would modify the caller's key
+		p, q := key.Primes[0], key.Primes[1]
+		one := big.NewInt(1)
+		setRSAPublic(out, &key.PublicKey)
+		out.D = b64(key.D.Bytes())
+		out.P = b64(p.Bytes())
+		out.Q = b64(q.Bytes())
+		out.Dp = b64(new(big.Int).Mod(key.D, new(big.Int).Sub(p, one)).Bytes())
+		out.Dq = b64(new(big.Int).Mod(key.D, new(big.Int).Sub(q, one)).Bytes())
+		out.Qi = b64(new(big.Int).ModInverse(q, p).Bytes())
+	case *rsa.PublicKey:
+		setRSAPublic(out, key)
+	case *ecdsa.PrivateKey:
+		if err := setECPublic(out, &key.PublicKey); err != nil {
+			return nil, err
+		}
+		out.D = b64(padded(key.D, (key.Curve.Params().BitSize+7)/8))
+	case *ecdsa.PublicKey:
+		if err := setECPublic(out, key); err != nil {
+			return nil, err
+		}
+	case ed25519.PrivateKey:
+		out.Kty, out.Crv = jwkTypeOKP, jwkCurveEd25519
+		out.X = b64(key.Public().(ed25519.PublicKey))
+		out.D = b64(key.Seed())
+	case ed25519.PublicKey:
+		out.Kty, out.Crv = jwkTypeOKP, jwkCurveEd25519
+		out.X = b64(key)
+	default:
+		return nil, fmt.Errorf("Unsupported JWK key type %T", jwk.Key)
+	}
+
+	if len(jwk.Certificates) > 0 {
+		for _, cert := range jwk.Certificates {
+			out.X5c = append(out.X5c, base64.StdEncoding.EncodeToString(cert.DER()))
+		}
+		sum := sha256.Sum256(jwk.Certificates[0].DER())
+		out.X5tS256 = b64(sum[:])
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (jwk *JWK) UnmarshalJSON(data []byte) error {
+	in := &jwkJSON{}
+	if err := json.Unmarshal(data, in); err != nil {
+		return fmt.Errorf("Unable to decode JWK: %w", err)
+	}
+
+	var err error
+	switch in.Kty {
+	case jwkTypeRSA:
+		jwk.Key, err = parseRSAJWK(in)
+	case jwkTypeEC:
+		jwk.Key, err = parseECJWK(in)
+	case jwkTypeOKP:
+		jwk.Key, err = parseOKPJWK(in)
+	default:
+		err = unsupportedJWK("key type %q", in.Kty)
+	}
+	if err != nil {
+		return err
+	}
+	jwk.KeyID, jwk.Use, jwk.Algorithm = in.Kid, in.Use, in.Alg
+
+	jwk.Certificates = nil
+	for _, encoded := range in.X5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("Unable to decode x5c certificate: %w", err)
+		}
+		cert, err := bytesToCert(der)
+		if err != nil {
+			return fmt.Errorf("Unable to parse x5c certificate: %w", err)
+		}
+		jwk.Certificates = append(jwk.Certificates, cert)
+	}
+	if len(jwk.Certificates) > 0 {
+		if !publicKeysEqual(jwk.Certificates[0].X509().PublicKey, jwk.PublicKey()) {
+			return fmt.Errorf("JWK key does not match its x5c certificate")
+		}
+		if in.X5tS256 != "" {
+			sum := sha256.Sum256(jwk.Certificates[0].DER())
+			if in.X5tS256 != b64(sum[:]) {
+				return fmt.Errorf("JWK x5t#S256 does not match its x5c certificate")
+			}
+		}
+	}
+	return nil
+}
+
+// Add adds the given keys to this JWKS.
+func (jwks *JWKS) Add(keys ...*JWK) {
+	jwks.Keys = append(jwks.Keys, keys...)
+}
+
+// Key returns the key with the given key ID, or nil if there is none.
+func (jwks *JWKS) Key(kid string) *JWK {
+	for _, key := range jwks.Keys {
+		if key.KeyID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// Public returns a copy of this JWKS with all private parts removed, suitable
+// for publishing.
+func (jwks *JWKS) Public() *JWKS {
+	pub := &JWKS{Keys: make([]*JWK, 0, len(jwks.Keys))}
+	for _, key := range jwks.Keys {
+		pub.Keys = append(pub.Keys, key.Public())
+	}
+	return pub
+}
+
+func setRSAPublic(out *jwkJSON, key *rsa.PublicKey) {
+	out.Kty = jwkTypeRSA
+	out.N = b64(key.N.Bytes())
+	out.E = b64(big.NewInt(int64(key.E)).Bytes())
+}
+
+func setECPublic(out *jwkJSON, key *ecdsa.PublicKey) error {
+	crv, size, err := jwkCurve(key.Curve)
+	if err != nil {
+		return err
+	}
+	out.Kty, out.Crv = jwkTypeEC, crv
+	out.X = b64(padded(key.X, size))
+	out.Y = b64(padded(key.Y, size))
+	return nil
+}
+
+func parseRSAJWK(in *jwkJSON) (interface{}, error) {
+	n, err := unb64Int(in.N, "n")
+	if err != nil {
+		return nil, err
+	}
+	e, err := unb64Int(in.E, "e")
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("JWK RSA exponent is too large")
+	}
+	pub := rsa.PublicKey{N: n, E: int(e.Int64())}
+	if in.D == "" {
+		return &pub, nil
+	}
+
+	key := &rsa.PrivateKey{PublicKey: pub}
+	if key.D, err = unb64Int(in.D, "d"); err != nil {
+		return nil, err
+	}
+	p, err := unb64Int(in.P, "p")
+	if err != nil {
+		return nil, err
+	}
+	q, err := unb64Int(in.Q, "q")
+	if err != nil {
+		return nil, err
+	}
+	key.Primes = []*big.Int{p, q}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid JWK RSA private key: %w", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+func parseECJWK(in *jwkJSON) (interface{}, error) {
+	var curve elliptic.Curve
+	switch in.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, unsupportedJWK("EC curve %q", in.Crv)
+	}
+	x, err := unb64Int(in.X, "x")
+	if err != nil {
+		return nil, err
+	}
+	y, err := unb64Int(in.Y, "y")
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("JWK EC point is not on curve %s", in.Crv)
+	}
+	pub := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	if in.D == "" {
+		return &pub, nil
+	}
+	d, err := unb64Int(in.D, "d")
+	if err != nil {
+		return nil, err
+	}
+	dx, dy := curve.ScalarBaseMult(d.Bytes())
+	if dx.Cmp(x) != 0 || dy.Cmp(y) != 0 {
+		return nil, fmt.Errorf("JWK EC private key does not match its public key")
+	}
+	return &ecdsa.PrivateKey{PublicKey: pub, D: d}, nil
+}
+
+func parseOKPJWK(in *jwkJSON) (interface{}, error) {
+	if in.Crv != jwkCurveEd25519 {
+		return nil, unsupportedJWK("OKP curve %q", in.Crv)
+	}
+	x, err := unb64(in.X, "x")
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("JWK Ed25519 public key has wrong length %d", len(x))
+	}
+	if in.D == "" {
+		return ed25519.PublicKey(x), nil
+	}
+	d, err := unb64(in.D, "d")
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != ed25519.SeedSize {
+		return nil, fmt.Errorf("JWK Ed25519 private key has wrong length %d", len(d))
+	}
+	key := ed25519.NewKeyFromSeed(d)
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), x) {
+		return nil, fmt.Errorf("JWK Ed25519 private key does not match its public key")
+	}
+	return key, nil
+}
+
+func jwkCurve(curve elliptic.Curve) (string, int, error) {
+	switch curve {
+	case elliptic.P256():
+		return "P-256", 32, nil
+	case elliptic.P384():
+		return "P-384", 48, nil
+	case elliptic.P521():
+		return "P-521", 66, nil
+	}
+	return "", 0, fmt.Errorf("Unsupported EC curve %s", curve.Params().Name)
+}
+
+func defaultJWKAlgorithm(key interface{}) string {
+	switch key := publicKeyOf(key).(type) {
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256"
+		case elliptic.P384():
+			return "ES384"
+		case elliptic.P521():
+			return "ES512"
+		}
+	case ed25519.PublicKey:
+		return "EdDSA"
+	}
+	return ""
+}
+
+func publicKeyOf(key interface{}) crypto.PublicKey {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	case ed25519.PrivateKey:
+		return key.Public()
+	}
+	return key
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+func padded(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	result := make([]byte, size)
+	copy(result[size-len(b):], b)
+	return result
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func unb64(s string, member string) ([]byte, error) {
+	if s == "" {
+		return nil, fmt.Errorf("JWK is missing member %q", member)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode JWK member %q: %w", member, err)
+	}
+	return b, nil
+}
+
+func unb64Int(s string, member string) (*big.Int, error) {
+	b, err := unb64(s, member)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// unsupportedJWK is the error for JWKs with a key type or curve that isn't
+// understood, which are skipped in JWK Sets.
+func unsupportedJWK(format string, args ...interface{}) error {
+	return &Error{Op: "decode JWK", Kind: ErrUnsupportedKeyType, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,168 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// Example from RFC 7638 section 3.1
+	jwk, err := ParseJWK([]byte(`{"kty":"RSA","e":"AQAB","alg":"RS256","kid":"2011-04-29",` +
+		`"n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECP` +
+		`ebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368Q` +
+		`QMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2Nc` +
+		`Rwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"}`))
+	if !assert.NoError(t, err, "Unable to parse JWK") {
+		return
+	}
+	thumbprint, err := jwk.Thumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+	assert.Equal(t, "2011-04-29", jwk.KeyID)
+	assert.False(t, jwk.IsPrivate())
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err, "Unable to generate PK") {
+		return
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, key := range []interface{}{pk.RSA(), &pk.RSA().PublicKey, ecKey, &ecKey.PublicKey, edKey, edKey.Public()} {
+		jwk, err := NewJWK(key)
+		if !assert.NoError(t, err, "Unable to create JWK for %T", key) {
+			continue
+		}
+		data, err := json.Marshal(jwk)
+		if !assert.NoError(t, err, "Unable to marshal JWK for %T", key) {
+			continue
+		}
+		parsed, err := ParseJWK(data)
+		if !assert.NoError(t, err, "Unable to parse JWK for %T", key) {
+			continue
+		}
+		assert.Equal(t, jwk.KeyID, parsed.KeyID)
+		assert.Equal(t, jwk.IsPrivate(), parsed.IsPrivate())
+		assert.True(t, publicKeysEqual(jwk.PublicKey(), parsed.PublicKey()), "Public key of %T didn't round trip", key)
+		if jwk.IsPrivate() {
+			private, ok := jwk.Key.(interface{ Equal(crypto.PrivateKey) bool })
+			assert.True(t, ok && private.Equal(parsed.Key), "Private key of %T didn't round trip", key)
+		}
+	}
+
+	jwk, err := pk.JWK()
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, _ := json.Marshal(jwk)
+	parsed, err := ParseJWK(data)
+	if assert.NoError(t, err) {
+		pk2, err := parsed.PrivateKey()
+		if assert.NoError(t, err) {
+			assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded(), "PrivateKey didn't round trip through JWK")
+		}
+	}
+	public, _ := json.Marshal(jwk.Public())
+	assert.NotContains(t, string(public), `"d"`, "Public JWK should not contain private exponent")
+
+	// Marshaling mustn't modify the caller's key
+	bare := &rsa.PrivateKey{PublicKey: pk.RSA().PublicKey, D: pk.RSA().D, Primes: pk.RSA().Primes}
+	data, err = json.Marshal(&JWK{Key: bare})
+	if assert.NoError(t, err) {
+		assert.Nil(t, bare.Precomputed.Dp, "Marshaling should not precompute the caller's key")
+		assert.Contains(t, string(data), `"dp":"`+b64(pk.RSA().Precomputed.Dp.Bytes())+`"`)
+		assert.Contains(t, string(data), `"qi":"`+b64(pk.RSA().Precomputed.Qinv.Bytes())+`"`)
+	}
+
+	ecJWK, _ := NewJWK(ecKey)
+	_, err = ecJWK.PrivateKey()
+	assert.Error(t, err, "Only RSA keys should convert to PrivateKey")
+}
+
+func TestCertificateJWKS(t *testing.T) {
+	caKey, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ca, err := caKey.TLSCertificateFor(time.Now().Add(TWO_WEEKS), true, nil, "Test Org", "Test CA")
+	if !assert.NoError(t, err) {
+		return
+	}
+	leafKey, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	leafTemplate := *ca.X509()
+	leafTemplate.IsCA = false
+	leaf, err := caKey.CertificateForKey(&leafTemplate, ca, &leafKey.RSA().PublicKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	chainJWK, err := CertificateChainJWK(leaf, ca)
+	if !assert.NoError(t, err) {
+		return
+	}
+	caJWK, err := ca.JWK()
+	if !assert.NoError(t, err) {
+		return
+	}
+	jwks := &JWKS{}
+	jwks.Add(chainJWK, caJWK)
+
+	data, err := json.Marshal(jwks)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(data), `"x5t#S256"`)
+
+	parsed, err := ParseJWKS(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, parsed.Keys, 2) {
+		leafJWK := parsed.Key(chainJWK.KeyID)
+		if assert.NotNil(t, leafJWK) && assert.Len(t, leafJWK.Certificates, 2) {
+			assert.Equal(t, leaf.DER(), leafJWK.Certificates[0].DER())
+			assert.Equal(t, ca.DER(), leafJWK.Certificates[1].DER())
+		}
+	}
+	assert.Nil(t, parsed.Key("unknown"))
+
+	// Keys that aren't understood are skipped
+	var set map[string][]json.RawMessage
+	if assert.NoError(t, json.Unmarshal(data, &set)) {
+		set["keys"] = append(set["keys"], json.RawMessage(`{"kty":"oct","k":"c2VjcmV0"}`), json.RawMessage(`{"kty":"EC","crv":"P-192","x":"AA","y":"AA"}`))
+		withUnknown, _ := json.Marshal(set)
+		parsed, err = ParseJWKS(withUnknown)
+		if assert.NoError(t, err) {
+			assert.Len(t, parsed.Keys, 2)
+		}
+	}
+	_, err = ParseJWKS([]byte(`{"keys":[{"kty":"RSA","n":"!"}]}`))
+	assert.Error(t, err, "Malformed keys of supported types should be rejected")
+
+	// Tamper with the key so that it no longer matches x5c
+	otherJWK, _ := leafKey.PublicJWK()
+	otherJWK.Certificates = []*Certificate{ca}
+	data, _ = json.Marshal(otherJWK)
+	_, err = ParseJWK(data)
+	assert.Error(t, err, "JWK whose key doesn't match x5c should be rejected")
+}
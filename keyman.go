@@ -2,18 +2,19 @@
 package keyman
 
 import (
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
 	"time"
 
 	"github.com/getlantern/elevate"
@@ -28,8 +29,6 @@ const (
 
 var (
 	log = golog.LoggerFor("keyman")
-
-	tenYearsFromToday = time.Now().AddDate(10, 0, 0)
 )
 
 // PrivateKey is a convenience wrapper for rsa.PrivateKey
@@ -49,12 +48,7 @@ type Certificate struct {
 
 // GeneratePK generates a PrivateKey with a specified size in bits.
 func GeneratePK(bits int) (key *PrivateKey, err error) {
-	var rsaKey *rsa.PrivateKey
-	rsaKey, err = rsa.GenerateKey(rand.Reader, bits)
-	if err == nil {
-		key = &PrivateKey{rsaKey: rsaKey}
-	}
-	return
+	return defaultGenerator.GeneratePK(bits)
 }
 
 // LoadPKFromFile loads a PEM-encoded PrivateKey from a file
@@ -64,7 +58,7 @@ func LoadPKFromFile(filename string) (key *PrivateKey, err error) {
 		if os.IsNotExist(err) {
 			return nil, err
 		}
-		return nil, fmt.Errorf("Unable to read private key file from file %s: %s", filename, err)
+		return nil, fmt.Errorf("Unable to read private key file from file %s: %w", filename, err)
 	}
 	return LoadPKFromPEMBytes(pemBytes)
 }
@@ -73,11 +67,21 @@ func LoadPKFromFile(filename string) (key *PrivateKey, err error) {
 func LoadPKFromPEMBytes(pemBytes []byte) (key *PrivateKey, err error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
-		return nil, fmt.Errorf("Unable to decode PEM encoded private key data: %s", err)
+		return nil, &Error{Op: "decode PEM encoded private key data", Kind: ErrMalformedPEM}
 	}
 	rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to decode X509 private key data: %s", err)
+		// Keys of other types, or in PKCS#8, fail to parse as PKCS#1
+		if parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes); pkcs8Err == nil {
+			if _, isRSA := parsed.(*rsa.PrivateKey); isRSA {
+				return nil, &Error{Op: "decode X509 private key data", Kind: ErrUnsupportedKeyEncoding, Err: errors.New("PKCS#8 RSA key, only PKCS#1 is supported")}
+			}
+			return nil, &Error{Op: "decode X509 private key data", Kind: ErrUnsupportedKeyType, Err: fmt.Errorf("PKCS#8 %T", parsed)}
+		}
+		if _, ecErr := x509.ParseECPrivateKey(block.Bytes); ecErr == nil {
+			return nil, &Error{Op: "decode X509 private key data", Kind: ErrUnsupportedKeyType, Err: errors.New(block.Type)}
+		}
+		return nil, &Error{Op: "decode X509 private key data", Kind: ErrMalformedPEM, Err: err}
 	}
 	return &PrivateKey{rsaKey: rsaKey}, nil
 }
@@ -92,19 +96,10 @@ func (key *PrivateKey) PEMEncoded() (pemBytes []byte) {
 	return pem.EncodeToMemory(key.pemBlock())
 }
 
-// WriteToFile writes the PEM-encoded PrivateKey to the given file
+// WriteToFile writes the PEM-encoded PrivateKey to the given file. The file is
+// replaced atomically, so a crash never leaves a truncated key behind.
 func (key *PrivateKey) WriteToFile(filename string) (err error) {
-	keyOut, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("Failed to open %s for writing: %s", filename, err)
-	}
-	if err := pem.Encode(keyOut, key.pemBlock()); err != nil {
-		return fmt.Errorf("Unable to PEM encode private key: %s", err)
-	}
-	if err := keyOut.Close(); err != nil {
-		log.Debugf("Unable to close file: %v", err)
-	}
-	return
+	return writeFileAtomic(filename, key.PEMEncoded(), 0600)
 }
 
 func (key *PrivateKey) pemBlock() *pem.Block {
@@ -130,24 +125,7 @@ the given template and signed by the given issuer.  If issuer is nil, the
 generated certificate is self-signed.
 */
 func (key *PrivateKey) CertificateForKey(template *x509.Certificate, issuer *Certificate, publicKey interface{}) (*Certificate, error) {
-	var issuerCert *x509.Certificate
-	if issuer == nil {
-		// Note - for self-signed certificates, we include the host's external IP address
-		issuerCert = template
-	} else {
-		issuerCert = issuer.cert
-	}
-	derBytes, err := x509.CreateCertificate(
-		rand.Reader, // secure entropy
-		template,    // the template for the new cert
-		issuerCert,  // cert that's signing this cert
-		publicKey,   // public key
-		key.rsaKey,  // private key
-	)
-	if err != nil {
-		return nil, err
-	}
-	return bytesToCert(derBytes)
+	return defaultGenerator.CertificateForKey(key, template, issuer, publicKey)
 }
 
 // TLSCertificateFor generates a certificate useful for TLS use based on the
@@ -171,19 +149,48 @@ func (key *PrivateKey) TLSCertificateFor(
 	commonName string,
 	hosts ...string) (cert *Certificate, err error) {
 
+	return defaultGenerator.TLSCertificateFor(key, validUntil, isCA, issuer, organization, commonName, hosts...)
+}
+
+// CRLIssuerCertificateFor is like TLSCertificateFor for a CA certificate that
+// can also sign the CRLs generated by PrivateKey.CRL and CA.CRL.
+func (key *PrivateKey) CRLIssuerCertificateFor(validUntil time.Time, issuer *Certificate, organization string, commonName string, hosts ...string) (*Certificate, error) {
+	return defaultGenerator.CRLIssuerCertificateFor(key, validUntil, issuer, organization, commonName, hosts...)
+}
+
+// tlsTemplate builds the template used by TLSCertificateFor, with the given
+// serial number as of the given time.
+func tlsTemplate(serial *big.Int, now time.Time, validUntil time.Time, isCA bool, isSelfSigned bool, organization string, commonName string, hosts ...string) *x509.Certificate {
 	template := &x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(int64(time.Now().UnixNano())),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			Organization: []string{organization},
 			CommonName:   commonName,
 		},
-		NotBefore: time.Now().AddDate(0, -1, 0),
+		NotBefore: now.AddDate(0, -1, 0),
 		NotAfter:  validUntil,
 
 		BasicConstraintsValid: true,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 	}
 
+	template.DNSNames, template.IPAddresses = subjectAltNames(commonName, hosts)
+
+	if isSelfSigned {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	// If it's a CA, add certificate signing
+	if isCA {
+		template.KeyUsage = template.KeyUsage | x509.KeyUsageCertSign
+		template.IsCA = true
+	}
+	return template
+}
+
+// subjectAltNames determines the DNS and IP SANs for a certificate with the
+// given common name and hosts.
+func subjectAltNames(commonName string, hosts []string) (dnsNames []string, ipAddresses []net.IP) {
 	if len(hosts) == 0 {
 		hosts = []string{commonName}
 	}
@@ -193,9 +200,9 @@ func (key *PrivateKey) TLSCertificateFor(
 		// If host is an ip address, add it as an IP SAN
 		ip := net.ParseIP(host)
 		if ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
+			ipAddresses = append(ipAddresses, ip)
 		} else {
-			template.DNSNames = append(template.DNSNames, host)
+			dnsNames = append(dnsNames, host)
 		}
 		if host == commonName {
 			cnInHosts = true
@@ -204,21 +211,8 @@ func (key *PrivateKey) TLSCertificateFor(
 	if !cnInHosts {
 		// Add the common name as a DNS SAN, otherwise it will be ignored.
 		// https://github.com/golang/go/issues/24293
-		template.DNSNames = append(template.DNSNames, commonName)
+		dnsNames = append(dnsNames, commonName)
 	}
-
-	isSelfSigned := issuer == nil
-	if isSelfSigned {
-		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
-	}
-
-	// If it's a CA, add certificate signing
-	if isCA {
-		template.KeyUsage = template.KeyUsage | x509.KeyUsageCertSign
-		template.IsCA = true
-	}
-
-	cert, err = key.Certificate(template, issuer)
 	return
 }
 
@@ -229,7 +223,7 @@ func LoadCertificateFromFile(filename string) (*Certificate, error) {
 		if os.IsNotExist(err) {
 			return nil, err
 		}
-		return nil, fmt.Errorf("Unable to read certificate file from disk: %s", err)
+		return nil, fmt.Errorf("Unable to read certificate file from disk: %w", err)
 	}
 	return LoadCertificateFromPEMBytes(certificateData)
 }
@@ -239,9 +233,45 @@ func LoadCertificateFromFile(filename string) (*Certificate, error) {
 func LoadCertificateFromPEMBytes(pemBytes []byte) (*Certificate, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
-		return nil, fmt.Errorf("Unable to decode PEM encoded certificate")
+		return nil, &Error{Op: "decode PEM encoded certificate", Kind: ErrMalformedPEM}
+	}
+	cert, err := bytesToCert(block.Bytes)
+	if err != nil {
+		return nil, &Error{Op: "parse PEM encoded certificate", Kind: ErrMalformedPEM, Err: err}
+	}
+	return cert, nil
+}
+
+// LoadCertificatesFromPEMBytes loads all Certificates from a byte array in PEM
+// format, such as a certificate bundle. Blocks other than certificates are
+// skipped.
+func LoadCertificatesFromPEMBytes(pemBytes []byte) ([]*Certificate, error) {
+	var certs []*Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != PEM_HEADER_CERTIFICATE {
+			continue
+		}
+		cert, err := bytesToCert(block.Bytes)
+		if err != nil {
+			return nil, &Error{Op: "parse PEM encoded certificate", Kind: ErrMalformedPEM, Err: err}
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, &Error{Op: "decode PEM encoded certificate", Kind: ErrMalformedPEM}
 	}
-	return bytesToCert(block.Bytes)
+	return certs, nil
+}
+
+// LoadCertificateFromDERBytes loads a Certificate from a byte array in DER
+// format
+func LoadCertificateFromDERBytes(derBytes []byte) (*Certificate, error) {
+	return bytesToCert(derBytes)
 }
 
 // LoadCertificateFromX509 loads a Certificate from an x509.Certificate
@@ -269,47 +299,29 @@ func (cert *Certificate) PEMEncoded() (pemBytes []byte) {
 	return pem.EncodeToMemory(cert.pemBlock())
 }
 
-// WriteToFile writes the PEM-encoded Certificate to a file.
+// WriteToFile writes the PEM-encoded Certificate to a file. The file is
+// replaced atomically, so a crash never leaves a truncated certificate behind.
 func (cert *Certificate) WriteToFile(filename string) (err error) {
-	certOut, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("Failed to open %s for writing: %s", filename, err)
-	}
-	defer func() {
-		if err := certOut.Close(); err != nil {
-			log.Debugf("Unable to close file: %v", err)
-		}
-	}()
-	return pem.Encode(certOut, cert.pemBlock())
+	return writeFileAtomic(filename, cert.PEMEncoded(), 0644)
 }
 
 func (cert *Certificate) WriteToTempFile() (name string, err error) {
 	// Create a temp file containing the certificate
 	tempFile, err := ioutil.TempFile("", "tempCert")
 	if err != nil {
-		return "", fmt.Errorf("Unable to create temp file: %s", err)
+		return "", fmt.Errorf("Unable to create temp file: %w", err)
 	}
 	name = tempFile.Name()
 	err = cert.WriteToFile(name)
 	if err != nil {
-		return "", fmt.Errorf("Unable to save certificate to temp file: %s", err)
+		return "", fmt.Errorf("Unable to save certificate to temp file: %w", err)
 	}
 	return
 }
 
 // WriteToDERFile writes the DER-encoded Certificate to a file.
 func (cert *Certificate) WriteToDERFile(filename string) (err error) {
-	certOut, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("Failed to open %s for writing: %s", filename, err)
-	}
-	defer func() {
-		if err := certOut.Close(); err != nil {
-			log.Debugf("Unable to close file: %v", err)
-		}
-	}()
-	_, err = certOut.Write(cert.derBytes)
-	return err
+	return writeFileAtomic(filename, cert.derBytes, 0644)
 }
 
 // PoolContainingCert creates a pool containing this cert.
@@ -353,47 +365,196 @@ func (cert *Certificate) pemBlock() *pem.Block {
  * Utility Functions
  ******************************************************************************/
 
+// PKAndCertOptions describes the certificate that StoredPKAndCertIn creates
+// when none is stored yet.
+type PKAndCertOptions struct {
+	// Organization is the org name for the cert
+	Organization string
+	// CommonName is used as the common name for the cert
+	CommonName string
+	// Hosts populate the DNS names or IP SANs of the cert
+	Hosts []string
+	// LockTimeout is how long to wait for other processes creating the same
+	// key pair. Defaults to DefaultLockTimeout.
+	LockTimeout time.Duration
+	// ExpectCA requires the stored certificate to be a CA
+	ExpectCA bool
+	// Validation determines how problems with the stored key and certificate
+	// are handled.
+	Validation ValidationPolicies
+	// KeyPermissions determines how a stored key that others can access is
+	// handled, for Stores that keep files on disk.
+	KeyPermissions PermissionPolicy
+	// Generator generates the key and issues the cert. Defaults to using the
+	// system clock and crypto/rand.
+	Generator *Generator
+}
+
 // StoredPKAndCert returns a PK and certificate for the given host, storing
 // these at the given pkfile and certfile paths and using the stored values on
-// subsequence calls.
+// subsequence calls. If the stored certificate was issued for a different
+// organization, common name or host, it is reissued using the stored PK.
 func StoredPKAndCert(pkfile string, certfile string, organization string, host string, commonName string) (*PrivateKey, *Certificate, error) {
-	pk, err := LoadPKFromFile(pkfile)
+	// An empty host is passed on as is, which adds an empty DNS SAN, so that
+	// certificates issued by earlier versions still match what's requested
+	// and aren't reissued
+	return StoredPKAndCertForHosts(pkfile, certfile, organization, commonName, host)
+}
+
+// StoredPKAndCertForHosts is like StoredPKAndCert, but issues the certificate
+// for any number of hosts.
+func StoredPKAndCertForHosts(pkfile string, certfile string, organization string, commonName string, hosts ...string) (*PrivateKey, *Certificate, error) {
+	return StoredPKAndCertIn(NewDirStore(""), pkfile, certfile, &PKAndCertOptions{
+		Organization: organization,
+		CommonName:   commonName,
+		Hosts:        hosts,
+		ExpectCA:     true,
+	})
+}
+
+// StoredPKAndCertIn is like StoredPKAndCert, but keeps the PK and certificate
+// under the names pkname and certname in the given Store. Stored values are
+// checked for consistency according to opts.Validation.
+func StoredPKAndCertIn(store Store, pkname string, certname string, opts *PKAndCertOptions) (*PrivateKey, *Certificate, error) {
+	pk, cert, err := loadPKAndCert(store, pkname, certname, opts.KeyPermissions)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Debugf("Creating new PK at: %s", pkfile)
-			pk, err = GeneratePK(2048)
-			if err != nil {
-				return nil, nil, err
-			}
-			err = pk.WriteToFile(pkfile)
-			if err != nil {
-				return nil, nil, fmt.Errorf("Unable to save private key: %s", err)
-			}
-		} else {
-			return nil, nil, fmt.Errorf("Unable to read private key, even though it exists: %s", err)
+		return nil, nil, err
+	}
+	if pk != nil && cert != nil {
+		// Problems are handled, or reported, while holding the lock below
+		if regenerate, err := validatePKAndCert(pk, cert, opts); err == nil && !regenerate {
+			emitCert(EventLoaded, certname, cert)
+			return pk, cert, nil
 		}
 	}
 
-	cert, err := LoadCertificateFromFile(certfile)
+	unlock, err := lockStore(store, pkname, opts.LockTimeout)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Debugf("Creating new server cert at: %s", certfile)
-			cert, err = pk.TLSCertificateFor(tenYearsFromToday, true, nil, organization, commonName, host)
-			if err != nil {
-				return nil, nil, err
-			}
-			err = cert.WriteToFile(certfile)
-			if err != nil {
-				return nil, nil, fmt.Errorf("Unable to save certificate: %s", err)
-			}
-		} else {
-			return nil, nil, fmt.Errorf("Unable to read certificate, even though it exists: %s", err)
+		return nil, nil, err
+	}
+	defer unlock()
+
+	// Another process may have created the key pair while we waited for the
+	// lock, so check again.
+	pk, cert, err = loadPKAndCert(store, pkname, certname, opts.KeyPermissions)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cert, err = completePKAndCert(store, certname, pk, cert); err != nil {
+		return nil, nil, err
+	}
+
+	updates := make(map[string][]byte)
+	hadCert := cert != nil
+	if pk == nil {
+		log.Debugf("Creating new PK at: %s", pkname)
+		pk, err = opts.Generator.GeneratePK(2048)
+		if err != nil {
+			return nil, nil, err
 		}
+		updates[pkname] = pk.PEMEncoded()
+	}
+	// A newly generated key needs a new certificate, even if an old one exists
+	regenerate := cert == nil || len(updates) > 0
+	if !regenerate {
+		if regenerate, err = validatePKAndCert(pk, cert, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+	if regenerate {
+		log.Debugf("Creating new server cert at: %s", certname)
+		cert, err = opts.Generator.TLSCertificateFor(pk, opts.Generator.TenYearsFromNow(), true, nil, opts.Organization, opts.CommonName, opts.Hosts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		updates[certname] = cert.PEMEncoded()
 	}
 
+	if len(updates) == 0 {
+		emitCert(EventLoaded, certname, cert)
+		return pk, cert, nil
+	}
+	// The key is replaced before the cert, see completePKAndCert
+	if err := putInOrder(store, []string{pkname, certname}, updates); err != nil {
+		return nil, nil, fmt.Errorf("Unable to save private key and certificate: %w", err)
+	}
+	if _, generated := updates[pkname]; generated {
+		emitCert(EventKeyGenerated, pkname, nil)
+	}
+	if hadCert {
+		emitCert(EventRenewed, certname, cert)
+	} else {
+		emitCert(EventCertCreated, certname, cert)
+	}
 	return pk, cert, nil
 }
 
+// loadPKAndCert loads the stored PK and certificate, returning nil for either
+// one that doesn't exist yet.
+func loadPKAndCert(store Store, pkname string, certname string, keyPermissions PermissionPolicy) (*PrivateKey, *Certificate, error) {
+	if checker, ok := store.(permissionChecker); ok {
+		if err := checker.checkPermissions(pkname, keyPermissions); err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	pk, err := LoadPKFromStore(store, pkname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("Unable to read private key, even though it exists: %w", err)
+		}
+		pk = nil
+	}
+	cert, err := LoadCertificateFromStore(store, certname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("Unable to read certificate, even though it exists: %w", err)
+		}
+		cert = nil
+	}
+	return pk, cert, nil
+}
+
+// completePKAndCert finishes writing a key pair that was interrupted after
+// replacing the key but before replacing the cert, which leaves the new key
+// next to the old cert. The new cert is then still staged in the store, and
+// replaces the old one if it matches the key.
+func completePKAndCert(store Store, certname string, pk *PrivateKey, cert *Certificate) (*Certificate, error) {
+	staged, ok := store.(stagedStore)
+	if !ok || pk == nil || cert == nil || cert.MatchesKey(pk) {
+		return cert, nil
+	}
+	var completed *Certificate
+	found, err := staged.completeStaged(certname, func(data []byte) bool {
+		candidate, err := LoadCertificateFromPEMBytes(data)
+		if err != nil || !candidate.MatchesKey(pk) {
+			return false
+		}
+		completed = candidate
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to complete interrupted write of %s: %w", certname, err)
+	}
+	if !found {
+		return cert, nil
+	}
+	log.Debugf("Completed interrupted write of %s", certname)
+	return completed, nil
+}
+
+// WritePKAndCertToFiles writes the given PrivateKey and Certificate to pkfile
+// and certfile. Both are fully written to disk before either is replaced, and
+// the key is replaced before the certificate. A crash or a concurrent reader
+// can therefore see the new key next to the old certificate, but never a new
+// certificate next to the old key. StoredPKAndCert recognizes that case and
+// completes the write.
+func WritePKAndCertToFiles(pk *PrivateKey, cert *Certificate, pkfile string, certfile string) error {
+	return writeFilesAtomic(
+		atomicFile{name: pkfile, data: pk.PEMEncoded(), perm: 0600},
+		atomicFile{name: certfile, data: cert.PEMEncoded(), perm: 0644},
+	)
+}
+
 // KeyPairFor creates a key pair for the given host, pkfile and certfile. If
 // either pkfile or certfile is missing, default files will be created.
 func KeyPairFor(host, commonName, pkfile, certfile string) (tls.Certificate, error) {
@@ -405,66 +566,120 @@ func KeyPairFor(host, commonName, pkfile, certfile string) (tls.Certificate, err
 	if mycertfile == "" {
 		mycertfile = "cert.pem"
 	}
+	return KeyPairIn(NewDirStore(""), host, commonName, mypkfile, mycertfile)
+}
+
+// KeyPairIn is like KeyPairFor, but keeps the key pair under the names pkname
+// and certname in the given Store.
+func KeyPairIn(store Store, host, commonName, pkname, certname string) (tls.Certificate, error) {
 	ctx := certContext{
-		PKFile:         mypkfile,
-		ServerCertFile: mycertfile,
-	}
-	_, err1 := os.Stat(ctx.ServerCertFile)
-	_, err2 := os.Stat(ctx.PKFile)
-	if os.IsNotExist(err1) || os.IsNotExist(err2) {
-		fmt.Println("At least one of the Key/Cert files is not found -> Generating new key pair")
-		err := ctx.initPKAndCert(host, commonName)
+		Store:          store,
+		PKFile:         pkname,
+		ServerCertFile: certname,
+	}
+	if ctx.missingPKOrCert() {
+		unlock, err := lockStore(store, pkname, DefaultLockTimeout)
 		if err != nil {
-			return tls.Certificate{}, fmt.Errorf("Unable to init server cert: %s\n", err)
+			return tls.Certificate{}, err
+		}
+		// Check again in case another process created them while we waited
+		if ctx.missingPKOrCert() {
+			log.Debugf("At least one of the Key/Cert files is not found -> Generating new key pair")
+			err = ctx.initPKAndCert(host, commonName)
+		}
+		unlock()
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Unable to init server cert: %w\n", err)
 		}
 	}
 
-	cert, err := tls.LoadX509KeyPair(ctx.ServerCertFile, ctx.PKFile)
+	certPEM, err := store.Get(ctx.ServerCertFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Unable to load certificate from %s: %w\n", ctx.ServerCertFile, err)
+	}
+	keyPEM, err := store.Get(ctx.PKFile)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("Unable to load certificate and key from %s and %s: %s\n", ctx.ServerCertFile, ctx.PKFile, err)
+		return tls.Certificate{}, fmt.Errorf("Unable to load key from %s: %w\n", ctx.PKFile, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		e := &Error{Op: "load certificate and key from", Path: ctx.ServerCertFile + " and " + ctx.PKFile, Err: err}
+		pk, pkErr := LoadPKFromPEMBytes(keyPEM)
+		x, certErr := LoadCertificateFromPEMBytes(certPEM)
+		var loadErr *Error
+		switch {
+		case errors.As(pkErr, &loadErr), errors.As(certErr, &loadErr):
+			e.Kind = loadErr.Kind
+		case !x.MatchesKey(pk):
+			e.Kind = ErrKeyMismatch
+		}
+		return tls.Certificate{}, e
+	}
+	if ctx.ServerCert == nil {
+		loaded, _ := LoadCertificateFromPEMBytes(certPEM)
+		emitCert(EventLoaded, ctx.ServerCertFile, loaded)
 	}
 	return cert, err
 }
 
 // certContext encapsulates the certificates used by a Server
 type certContext struct {
+	Store          Store
 	PKFile         string
 	ServerCertFile string
 	PK             *PrivateKey
 	ServerCert     *Certificate
 }
 
+func (ctx *certContext) missingPKOrCert() bool {
+	_, err1 := ctx.Store.Get(ctx.ServerCertFile)
+	_, err2 := ctx.Store.Get(ctx.PKFile)
+	return os.IsNotExist(err1) || os.IsNotExist(err2)
+}
+
 // initPKAndCert initializes a PK + cert, creating them if necessary.
 func (ctx *certContext) initPKAndCert(host string, commonName string) (err error) {
-	if ctx.PK, err = LoadPKFromFile(ctx.PKFile); err != nil {
+	updates := make(map[string][]byte)
+	if ctx.PK, err = LoadPKFromStore(ctx.Store, ctx.PKFile); err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("Creating new PK at: %s\n", ctx.PKFile)
+			log.Debugf("Creating new PK at: %s", ctx.PKFile)
 			if ctx.PK, err = GeneratePK(2048); err != nil {
 				return
 			}
-			if err = ctx.PK.WriteToFile(ctx.PKFile); err != nil {
-				return fmt.Errorf("Unable to save private key: %s\n", err)
-			}
+			updates[ctx.PKFile] = ctx.PK.PEMEncoded()
 		} else {
-			return fmt.Errorf("Unable to read private key, even though it exists: %s\n", err)
+			return fmt.Errorf("Unable to read private key, even though it exists: %w\n", err)
 		}
 	}
 
-	fmt.Printf("Creating new cert for host %v at: %s\n", host, ctx.ServerCertFile)
-	ctx.ServerCert, err = ctx.PK.TLSCertificateFor(tenYearsFromToday, true, nil, "Lantern", commonName, host)
+	log.Debugf("Creating new cert for host %v at: %s", host, ctx.ServerCertFile)
+	ctx.ServerCert, err = ctx.PK.TLSCertificateFor(defaultGenerator.TenYearsFromNow(), true, nil, "Lantern", commonName, host)
 	if err != nil {
 		return
 	}
-	err = ctx.ServerCert.WriteToFile(ctx.ServerCertFile)
-	if err != nil {
-		return
+	updates[ctx.ServerCertFile] = ctx.ServerCert.PEMEncoded()
+	if err = putInOrder(ctx.Store, []string{ctx.PKFile, ctx.ServerCertFile}, updates); err != nil {
+		return fmt.Errorf("Unable to save private key and certificate: %w\n", err)
+	}
+	if _, generated := updates[ctx.PKFile]; generated {
+		emitCert(EventKeyGenerated, ctx.PKFile, nil)
 	}
+	emitCert(EventCertCreated, ctx.ServerCertFile, ctx.ServerCert)
 	return nil
 }
 
 func elevatedIfNecessary(prompt string) func(name string, args ...string) *exec.Cmd {
 	if prompt == "" {
 		return exec.Command
+	} else if runtime.GOOS == "linux" {
+		// elevate doesn't support Linux, so use polkit's pkexec, which shows
+		// its own prompt
+		if os.Geteuid() == 0 {
+			return exec.Command
+		}
+		return func(name string, args ...string) *exec.Cmd {
+			return exec.Command("pkexec", append([]string{name}, args...)...)
+		}
 	} else {
 		return elevate.WithPrompt(prompt).Command
 	}
@@ -1,9 +1,7 @@
 package keyman
 
 import (
-	"fmt"
-	"os"
-	"os/exec"
+	"context"
 )
 
 const (
@@ -11,24 +9,28 @@ const (
 	OSX_SYSTEM_KEYCHAIN_PATH = "/Library/Keychains/System.keychain"
 )
 
-func DeleteTrustedRootByName(commonName string, prompt string) error {
-	cmd := elevatedIfNecessary(prompt)("security", "delete-certificate", "-c", commonName, OSX_SYSTEM_KEYCHAIN_PATH)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Unable to run security command: %w\n%s", err, out)
-	}
-	return nil
+var (
+	defaultTrustStoreBackends = []string{"keychain"}
+)
+
+func init() {
+	RegisterTrustStoreBackend("keychain", func(prompt string) ([]TrustStore, error) {
+		return []TrustStore{NewKeychainTrustStore(OSX_SYSTEM_KEYCHAIN_PATH, prompt)}, nil
+	})
 }
 
-// isInstalled checks whether this certificate is install based purely on looking for a cert
-// in the system keychain that has the same common name.  This function returns
-// true if there are one or more certs in the system keychain whose common name
-// matches this cert.
-func (cert *Certificate) isInstalled() bool {
-	cmd := exec.Command("security", "find-certificate", "-c", cert.X509().Subject.CommonName, OSX_SYSTEM_KEYCHAIN_PATH)
-	err := cmd.Run()
+func DeleteTrustedRootByName(commonName string, prompt string) error {
+	return DeleteTrustedRootByNameContext(context.Background(), commonName, prompt)
+}
 
-	return err == nil
+// DeleteTrustedRootByNameContext is like DeleteTrustedRootByName but stops
+// running external commands once the context is done.
+func DeleteTrustedRootByNameContext(ctx context.Context, commonName string, prompt string) error {
+	stores, err := TrustStores(prompt)
+	if err != nil {
+		return err
+	}
+	return DeleteTrustedRootByNameIn(ctx, stores, commonName)
 }
 
 // AddAsTrustedRootIfNeeded adds the certificate to the user's trust store as a trusted
@@ -38,48 +40,16 @@ func (cert *Certificate) isInstalled() bool {
 // If installAttempted is provided it will be called on any attempt to modify system cert store with the resulting
 // error (if any)
 func (cert *Certificate) AddAsTrustedRootIfNeeded(elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
-	if cert.isInstalled() {
-		return nil
-	}
-
-	reportInstallResult := func(err error) error {
-		if installAttempted != nil {
-			installAttempted(err)
-		}
-		return err
-	}
-
-	tempFileName, err := cert.WriteToTempFile()
-	defer func() {
-		if err := os.Remove(tempFileName); err != nil {
-			log.Debugf("Unable to remove file: %w", err)
-		}
-	}()
-	if err != nil {
-		return reportInstallResult(err)
-	}
-
-	cmd := exec.Command("security", "verify-cert", "-c", tempFileName)
-	_, err = cmd.CombinedOutput()
-	if err == nil {
-		// certificate verified successfully so it's already a trusted root, no need
-		// to install.
-		return nil
-	}
+	return cert.AddAsTrustedRootIfNeededContext(context.Background(), elevatePrompt, installPromptTitle, installPromptContent, installAttempted)
+}
 
-	// Add it as a trusted cert
-	cmd = elevatedIfNecessary(elevatePrompt)("security", "add-trusted-cert", "-d", "-k", OSX_SYSTEM_KEYCHAIN_PATH, tempFileName)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("Unable to run security command: %w\n%s", err, out)
-	}
-	reportInstallResult(err)
+// AddAsTrustedRootIfNeededContext is like AddAsTrustedRootIfNeeded but stops
+// running external commands once the context is done. Whether the
+// installation was canceled can be told with IsCanceled.
+func (cert *Certificate) AddAsTrustedRootIfNeededContext(ctx context.Context, elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
+	stores, err := TrustStores(elevatePrompt)
 	if err != nil {
 		return err
 	}
-
-	cmd = exec.Command("security", "verify-cert", "-c", tempFileName)
-	out, err = cmd.CombinedOutput()
-	log.Debugf("%v: %v", out, err)
-	return nil
+	return cert.AddAsTrustedRootIn(ctx, stores, installAttempted)
 }
@@ -1,114 +1,136 @@
 package keyman
 
 import (
-	"fmt"
+	"context"
 	"os"
-	"os/exec"
 	"path/filepath"
 )
 
 var (
-	nssDBs = []string{
-		filepath.Join(os.Getenv("HOME"), ".pki/nssdb"),
-		filepath.Join(os.Getenv("HOME"), "snap/chromium/current/.pki/nssdb"), // Snapcraft
+	systemNSSDBs = []string{
 		"/etc/pki/nssdb", // CentOS 7
 	}
+	// FirefoxProfile is a glob matching additional profile directories to
+	// use. The profiles of Firefox and other applications are discovered with
+	// FindNSSProfiles.
 	FirefoxProfile = os.Getenv("HOME") + "/.mozilla/firefox/*"
+
+	// The system-wide trust store isn't used by default, since modifying it
+	// prompts for elevation. Use TrustStores(prompt, "nss", "system") to
+	// include it.
+	defaultTrustStoreBackends = []string{"nss"}
 )
 
-func DeleteTrustedRootByName(commonName string, prompt string) error {
-	return forEachNSSProfile(func(profile string) error {
-		cmd := exec.Command("certutil", "-d", profile, "-D", "-n", commonName)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("Unable to run certutil command: %w\n%s", err, out)
+func init() {
+	RegisterTrustStoreBackend("nss", NSSTrustStoreBackend(NSSOptions{}))
+	// The system-wide trust store is only used when requested and we're able
+	// to modify it, i.e. when running as root or allowed to elevate.
+	RegisterTrustStoreBackend("system", func(prompt string) ([]TrustStore, error) {
+		if !useSystemTrustStore(prompt) {
+			return nil, nil
 		}
-		return nil
+		store := NewSystemTrustStore("", prompt)
+		if _, err := store.Layout(); err != nil {
+			log.Debugf("Not using system trust store: %v", err)
+			return nil, nil
+		}
+		return []TrustStore{store}, nil
 	})
 }
 
-func (cert *Certificate) isInstalled(profile string) bool {
-	cmd := exec.Command("certutil", "-d", profile, "-L", "-n", cert.X509().Subject.CommonName)
-	err := cmd.Run()
-
-	return err == nil
+// NSSOptions configures the NSS trust store backend.
+type NSSOptions struct {
+	// CreateSharedDB creates the shared NSS database in ~/.pki/nssdb, which is
+	// used by Chrome, when installing a root if it doesn't exist yet, e.g.
+	// because Chrome has never run. Requires certutil.
+	CreateSharedDB bool
 }
 
-// AddAsTrustedRootIfNeeded adds the certificate to the user's trust store as a trusted
-// root CA. Supports Chrome and Firefox
-// elevatePrompt, installPromptTitle, installPromptContent are ignored, kept for API compatibility with other platforms
-// If installAttempted is provided it will be called on any attempt to modify system cert store with the resulting
-// error (if any)
-func (cert *Certificate) AddAsTrustedRootIfNeeded(elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
-	reportInstallResult := func(err error) error {
-		if installAttempted != nil {
-			installAttempted(err)
+// NSSTrustStoreBackend constructs a TrustStoreBackend for the user's NSS
+// databases. It's registered as "nss" with the default options, which can be
+// changed by registering it again, e.g.
+//
+//	keyman.RegisterTrustStoreBackend("nss", keyman.NSSTrustStoreBackend(keyman.NSSOptions{CreateSharedDB: true}))
+func NSSTrustStoreBackend(opts NSSOptions) TrustStoreBackend {
+	return func(prompt string) ([]TrustStore, error) {
+		var stores []TrustStore
+		err := forEachNSSProfile(func(profile string) error {
+			stores = append(stores, NewNSSTrustStore(profile))
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-		return err
-	}
-
-	var profilesNeedingInstall []string
-	forEachNSSProfile(func(profile string) error {
-		if !cert.isInstalled(profile) {
-			profilesNeedingInstall = append(profilesNeedingInstall, profile)
+		shared := filepath.Join(os.Getenv("HOME"), ".pki", "nssdb")
+		if opts.CreateSharedDB && nssProfileIn(NSSAppShared, NSSPackagingNative, "", shared) == nil {
+			if _, err := DefaultRunner.LookPath("certutil"); err != nil {
+				log.Debugf("Not creating %v without certutil", shared)
+			} else {
+				stores = append(stores, &NSSTrustStore{DB: "sql:" + shared, CreateIfMissing: true})
+			}
 		}
-		return nil
-	})
-
-	if len(profilesNeedingInstall) == 0 {
-		return nil
+		return stores, nil
 	}
+}
 
-	tempFileName, err := cert.WriteToTempFile()
-	defer func() {
-		if err := os.Remove(tempFileName); err != nil {
-			log.Debugf("Unable to remove file: %w", err)
-		}
-	}()
-	if err != nil {
-		return reportInstallResult(err)
-	}
+// DeleteTrustedRootByName removes the root with the given common name from the
+// user's NSS databases.
+func DeleteTrustedRootByName(commonName string, prompt string) error {
+	return DeleteTrustedRootByNameContext(context.Background(), commonName, prompt)
+}
 
-	for _, profile := range profilesNeedingInstall {
-		if err := reportInstallResult(cert.addAsTrustedRoot(tempFileName, profile)); err != nil {
-			return err
-		}
+// DeleteTrustedRootByNameContext is like DeleteTrustedRootByName but stops
+// running external commands once the context is done.
+func DeleteTrustedRootByNameContext(ctx context.Context, commonName string, prompt string) error {
+	stores, err := TrustStores(prompt)
+	if err != nil {
+		return err
 	}
+	return DeleteTrustedRootByNameIn(ctx, stores, commonName)
+}
 
-	return nil
+// AddAsTrustedRootIfNeeded adds the certificate to the user's trust store as a trusted
+// root CA. Supports Chrome and Firefox
+// To also add it to the system-wide trust store used by OpenSSL, curl and most command line tools, use
+// AddAsTrustedRootIn with TrustStores(elevatePrompt, "nss", "system").
+// installPromptTitle, installPromptContent are ignored, kept for API compatibility with other platforms
+// If installAttempted is provided it will be called on any attempt to modify system cert store with the resulting
+// error (if any)
+func (cert *Certificate) AddAsTrustedRootIfNeeded(elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
+	return cert.AddAsTrustedRootIfNeededContext(context.Background(), elevatePrompt, installPromptTitle, installPromptContent, installAttempted)
 }
 
-func (cert *Certificate) addAsTrustedRoot(tempFileName, profile string) error {
-	// Add it as a trusted cert
-	// https://code.google.com/p/chromium/wiki/LinuxCertManagement#Add_a_certificate
-	cmd := exec.Command("certutil", "-d", profile, "-A", "-t", "C,,", "-n", cert.X509().Subject.CommonName, "-i", tempFileName)
-	out, err := cmd.CombinedOutput()
+// AddAsTrustedRootIfNeededContext is like AddAsTrustedRootIfNeeded but stops
+// running external commands once the context is done. Whether the
+// installation was canceled can be told with IsCanceled.
+func (cert *Certificate) AddAsTrustedRootIfNeededContext(ctx context.Context, elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
+	stores, err := TrustStores(elevatePrompt)
 	if err != nil {
-		return fmt.Errorf("Unable to run certutil command: %w\n%s", err, out)
+		return err
 	}
-	return nil
+	return cert.AddAsTrustedRootIn(ctx, stores, installAttempted)
 }
 
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+func useSystemTrustStore(prompt string) bool {
+	return prompt != "" || os.Geteuid() == 0
 }
 
 func forEachNSSProfile(f func(profile string) error) error {
-	profiles, _ := filepath.Glob(FirefoxProfile)
-	profiles = append(profiles, nssDBs...)
+	profiles := FindNSSProfiles(os.Getenv("HOME"))
+	extra, _ := filepath.Glob(FirefoxProfile)
+	for _, dir := range append(extra, systemNSSDBs...) {
+		if profile := nssProfileIn("", NSSPackagingNative, "", dir); profile != nil {
+			profiles = append(profiles, profile)
+		}
+	}
+	seen := make(map[string]bool)
 	for _, profile := range profiles {
-		if stat, err := os.Stat(profile); err != nil || !stat.IsDir() {
+		if seen[profile.Path] {
 			continue
 		}
-		if pathExists(filepath.Join(profile, "cert9.db")) {
-			if err := f("sql:" + profile); err != nil {
-				return err
-			}
-		} else if pathExists(filepath.Join(profile, "cert8.db")) {
-			if err := f("dbm:" + profile); err != nil {
-				return err
-			}
+		seen[profile.Path] = true
+		if err := f(profile.DB()); err != nil {
+			return err
 		}
 	}
 	return nil
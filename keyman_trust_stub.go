@@ -3,13 +3,22 @@
 package keyman
 
 import (
+	"context"
 	"fmt"
 )
 
+var (
+	defaultTrustStoreBackends []string
+)
+
 func DeleteTrustedRootByName(commonName string, prompt string) error {
 	return fmt.Errorf("DeleteTrustedRootByName is not supported on this platform")
 }
 
+func DeleteTrustedRootByNameContext(ctx context.Context, commonName string, prompt string) error {
+	return fmt.Errorf("DeleteTrustedRootByName is not supported on this platform")
+}
+
 // AddAsTrustedRoot adds the certificate to the user's trust store as a trusted
 // root CA. If elevatePrompt is provided, privilege escalation will be requested (if
 // required) and the user will be prompted with the given text.
@@ -18,3 +27,7 @@ func DeleteTrustedRootByName(commonName string, prompt string) error {
 func (cert *Certificate) AddAsTrustedRootIfNeeded(elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
 	return fmt.Errorf("AddAsTrustedRootIfNeeded is not supported on this platform")
 }
+
+func (cert *Certificate) AddAsTrustedRootIfNeededContext(ctx context.Context, elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
+	return fmt.Errorf("AddAsTrustedRootIfNeeded is not supported on this platform")
+}
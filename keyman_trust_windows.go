@@ -1,10 +1,8 @@
 package keyman
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
 
 	"github.com/getlantern/byteexec"
 	"github.com/getlantern/keyman/certimporter"
@@ -16,6 +14,8 @@ const (
 
 var (
 	cebe *byteexec.Exec
+
+	defaultTrustStoreBackends = []string{"windows"}
 )
 
 func init() {
@@ -27,28 +27,24 @@ func init() {
 	if err != nil {
 		panic(fmt.Errorf("Unable to construct executable from memory: %w", err))
 	}
+
+	RegisterTrustStoreBackend("windows", func(prompt string) ([]TrustStore, error) {
+		return []TrustStore{NewWindowsTrustStore(ROOT_CERT_STORE_NAME, prompt)}, nil
+	})
 }
 
 func DeleteTrustedRootByName(commonName string, prompt string) error {
-	cmd := elevatedIfNecessary(prompt)(cebe.Filename, "delete", ROOT_CERT_STORE_NAME, commonName)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Unable to run certimporter.exe: %w\n%s", err, out)
-	}
-	return nil
+	return DeleteTrustedRootByNameContext(context.Background(), commonName, prompt)
 }
 
-func (cert *Certificate) isInstalled() bool {
-	// TODO: make sure that passing byte strings of various encodings to the
-	// certimporter program works in different languages/different usernames (
-	// which end up in the temp path, etc.)
-	cmd := cebe.Command("find", ROOT_CERT_STORE_NAME, cert.X509().Subject.CommonName)
-	err := cmd.Run()
-
-	// Consider the certificate found if and only if certimporter.exe exited
-	// with a 0 exit code.  Any non-zero code (cert not found, or error looking
-	// for cert) is treated as the cert not being found.
-	return err == nil
+// DeleteTrustedRootByNameContext is like DeleteTrustedRootByName but stops
+// running external commands once the context is done.
+func DeleteTrustedRootByNameContext(ctx context.Context, commonName string, prompt string) error {
+	stores, err := TrustStores(prompt)
+	if err != nil {
+		return err
+	}
+	return DeleteTrustedRootByNameIn(ctx, stores, commonName)
 }
 
 // AddAsTrustedRootIfNeeded adds the certificate to the user's trust store as a trusted
@@ -58,41 +54,34 @@ func (cert *Certificate) isInstalled() bool {
 // If installAttempted is provided it will be called on any attempt to modify system cert store with the resulting
 // error (if any)
 func (cert *Certificate) AddAsTrustedRootIfNeeded(elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
-	if cert.isInstalled() {
-		return nil
-	}
+	return cert.AddAsTrustedRootIfNeededContext(context.Background(), elevatePrompt, installPromptTitle, installPromptContent, installAttempted)
+}
 
-	reportInstallResult := func(err error) error {
-		if installAttempted != nil {
-			installAttempted(err)
-		}
+// AddAsTrustedRootIfNeededContext is like AddAsTrustedRootIfNeeded but stops
+// running external commands once the context is done. Whether the
+// installation was canceled can be told with IsCanceled.
+func (cert *Certificate) AddAsTrustedRootIfNeededContext(ctx context.Context, elevatePrompt, installPromptTitle, installPromptContent string, installAttempted func(error)) error {
+	stores, err := TrustStores(elevatePrompt)
+	if err != nil {
 		return err
 	}
+	result := &TrustResult{}
+	pending := cert.checkTrustStores(ctx, stores, result)
+	if len(pending) == 0 {
+		return result.Err()
+	}
 
 	// Warn the user of what's about to happen
 	if installPromptContent != "" && installPromptTitle != "" {
-		cmd := exec.Command("mshta", fmt.Sprintf("javascript: var sh=new ActiveXObject('WScript.Shell'); sh.Popup('%v', 0, '%v', 64); close()", installPromptContent, installPromptTitle))
-		promptErr := cmd.Run()
+		_, promptErr := DefaultRunner.Run(ctx, &Command{Name: "mshta", Args: []string{fmt.Sprintf("javascript: var sh=new ActiveXObject('WScript.Shell'); sh.Popup('%v', 0, '%v', 64); close()", installPromptContent, installPromptTitle)}})
 		if promptErr != nil {
-			return reportInstallResult(fmt.Errorf("Unable to show windows prompt for installing certificate: %v", promptErr))
+			err := fmt.Errorf("Unable to show windows prompt for installing certificate: %v", promptErr)
+			if installAttempted != nil {
+				installAttempted(err)
+			}
+			return err
 		}
 	}
-	// Create a temp file containing the certificate
-	tempFile, err := ioutil.TempFile("", "tempCert")
-	defer os.Remove(tempFile.Name())
-	if err != nil {
-		return reportInstallResult(err)
-	}
-	err = cert.WriteToDERFile(tempFile.Name())
-	if err != nil {
-		return fmt.Errorf("Unable to save certificate to temp file: %w", err)
-	}
-
-	// Add it as a trusted cert
-	cmd := elevatedIfNecessary(elevatePrompt)(cebe.Filename, "add", ROOT_CERT_STORE_NAME, tempFile.Name())
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("Unable to run certimporter.exe: %w\n%s", err, out)
-	}
-	return reportInstallResult(err)
+	cert.installTrustedRoot(ctx, pending, &TrustOptions{InstallAttempted: installAttempted})
+	return result.Err()
 }
@@ -0,0 +1,438 @@
+package keyman
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StatusValid marks a certificate that hasn't been revoked
+	StatusValid CertStatus = "valid"
+	// StatusRevoked marks a revoked certificate
+	StatusRevoked CertStatus = "revoked"
+)
+
+var (
+	// ErrDuplicateSerial is returned when recording a certificate whose serial
+	// number is already in the Ledger.
+	ErrDuplicateSerial = errors.New("Serial number already issued")
+
+	// ErrUnknownSerial is returned when looking up a serial number that isn't
+	// in the Ledger.
+	ErrUnknownSerial = errors.New("Serial number not found")
+
+	oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+	// opensslNames are the short names that OpenSSL uses for attributes in
+	// one-line distinguished names
+	opensslNames = map[string]string{
+		"2.5.4.3":              "CN",
+		"2.5.4.5":              "serialNumber",
+		"2.5.4.6":              "C",
+		"2.5.4.7":              "L",
+		"2.5.4.8":              "ST",
+		"2.5.4.9":              "street",
+		"2.5.4.10":             "O",
+		"2.5.4.11":             "OU",
+		"2.5.4.17":             "postalCode",
+		"1.2.840.113549.1.9.1": "emailAddress",
+	}
+)
+
+// CertStatus is the status of an issued certificate.
+type CertStatus string
+
+// LedgerEntry records a certificate issued by a CA.
+type LedgerEntry struct {
+	Serial *big.Int `json:"serial"`
+	// Subject is the certificate's subject in OpenSSL's one-line form, as
+	// used in index.txt, e.g. /O=Org/CN=example.com
+	Subject        string     `json:"subject"`
+	DNSNames       []string   `json:"dnsNames,omitempty"`
+	IPAddresses    []string   `json:"ipAddresses,omitempty"`
+	NotBefore      time.Time  `json:"notBefore"`
+	NotAfter       time.Time  `json:"notAfter"`
+	KeyFingerprint string     `json:"keyFingerprint"`
+	Requester      string     `json:"requester,omitempty"`
+	Status         CertStatus `json:"status"`
+	// RevokedAt is when the certificate was revoked, nil unless it's revoked
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason int        `json:"revocationReason,omitempty"`
+}
+
+// LedgerFilter selects LedgerEntries in a query.
+type LedgerFilter func(entry *LedgerEntry) bool
+
+// Ledger is an inventory of the certificates issued by a CA, similar to
+// OpenSSL's index.txt. Serial numbers are unique within a Ledger.
+type Ledger interface {
+	// Record adds an entry, failing with ErrDuplicateSerial if its serial
+	// number has already been recorded. The check and the addition must be
+	// atomic, CA.Issue relies on it to refuse duplicate serial numbers.
+	Record(entry *LedgerEntry) error
+
+	// Get returns the entry with the given serial number, failing with
+	// ErrUnknownSerial if there is none.
+	Get(serial *big.Int) (*LedgerEntry, error)
+
+	// Revoke marks the certificate with the given serial number as revoked
+	// at the given time for the given reason (an RFC 5280 CRLReason).
+	Revoke(serial *big.Int, at time.Time, reason int) error
+
+	// Query returns all entries matching all of the given filters, ordered
+	// by serial number.
+	Query(filters ...LedgerFilter) ([]*LedgerEntry, error)
+}
+
+// NewLedgerEntry creates a valid LedgerEntry for the given certificate.
+func NewLedgerEntry(cert *Certificate, requester string) *LedgerEntry {
+	x := cert.X509()
+	entry := &LedgerEntry{
+		Serial:         new(big.Int).Set(x.SerialNumber),
+		Subject:        opensslSubject(x),
+		DNSNames:       x.DNSNames,
+		NotBefore:      x.NotBefore,
+		NotAfter:       x.NotAfter,
+		KeyFingerprint: publicKeyFingerprint(x),
+		Requester:      requester,
+		Status:         StatusValid,
+	}
+	for _, ip := range x.IPAddresses {
+		entry.IPAddresses = append(entry.IPAddresses, ip.String())
+	}
+	return entry
+}
+
+// opensslSubject formats the subject of the given certificate in OpenSSL's
+// one-line form, keeping the order of its attributes.
+func opensslSubject(cert *x509.Certificate) string {
+	var rdns pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(cert.RawSubject, &rdns); err != nil || len(rest) > 0 {
+		rdns = cert.Subject.ToRDNSequence()
+	}
+	var b strings.Builder
+	for _, rdn := range rdns {
+		for i, atv := range rdn {
+			if i == 0 {
+				b.WriteString("/")
+			} else {
+				b.WriteString("+")
+			}
+			name, found := opensslNames[atv.Type.String()]
+			if !found {
+				name = atv.Type.String()
+			}
+			fmt.Fprintf(&b, "%s=%v", name, atv.Value)
+		}
+	}
+	return b.String()
+}
+
+// ExpiringWithin selects valid certificates that expire within the given
+// duration from now.
+func ExpiringWithin(now time.Time, within time.Duration) LedgerFilter {
+	return func(entry *LedgerEntry) bool {
+		return entry.Status == StatusValid && entry.NotAfter.Before(now.Add(within))
+	}
+}
+
+// ForHost selects certificates issued for the given DNS name or IP address.
+func ForHost(host string) LedgerFilter {
+	return func(entry *LedgerEntry) bool {
+		for _, name := range entry.DNSNames {
+			if strings.EqualFold(name, host) {
+				return true
+			}
+		}
+		for _, ip := range entry.IPAddresses {
+			if ip == host {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithStatus selects certificates with the given status.
+func WithStatus(status CertStatus) LedgerFilter {
+	return func(entry *LedgerEntry) bool {
+		return entry.Status == status
+	}
+}
+
+// WriteOpenSSLIndex writes the given entries in the format of OpenSSL's
+// index.txt.
+func WriteOpenSSLIndex(w io.Writer, entries []*LedgerEntry) error {
+	return defaultGenerator.WriteOpenSSLIndex(w, entries)
+}
+
+// WriteOpenSSLIndex is like the package level WriteOpenSSLIndex, but marks
+// entries as expired according to the Generator's Clock.
+func (g *Generator) WriteOpenSSLIndex(w io.Writer, entries []*LedgerEntry) error {
+	now := g.Now()
+	const timeFormat = "060102150405Z"
+	for _, entry := range entries {
+		status, revoked := "V", ""
+		if entry.Status == StatusRevoked && entry.RevokedAt != nil {
+			status, revoked = "R", entry.RevokedAt.UTC().Format(timeFormat)
+		} else if entry.NotAfter.Before(now) {
+			status = "E"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%X\tunknown\t%s\n", status, entry.NotAfter.UTC().Format(timeFormat), revoked, entry.Serial, entry.Subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CRL generates a DER-encoded certificate revocation list signed by this
+// PrivateKey, listing every certificate that is revoked in the given Ledger.
+// The issuer must allow signing CRLs, see CRLIssuerCertificateFor.
+func (key *PrivateKey) CRL(issuer *Certificate, ledger Ledger, number *big.Int, thisUpdate time.Time, nextUpdate time.Time) ([]byte, error) {
+	return defaultGenerator.CRL(key, issuer, ledger, number, thisUpdate, nextUpdate)
+}
+
+// CRL is like PrivateKey.CRL, but signs using the Generator's entropy source.
+func (g *Generator) CRL(key *PrivateKey, issuer *Certificate, ledger Ledger, number *big.Int, thisUpdate time.Time, nextUpdate time.Time) ([]byte, error) {
+	revoked, err := ledger.Query(WithStatus(StatusRevoked))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.RevocationList{
+		Number:     number,
+		ThisUpdate: thisUpdate,
+		NextUpdate: nextUpdate,
+	}
+	for _, entry := range revoked {
+		rc := pkix.RevokedCertificate{SerialNumber: entry.Serial}
+		if entry.RevokedAt != nil {
+			rc.RevocationTime = *entry.RevokedAt
+		}
+		if entry.RevocationReason != 0 {
+			reason, err := asn1.Marshal(asn1.Enumerated(entry.RevocationReason))
+			if err != nil {
+				return nil, err
+			}
+			rc.Extensions = []pkix.Extension{{Id: oidCRLReason, Value: reason}}
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, rc)
+	}
+	crl, err := x509.CreateRevocationList(g.rand(), template, issuer.X509(), key.rsaKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create CRL: %w", err)
+	}
+	return crl, nil
+}
+
+func publicKeyFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+/*******************************************************************************
+ * In-Memory Ledger
+ ******************************************************************************/
+
+// MemLedger is a Ledger kept in memory.
+type MemLedger struct {
+	entries map[string]*LedgerEntry
+	mx      sync.RWMutex
+}
+
+// NewMemLedger constructs an empty MemLedger.
+func NewMemLedger() *MemLedger {
+	return &MemLedger{entries: make(map[string]*LedgerEntry)}
+}
+
+func (l *MemLedger) Record(entry *LedgerEntry) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	key := entry.Serial.String()
+	if _, found := l.entries[key]; found {
+		return fmt.Errorf("%w: %X", ErrDuplicateSerial, entry.Serial)
+	}
+	recorded := *entry
+	l.entries[key] = &recorded
+	return nil
+}
+
+func (l *MemLedger) Get(serial *big.Int) (*LedgerEntry, error) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	entry, found := l.entries[serial.String()]
+	if !found {
+		return nil, fmt.Errorf("%w: %X", ErrUnknownSerial, serial)
+	}
+	result := *entry
+	return &result, nil
+}
+
+func (l *MemLedger) Revoke(serial *big.Int, at time.Time, reason int) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	entry, found := l.entries[serial.String()]
+	if !found {
+		return fmt.Errorf("%w: %X", ErrUnknownSerial, serial)
+	}
+	entry.Status = StatusRevoked
+	entry.RevokedAt = &at
+	entry.RevocationReason = reason
+	return nil
+}
+
+func (l *MemLedger) Query(filters ...LedgerFilter) ([]*LedgerEntry, error) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	var result []*LedgerEntry
+entries:
+	for _, entry := range l.entries {
+		for _, filter := range filters {
+			if !filter(entry) {
+				continue entries
+			}
+		}
+		e := *entry
+		result = append(result, &e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Serial.Cmp(result[j].Serial) < 0 })
+	return result, nil
+}
+
+/*******************************************************************************
+ * File Ledger
+ ******************************************************************************/
+
+// FileLedger is a Ledger kept in a file with one JSON entry per line. Every
+// operation re-reads the file under a cross-process lock, so several
+// processes can share one FileLedger. Changes are written atomically.
+type FileLedger struct {
+	filename    string
+	lockTimeout time.Duration
+}
+
+// NewFileLedger constructs a FileLedger kept in the given file, which is
+// created on the first change.
+func NewFileLedger(filename string) *FileLedger {
+	return &FileLedger{filename: filename, lockTimeout: DefaultLockTimeout}
+}
+
+func (l *FileLedger) Record(entry *LedgerEntry) error {
+	return l.update(func(mem *MemLedger) error {
+		return mem.Record(entry)
+	})
+}
+
+func (l *FileLedger) Get(serial *big.Int) (entry *LedgerEntry, err error) {
+	err = l.view(func(mem *MemLedger) error {
+		entry, err = mem.Get(serial)
+		return err
+	})
+	return
+}
+
+func (l *FileLedger) Revoke(serial *big.Int, at time.Time, reason int) error {
+	return l.update(func(mem *MemLedger) error {
+		return mem.Revoke(serial, at, reason)
+	})
+}
+
+func (l *FileLedger) Query(filters ...LedgerFilter) (entries []*LedgerEntry, err error) {
+	err = l.view(func(mem *MemLedger) error {
+		entries, err = mem.Query(filters...)
+		return err
+	})
+	return
+}
+
+func (l *FileLedger) view(fn func(mem *MemLedger) error) error {
+	mem, err := l.load()
+	if err != nil {
+		return err
+	}
+	return fn(mem)
+}
+
+func (l *FileLedger) update(fn func(mem *MemLedger) error) error {
+	dir, base := filepath.Split(l.filename)
+	lock, err := LockFile(filepath.Join(dir, lockFilePrefix+base), l.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			log.Debugf("Unable to unlock ledger: %v", err)
+		}
+	}()
+
+	mem, err := l.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(mem); err != nil {
+		return err
+	}
+	entries, _ := mem.Query()
+	data, err := encodeLedgerEntries(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.filename, data, 0600)
+}
+
+func (l *FileLedger) load() (*MemLedger, error) {
+	mem := NewMemLedger()
+	data, err := ioutil.ReadFile(l.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mem, nil
+		}
+		return nil, fmt.Errorf("Unable to read ledger %s: %w", l.filename, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := &LedgerEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("Unable to decode ledger %s line %d: %w", l.filename, line, err)
+		}
+		if err := mem.Record(entry); err != nil {
+			return nil, fmt.Errorf("Corrupt ledger %s line %d: %w", l.filename, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read ledger %s: %w", l.filename, err)
+	}
+	return mem, nil
+}
+
+// encodeLedgerEntries encodes entries in the format used by FileLedger.
+func encodeLedgerEntries(entries []*LedgerEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
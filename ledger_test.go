@@ -0,0 +1,155 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger(t *testing.T) {
+	for name, ledger := range map[string]Ledger{
+		"mem":  NewMemLedger(),
+		"file": NewFileLedger(filepath.Join(t.TempDir(), "index.json")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testLedger(t, ledger)
+		})
+	}
+}
+
+func testLedger(t *testing.T, ledger Ledger) {
+	caKey, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	caCert, err := caKey.CRLIssuerCertificateFor(time.Now().AddDate(1, 0, 0), nil, "Test Org", "Test CA")
+	if !assert.NoError(t, err) {
+		return
+	}
+	leafKey, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ca := NewCA(caKey, caCert, ledger)
+
+	soon, err := ca.TLSCertificateFor(&leafKey.RSA().PublicKey, "alice", time.Now().Add(ONE_WEEK), "Test Org", "soon.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	later, err := ca.TLSCertificateFor(&leafKey.RSA().PublicKey, "bob", time.Now().AddDate(0, 6, 0), "Test Org", "later.example.com", "10.0.0.1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = x509.ParseCertificate(later.DER())
+	assert.NoError(t, err)
+
+	_, err = ca.Issue(later.X509(), &leafKey.RSA().PublicKey, "mallory")
+	assert.True(t, errors.Is(err, ErrDuplicateSerial), "Reusing a serial number should fail")
+	assert.True(t, errors.Is(ledger.Record(NewLedgerEntry(soon, "alice")), ErrDuplicateSerial))
+
+	entry, err := ledger.Get(soon.X509().SerialNumber)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", entry.Requester)
+		assert.Equal(t, StatusValid, entry.Status)
+		assert.Equal(t, []string{"soon.example.com"}, entry.DNSNames)
+		assert.Equal(t, publicKeyFingerprint(later.X509()), entry.KeyFingerprint)
+	}
+
+	expiring, err := ledger.Query(ExpiringWithin(time.Now(), 30*24*time.Hour))
+	if assert.NoError(t, err) && assert.Len(t, expiring, 1) {
+		assert.Equal(t, soon.X509().SerialNumber, expiring[0].Serial)
+	}
+	forHost, err := ledger.Query(ForHost("10.0.0.1"))
+	if assert.NoError(t, err) && assert.Len(t, forHost, 1) {
+		assert.Equal(t, later.X509().SerialNumber, forHost[0].Serial)
+	}
+
+	assert.NoError(t, ca.Revoke(soon.X509().SerialNumber, 1))
+	assert.True(t, errors.Is(ca.Revoke(caCert.X509().SerialNumber, 1), ErrUnknownSerial))
+	expiring, _ = ledger.Query(ExpiringWithin(time.Now(), 30*24*time.Hour))
+	assert.Empty(t, expiring, "Revoked certificates aren't expiring")
+
+	crlBytes, err := ca.CRL(time.Now().Add(ONE_WEEK))
+	if assert.NoError(t, err) {
+		crl, err := x509.ParseRevocationList(crlBytes)
+		if assert.NoError(t, err) {
+			assert.NoError(t, crl.CheckSignatureFrom(caCert.X509()))
+			if assert.Len(t, crl.RevokedCertificateEntries, 1) {
+				assert.Equal(t, soon.X509().SerialNumber, crl.RevokedCertificateEntries[0].SerialNumber)
+				assert.Equal(t, 1, crl.RevokedCertificateEntries[0].ReasonCode)
+			}
+		}
+	}
+
+	// Plain CA certificates can't sign CRLs
+	plainCert, err := caKey.TLSCertificateFor(time.Now().AddDate(1, 0, 0), true, nil, "Test Org", "Test CA")
+	if assert.NoError(t, err) {
+		assert.Equal(t, x509.KeyUsage(0), plainCert.X509().KeyUsage&x509.KeyUsageCRLSign)
+		_, err = NewCA(caKey, plainCert, ledger).CRL(time.Now().Add(ONE_WEEK))
+		assert.Error(t, err)
+	}
+
+	all, _ := ledger.Query()
+	var index bytes.Buffer
+	assert.NoError(t, WriteOpenSSLIndex(&index, all))
+	lines := strings.Split(strings.TrimSpace(index.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		// Entries are ordered by serial number
+		if soon.X509().SerialNumber.Cmp(later.X509().SerialNumber) > 0 {
+			lines[0], lines[1] = lines[1], lines[0]
+		}
+		assert.True(t, strings.HasPrefix(lines[0], "R\t"), "Revoked entry should be marked")
+		assert.True(t, strings.HasPrefix(lines[1], "V\t"), "Valid entry should be marked")
+		assert.True(t, strings.HasSuffix(lines[0], "\tunknown\t/O=Test Org/CN=soon.example.com"), lines[0])
+	}
+}
+
+func TestCAIssueRefusesConcurrentDuplicates(t *testing.T) {
+	caKey, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	caCert, err := caKey.TLSCertificateFor(time.Now().AddDate(1, 0, 0), true, nil, "Test Org", "Test CA")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for name, ledger := range map[string]Ledger{
+		"mem":  NewMemLedger(),
+		"file": NewFileLedger(filepath.Join(t.TempDir(), "index.json")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ca := NewCA(caKey, caCert, ledger)
+			template := tlsTemplate(big.NewInt(42), time.Now(), time.Now().Add(ONE_WEEK), false, false, "Test Org", "dup.example.com")
+			const attempts = 8
+			var wg sync.WaitGroup
+			errs := make(chan error, attempts)
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := ca.Issue(template, &caKey.RSA().PublicKey, "alice")
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			issued := 0
+			for err := range errs {
+				if err == nil {
+					issued++
+				} else {
+					assert.True(t, errors.Is(err, ErrDuplicateSerial), "Unexpected error: %v", err)
+				}
+			}
+			assert.Equal(t, 1, issued, "Only one certificate should be issued per serial number")
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	lockFilePrefix = ".keyman-lock-"
+
+	lockPollInterval    = 10 * time.Millisecond
+	maxLockPollInterval = 250 * time.Millisecond
+)
+
+var (
+	// DefaultLockTimeout is how long load-or-create operations wait for other
+	// processes working on the same key pair when no timeout is specified.
+	DefaultLockTimeout = 30 * time.Second
+
+	// ErrLockTimeout is returned when a lock could not be acquired in time.
+	ErrLockTimeout = errors.New("Timed out waiting for lock")
+)
+
+// Locker is implemented by Stores that can hold a lock on an entry across
+// processes, so that only one of them creates a missing key pair.
+type Locker interface {
+	// Lock locks the named entry, waiting up to timeout for other holders to
+	// release it. The returned function releases the lock.
+	Lock(name string, timeout time.Duration) (unlock func(), err error)
+}
+
+// FileLock is an advisory lock on a file that is honored by other processes
+// (and other FileLocks in this process) locking the same file.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile acquires an exclusive advisory lock on the given file, creating it
+// if necessary and waiting up to timeout for the current holder to release
+// it. If timeout is zero, DefaultLockTimeout is used.
+func LockFile(filename string, timeout time.Duration) (*FileLock, error) {
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file %s: %w", filename, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	wait := lockPollInterval
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Unable to lock %s: %w", filename, err)
+		}
+		if locked {
+			return &FileLock{file: file}, nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("Unable to lock %s: %w", filename, ErrLockTimeout)
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxLockPollInterval {
+			wait = maxLockPollInterval
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Lock implements Locker using a lock file next to the named entry.
+func (s *DirStore) Lock(name string, timeout time.Duration) (func(), error) {
+	dir, base := filepath.Split(s.path(name))
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create directory for %s: %w", name, err)
+	}
+	l, err := LockFile(filepath.Join(dir, lockFilePrefix+base), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := l.Unlock(); err != nil {
+			log.Debugf("Unable to unlock %s: %v", name, err)
+		}
+	}, nil
+}
+
+// Lock implements Locker. MemStore locks only exclude other users of the same
+// MemStore.
+func (s *MemStore) Lock(name string, timeout time.Duration) (func(), error) {
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	s.mx.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]chan struct{})
+	}
+	ch, found := s.locks[name]
+	if !found {
+		ch = make(chan struct{}, 1)
+		s.locks[name] = ch
+	}
+	s.mx.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Unable to lock %s: %w", name, ErrLockTimeout)
+	}
+}
+
+// lockStore locks the named entry in the given Store if it supports locking,
+// and otherwise does nothing.
+func lockStore(store Store, name string, timeout time.Duration) (func(), error) {
+	locker, ok := store.(Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	return locker.Lock(name, timeout)
+}
+
+// lockStoreEntries locks all of the named entries in the given Store, in
+// sorted order so that callers locking overlapping entries can't deadlock.
+func lockStoreEntries(store Store, names []string, timeout time.Duration) (func(), error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	unlocks := make([]func(), 0, len(sorted))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, name := range sorted {
+		unlock, err := lockStore(store, name, timeout)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package keyman
+
+import (
+	"os"
+)
+
+// Advisory locks aren't supported on this platform, so locking always
+// succeeds immediately.
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
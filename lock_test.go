@@ -0,0 +1,101 @@
+package keyman
+
+import (
+	"crypto/tls"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoredPKAndCertConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	pkfile := filepath.Join(dir, "pk.pem")
+	certfile := filepath.Join(dir, "cert.pem")
+
+	const racers = 8
+	var wg sync.WaitGroup
+	pks := make([][]byte, racers)
+	errs := make([]error, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pk, _, err := StoredPKAndCert(pkfile, certfile, "Test Org", "127.0.0.1", "TestCommonName")
+			errs[i] = err
+			if err == nil {
+				pks[i] = pk.PEMEncoded()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < racers; i++ {
+		if assert.NoError(t, errs[i]) {
+			assert.Equal(t, pks[0], pks[i], "All racers should end up with the same key")
+		}
+	}
+	pk, err := LoadPKFromFile(pkfile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, pks[0], pk.PEMEncoded(), "Stored key should be the one all racers got")
+	}
+	_, err = tls.LoadX509KeyPair(certfile, pkfile)
+	assert.NoError(t, err, "Stored key and cert should form a key pair")
+}
+
+func TestKeyPairForConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	pkfile := filepath.Join(dir, "pk.pem")
+	certfile := filepath.Join(dir, "cert.pem")
+
+	const racers = 4
+	var wg sync.WaitGroup
+	certs := make([]tls.Certificate, racers)
+	errs := make([]error, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			certs[i], errs[i] = KeyPairFor("127.0.0.1", "TestCommonName", pkfile, certfile)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < racers; i++ {
+		if assert.NoError(t, errs[i]) {
+			assert.Equal(t, certs[0].Certificate, certs[i].Certificate, "All racers should end up with the same cert")
+		}
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	for name, store := range map[string]Store{
+		"dir": NewDirStore(t.TempDir()),
+		"mem": NewMemStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			locker := store.(Locker)
+			unlock, err := locker.Lock("pk.pem", time.Second)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = locker.Lock("pk.pem", 50*time.Millisecond)
+			assert.True(t, errors.Is(err, ErrLockTimeout), "Second lock should time out")
+
+			_, _, err = StoredPKAndCertIn(store, "pk.pem", "cert.pem", &PKAndCertOptions{CommonName: "Test", LockTimeout: 50 * time.Millisecond})
+			assert.True(t, errors.Is(err, ErrLockTimeout), "Load-or-create should time out while locked")
+
+			unlock()
+			unlock, err = locker.Lock("pk.pem", time.Second)
+			if assert.NoError(t, err, "Lock should be available after unlock") {
+				unlock()
+			}
+
+			names, _ := store.List()
+			assert.Empty(t, names, "Lock files should not be listed")
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// nssPublicTable is the table in cert9.db holding the certificate and
+	// trust objects
+	nssPublicTable = "nssPublic"
+
+	// PKCS#11 attribute types, object classes and trust values used by NSS,
+	// from pkcs11t.h and pkcs11n.h
+	ckaClass                = 0x0
+	ckaLabel                = 0x3
+	ckaValue                = 0x11
+	ckaIssuer               = 0x81
+	ckaSerialNumber         = 0x82
+	ckaTrustServerAuth      = 0xce536358
+	ckaTrustClientAuth      = 0xce536359
+	ckaTrustCodeSigning     = 0xce53635a
+	ckaTrustEmailProtection = 0xce53635b
+	ckaCertSHA1Hash         = 0xce5363b4
+
+	ckoCertificate = 0x1
+	ckoNSSTrust    = 0xce534353
+
+	cktNSSTrusted          = 0xce534351
+	cktNSSTrustedDelegator = 0xce534352
+	cktNSSNotTrusted       = 0xce53435a
+	cktNSSValidDelegator   = 0xce53435b
+)
+
+var (
+	// nssExplicitNull is stored by NSS for attributes with an empty value
+	nssExplicitNull = []byte{0xa5, 0x00, 0x5a}
+)
+
+// NSSCertificate is a certificate in an NSS database, along with its nickname
+// and trust flags.
+type NSSCertificate struct {
+	Nickname    string
+	Certificate *Certificate
+	Trust       NSSTrust
+}
+
+// NSSTrust holds the trust flags of a certificate in an NSS database for each
+// purpose, using the letters displayed by certutil, e.g. "C" for a CA trusted
+// to issue server certificates.
+type NSSTrust struct {
+	SSL           string
+	Email         string
+	ObjectSigning string
+}
+
+// String formats the trust flags like certutil does, e.g. "CT,C,".
+func (t NSSTrust) String() string {
+	return t.SSL + "," + t.Email + "," + t.ObjectSigning
+}
+
+// TrustedCA reports whether the certificate is trusted to issue server
+// certificates, which is how Add installs certificates.
+func (t NSSTrust) TrustedCA() bool {
+	return strings.Contains(t.SSL, "C")
+}
+
+// ReadNSSCertDB lists the certificates in the SQLite based cert9.db of the
+// given NSS database, without needing certutil. db is the database directory,
+// optionally prefixed with "sql:". Legacy "dbm:" databases aren't supported.
+func ReadNSSCertDB(db string) ([]*NSSCertificate, error) {
+	if strings.HasPrefix(db, "dbm:") {
+		return nil, &Error{Op: "read NSS database", Path: db, Kind: ErrNotSupported}
+	}
+	filename := filepath.Join(strings.TrimPrefix(db, "sql:"), "cert9.db")
+	sqlite, err := openSQLite(filename)
+	if err != nil {
+		return nil, &Error{Op: "read NSS database", Path: filename, Err: err}
+	}
+
+	var certs []*NSSCertificate
+	trusts := make(map[string]NSSTrust)
+	trustsBySHA1 := make(map[string]NSSTrust)
+	err = sqlite.rows(nssPublicTable, func(row map[string]interface{}) error {
+		class, ok := nssULong(row, ckaClass)
+		if !ok {
+			return nil
+		}
+		switch class {
+		case ckoCertificate:
+			cert, err := LoadCertificateFromDERBytes(nssAttribute(row, ckaValue))
+			if err != nil {
+				log.Debugf("Skipping unparseable certificate in %v: %v", filename, err)
+				return nil
+			}
+			certs = append(certs, &NSSCertificate{
+				Nickname:    string(nssAttribute(row, ckaLabel)),
+				Certificate: cert,
+			})
+		case ckoNSSTrust:
+			trust := nssTrustFor(row)
+			if issuer, serial := nssAttribute(row, ckaIssuer), nssAttribute(row, ckaSerialNumber); len(issuer) > 0 && len(serial) > 0 {
+				trusts[nssTrustKey(issuer, serial)] = trust
+			}
+			if hash := nssAttribute(row, ckaCertSHA1Hash); len(hash) > 0 {
+				trustsBySHA1[string(hash)] = trust
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &Error{Op: "read NSS database", Path: filename, Err: err}
+	}
+
+	for _, cert := range certs {
+		trust, found := trusts[nssTrustKey(cert.Certificate.X509().RawIssuer, nssSerial(cert.Certificate))]
+		if !found {
+			hash := sha1.Sum(cert.Certificate.DER())
+			trust = trustsBySHA1[string(hash[:])]
+		}
+		cert.Trust = trust
+	}
+	return certs, nil
+}
+
+// nssTrustFor converts the PKCS#11 trust values of a trust object to the
+// flags displayed by certutil.
+func nssTrustFor(row map[string]interface{}) NSSTrust {
+	flags := func(attr uint32) string {
+		value, _ := nssULong(row, attr)
+		switch value {
+		case cktNSSTrustedDelegator:
+			return "C"
+		case cktNSSValidDelegator:
+			return "c"
+		case cktNSSTrusted:
+			return "P"
+		case cktNSSNotTrusted:
+			return "p"
+		}
+		return ""
+	}
+	trust := NSSTrust{
+		SSL:           flags(ckaTrustServerAuth),
+		Email:         flags(ckaTrustEmailProtection),
+		ObjectSigning: flags(ckaTrustCodeSigning),
+	}
+	if value, _ := nssULong(row, ckaTrustClientAuth); value == cktNSSTrustedDelegator {
+		trust.SSL += "T"
+	}
+	return trust
+}
+
+// nssAttribute returns the value of the given attribute in a row of the
+// nssPublic table, which is stored in the column named after its type.
+func nssAttribute(row map[string]interface{}, attr uint32) []byte {
+	var value []byte
+	switch v := row[fmt.Sprintf("a%x", attr)].(type) {
+	case []byte:
+		value = v
+	case string:
+		value = []byte(v)
+	}
+	if bytes.Equal(value, nssExplicitNull) {
+		return nil
+	}
+	return value
+}
+
+// nssULong decodes a CK_ULONG attribute, which NSS stores as 4 bytes in
+// network byte order.
+func nssULong(row map[string]interface{}, attr uint32) (uint32, bool) {
+	value := nssAttribute(row, attr)
+	if len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// nssSerial DER encodes the serial number of the given certificate, as stored
+// in CKA_SERIAL_NUMBER.
+func nssSerial(cert *Certificate) []byte {
+	serial, err := asn1.Marshal(cert.X509().SerialNumber)
+	if err != nil {
+		return nil
+	}
+	return serial
+}
+
+func nssTrustKey(issuer, serial []byte) string {
+	return string(issuer) + "\x00" + string(serial)
+}
@@ -0,0 +1,112 @@
+package keyman
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// NSS_FIXTURE is an NSS database with page size 1024, so that the table
+	// spans interior pages and certificates overflow onto other pages.
+	NSS_FIXTURE = "testdata/nss"
+)
+
+func TestReadNSSCertDB(t *testing.T) {
+	ctx := context.Background()
+	data, err := ioutil.ReadFile(filepath.Join(NSS_FIXTURE, "certs.pem"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected, err := LoadCertificatesFromPEMBytes(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	entries, err := ReadNSSCertDB("sql:" + NSS_FIXTURE)
+	if !assert.NoError(t, err) || !assert.Len(t, entries, len(expected)) {
+		return
+	}
+	for i, entry := range entries {
+		assert.Equal(t, expected[i].DER(), entry.Certificate.DER())
+		assert.Equal(t, entry.Certificate.X509().Subject.CommonName, entry.Nickname)
+	}
+	trust := make(map[string]string)
+	for _, entry := range entries[:6] {
+		trust[entry.Nickname] = entry.Trust.String()
+	}
+	assert.Equal(t, map[string]string{
+		"Lantern":                 "C,,",
+		"My Company Root CA - G2": "CT,C,C",
+		"Email Only":              ",C,",
+		"Trusted Peer":            "P,,",
+		"Distrusted":              "p,p,p",
+		"No Trust":                ",,",
+	}, trust)
+
+	store := NewNSSTrustStore("sql:" + NSS_FIXTURE)
+	certs, err := store.List(ctx)
+	if assert.NoError(t, err) {
+		assert.Len(t, certs, len(expected))
+	}
+	for i, installed := range []bool{true, true, false, false, false, false} {
+		contains, err := store.Contains(ctx, expected[i])
+		assert.NoError(t, err)
+		assert.Equal(t, installed, contains, "Only certs trusted as SSL CAs should be installed: %v", entries[i].Nickname)
+	}
+	contains, err := store.Contains(ctx, testRoot(t, "Lantern"))
+	assert.NoError(t, err)
+	assert.False(t, contains, "Different cert with the same nickname should not be installed")
+	assert.True(t, store.containsName(ctx, "Lantern"))
+	assert.False(t, store.containsName(ctx, "Missing"))
+
+	_, err = ReadNSSCertDB("dbm:" + NSS_FIXTURE)
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	_, err = ReadNSSCertDB("sql:" + t.TempDir())
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestSQLiteCorrupt(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(NSS_FIXTURE, "cert9.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = parseSQLite([]byte("not a database"))
+	assert.True(t, errors.Is(err, errSQLiteCorrupt))
+
+	db, err := parseSQLite(data[:len(data)/2])
+	if assert.NoError(t, err) {
+		err = db.rows(nssPublicTable, func(row map[string]interface{}) error { return nil })
+		assert.True(t, errors.Is(err, errSQLiteCorrupt), "Truncated database should be detected")
+	}
+
+	db, err = parseSQLite(data)
+	if assert.NoError(t, err) {
+		err = db.rows("missing", func(row map[string]interface{}) error { return nil })
+		assert.Error(t, err)
+	}
+}
+
+func TestSQLiteVarint(t *testing.T) {
+	for _, c := range []struct {
+		in  []byte
+		v   uint64
+		len int
+	}{
+		{[]byte{0x05}, 5, 1},
+		{[]byte{0x81, 0x00}, 128, 2},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<64 - 1, 9},
+		{[]byte{0x81}, 0, 0},
+	} {
+		v, n := sqliteVarint(c.in)
+		assert.Equal(t, c.v, v)
+		assert.Equal(t, c.len, n)
+	}
+	columns, rowid := sqliteColumns(`CREATE TABLE t (id INTEGER PRIMARY KEY, "name" TEXT, data BLOB DEFAULT (x'00'), UNIQUE (name, data))`)
+	assert.Equal(t, []string{"id", "name", "data"}, columns)
+	assert.Equal(t, 0, rowid)
+}
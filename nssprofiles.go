@@ -0,0 +1,220 @@
+package keyman
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Applications that keep certificates in NSS databases.
+const (
+	NSSAppFirefox     = "firefox"
+	NSSAppThunderbird = "thunderbird"
+	NSSAppLibreWolf   = "librewolf"
+	NSSAppChromium    = "chromium"
+	NSSAppChrome      = "chrome"
+	// NSSAppShared is the shared database in ~/.pki/nssdb, used by Chrome,
+	// Chromium and other applications on Linux.
+	NSSAppShared = "shared"
+)
+
+// Packagings of applications, which determine where they keep their
+// profiles.
+const (
+	NSSPackagingNative  = ""
+	NSSPackagingFlatpak = "flatpak"
+	NSSPackagingSnap    = "snap"
+)
+
+// NSSDBFormat is the format of an NSS database, which is also the prefix used
+// to address it, e.g. "sql:/home/user/.pki/nssdb".
+type NSSDBFormat string
+
+const (
+	// NSSDBSQL is the SQLite based format (cert9.db)
+	NSSDBSQL NSSDBFormat = "sql"
+	// NSSDBLegacy is the legacy Berkeley DB based format (cert8.db)
+	NSSDBLegacy NSSDBFormat = "dbm"
+)
+
+var (
+	// nssProfileLocations are the places, relative to the home directory,
+	// where applications keep their NSS databases.
+	nssProfileLocations = []nssProfileLocation{
+		{NSSAppFirefox, NSSPackagingNative, ".mozilla/firefox", true},
+		{NSSAppFirefox, NSSPackagingFlatpak, ".var/app/org.mozilla.firefox/.mozilla/firefox", true},
+		{NSSAppFirefox, NSSPackagingSnap, "snap/firefox/common/.mozilla/firefox", true},
+		{NSSAppThunderbird, NSSPackagingNative, ".thunderbird", true},
+		{NSSAppThunderbird, NSSPackagingFlatpak, ".var/app/org.mozilla.Thunderbird/.thunderbird", true},
+		{NSSAppThunderbird, NSSPackagingSnap, "snap/thunderbird/common/.thunderbird", true},
+		{NSSAppLibreWolf, NSSPackagingNative, ".librewolf", true},
+		{NSSAppLibreWolf, NSSPackagingFlatpak, ".var/app/io.gitlab.librewolf-community/.librewolf", true},
+		{NSSAppShared, NSSPackagingNative, ".pki/nssdb", false},
+		{NSSAppChromium, NSSPackagingSnap, "snap/chromium/current/.pki/nssdb", false},
+		{NSSAppChromium, NSSPackagingFlatpak, ".var/app/org.chromium.Chromium/.pki/nssdb", false},
+		{NSSAppChrome, NSSPackagingFlatpak, ".var/app/com.google.Chrome/.pki/nssdb", false},
+	}
+)
+
+type nssProfileLocation struct {
+	application string
+	packaging   string
+	dir         string
+	// mozilla locations contain profile directories listed in profiles.ini
+	// and installs.ini, rather than being a database themselves
+	mozilla bool
+}
+
+// NSSProfile is an NSS database used by an application, like a Firefox profile
+// or the shared database used by Chrome on Linux.
+type NSSProfile struct {
+	// Application is one of the NSSApp constants
+	Application string
+	// Packaging is one of the NSSPackaging constants
+	Packaging string
+	// Name is the name of the profile from profiles.ini, if any
+	Name   string
+	Path   string
+	Format NSSDBFormat
+}
+
+// DB returns the database address understood by certutil and NSSTrustStore,
+// e.g. "sql:/home/user/.pki/nssdb".
+func (p *NSSProfile) DB() string {
+	return string(p.Format) + ":" + p.Path
+}
+
+// FindNSSProfiles discovers the NSS databases of the applications installed
+// for the user with the given home directory, natively, as Flatpaks or as
+// Snaps. Mozilla profiles are found through profiles.ini and installs.ini.
+// Profiles that don't have a database yet are skipped.
+func FindNSSProfiles(home string) []*NSSProfile {
+	var profiles []*NSSProfile
+	seen := make(map[string]bool)
+	for _, location := range nssProfileLocations {
+		root := filepath.Join(home, filepath.FromSlash(location.dir))
+		dirs := []mozillaProfileDir{{path: root}}
+		if location.mozilla {
+			dirs = mozillaProfileDirs(root)
+		}
+		for _, dir := range dirs {
+			profile := nssProfileIn(location.application, location.packaging, dir.name, dir.path)
+			if profile != nil && !seen[profile.Path] {
+				seen[profile.Path] = true
+				profiles = append(profiles, profile)
+			}
+		}
+	}
+	return profiles
+}
+
+// nssProfileIn constructs an NSSProfile for the database in the given
+// directory, or returns nil if there's no database there.
+func nssProfileIn(application, packaging, name, dir string) *NSSProfile {
+	dir = filepath.Clean(dir)
+	profile := &NSSProfile{Application: application, Packaging: packaging, Name: name, Path: dir}
+	switch {
+	case pathIsFile(filepath.Join(dir, "cert9.db")):
+		profile.Format = NSSDBSQL
+	case pathIsFile(filepath.Join(dir, "cert8.db")):
+		profile.Format = NSSDBLegacy
+	default:
+		return nil
+	}
+	return profile
+}
+
+type mozillaProfileDir struct {
+	name string
+	path string
+}
+
+// mozillaProfileDirs lists the profile directories of a Mozilla application
+// whose profiles are kept in root. Profiles are read from profiles.ini and
+// installs.ini, falling back to the subdirectories of root if neither exists.
+func mozillaProfileDirs(root string) []mozillaProfileDir {
+	// Defaults of installations usually are listed profiles too, so they're
+	// added last to keep the names of the profiles
+	var dirs, defaults []mozillaProfileDir
+	found := false
+	for _, file := range []string{"profiles.ini", "installs.ini"} {
+		data, err := ioutil.ReadFile(filepath.Join(root, file))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Debugf("Unable to read %v: %v", filepath.Join(root, file), err)
+			}
+			continue
+		}
+		found = true
+		for _, section := range parseINI(data) {
+			if strings.HasPrefix(section.name, "Profile") {
+				if path := section.values["Path"]; path != "" {
+					dirs = append(dirs, mozillaProfileDir{name: section.values["Name"], path: mozillaProfilePath(root, path, section.values["IsRelative"] != "0")})
+				}
+			} else if path := section.values["Default"]; path != "" {
+				// Install sections point to the default profile of each
+				// installation
+				defaults = append(defaults, mozillaProfileDir{path: mozillaProfilePath(root, path, true)})
+			}
+		}
+	}
+	if found {
+		return append(dirs, defaults...)
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, mozillaProfileDir{path: filepath.Join(root, entry.Name())})
+		}
+	}
+	return dirs
+}
+
+// mozillaProfilePath resolves the path of a profile listed in profiles.ini or
+// installs.ini.
+func mozillaProfilePath(root string, path string, relative bool) string {
+	path = filepath.FromSlash(path)
+	if relative && !filepath.IsAbs(path) {
+		return filepath.Join(root, path)
+	}
+	return path
+}
+
+type iniSection struct {
+	name   string
+	values map[string]string
+}
+
+// parseINI parses the sections of an INI file like profiles.ini, in the order
+// in which they appear.
+func parseINI(data []byte) []*iniSection {
+	var sections []*iniSection
+	var section *iniSection
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = &iniSection{name: line[1 : len(line)-1], values: make(map[string]string)}
+			sections = append(sections, section)
+		case section != nil:
+			if i := strings.Index(line, "="); i > 0 {
+				section.values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return sections
+}
+
+func pathIsFile(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && !stat.IsDir()
+}
@@ -0,0 +1,93 @@
+package keyman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindNSSProfiles(t *testing.T) {
+	home := t.TempDir()
+	absolute := filepath.Join(t.TempDir(), "elsewhere")
+	write := func(path string, data string) {
+		path = filepath.Join(home, filepath.FromSlash(path))
+		if !assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755)) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644)) {
+			t.FailNow()
+		}
+	}
+
+	write(".mozilla/firefox/profiles.ini", `
+[Install4F96D1932A9F858E]
+Default=abcd.default-release
+Locked=1
+
+[Profile1]
+Name=default
+IsRelative=1
+Path=efgh.default
+
+[Profile0]
+Name=default-release
+IsRelative=1
+Path=abcd.default-release
+Default=1
+
+[Profile2]
+Name=elsewhere
+IsRelative=0
+Path=`+absolute+`
+
+[Profile3]
+Name=never-started
+IsRelative=1
+Path=ijkl.never-started
+
+[General]
+StartWithLastProfile=1
+Version=2
+`)
+	write(".mozilla/firefox/abcd.default-release/cert9.db", "")
+	write(".mozilla/firefox/efgh.default/cert8.db", "")
+	write(".mozilla/firefox/unlisted.default/cert9.db", "")
+	assert.NoError(t, os.MkdirAll(absolute, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(absolute, "cert9.db"), nil, 0644))
+
+	write(".var/app/org.mozilla.firefox/.mozilla/firefox/installs.ini", "[9F0C1D2E]\nDefault=flat.default-release\n")
+	write(".var/app/org.mozilla.firefox/.mozilla/firefox/flat.default-release/cert9.db", "")
+	// Without profiles.ini, all profile directories are used
+	write("snap/firefox/common/.mozilla/firefox/snap.default/cert9.db", "")
+	write(".thunderbird/profiles.ini", "[Profile0]\nName=default\nPath=tb.default\n")
+	write(".thunderbird/tb.default/cert9.db", "")
+	write(".librewolf/profiles.ini", "[Profile0]\nName=default\nIsRelative=1\nPath=lw.default\n")
+	write(".librewolf/lw.default/cert9.db", "")
+	write(".pki/nssdb/cert9.db", "")
+	write(".var/app/org.chromium.Chromium/.pki/nssdb/cert9.db", "")
+
+	type record struct {
+		Application, Packaging, Name, DB string
+	}
+	var found []record
+	for _, profile := range FindNSSProfiles(home) {
+		found = append(found, record{profile.Application, profile.Packaging, profile.Name, profile.DB()})
+	}
+	in := func(path string) string { return filepath.Join(home, filepath.FromSlash(path)) }
+	assert.Equal(t, []record{
+		{NSSAppFirefox, NSSPackagingNative, "default", "dbm:" + in(".mozilla/firefox/efgh.default")},
+		{NSSAppFirefox, NSSPackagingNative, "default-release", "sql:" + in(".mozilla/firefox/abcd.default-release")},
+		{NSSAppFirefox, NSSPackagingNative, "elsewhere", "sql:" + absolute},
+		{NSSAppFirefox, NSSPackagingFlatpak, "", "sql:" + in(".var/app/org.mozilla.firefox/.mozilla/firefox/flat.default-release")},
+		{NSSAppFirefox, NSSPackagingSnap, "", "sql:" + in("snap/firefox/common/.mozilla/firefox/snap.default")},
+		{NSSAppThunderbird, NSSPackagingNative, "default", "sql:" + in(".thunderbird/tb.default")},
+		{NSSAppLibreWolf, NSSPackagingNative, "default", "sql:" + in(".librewolf/lw.default")},
+		{NSSAppShared, NSSPackagingNative, "", "sql:" + in(".pki/nssdb")},
+		{NSSAppChromium, NSSPackagingFlatpak, "", "sql:" + in(".var/app/org.chromium.Chromium/.pki/nssdb")},
+	}, found)
+
+	assert.Empty(t, FindNSSProfiles(t.TempDir()))
+}
@@ -0,0 +1,113 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// PermissionsIgnore loads private keys regardless of their permissions
+	PermissionsIgnore PermissionPolicy = iota
+	// PermissionsRefuse refuses to load private keys that others can access
+	PermissionsRefuse
+	// PermissionsRepair restricts the mode of private keys that others can
+	// read to 0600 before loading them. Problems that can't be repaired, like
+	// the wrong owner, are refused.
+	PermissionsRepair
+)
+
+// PermissionPolicy determines how loaders treat private key files that can be
+// accessed by someone other than their owner.
+type PermissionPolicy int
+
+// PermissionError indicates that a private key file, or the directory that
+// holds it, is accessible by someone other than the current user.
+type PermissionError struct {
+	// Path is the offending file or directory
+	Path string
+	// Mode is the mode of Path
+	Mode os.FileMode
+	// Problem describes what's wrong
+	Problem string
+	// Err is the error that prevented repairing Path, if any
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Insecure permissions on %s (%v): %s: %v", e.Path, e.Mode, e.Problem, e.Err)
+	}
+	return fmt.Sprintf("Insecure permissions on %s (%v): %s", e.Path, e.Mode, e.Problem)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrInsecurePermissions.
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrInsecurePermissions
+}
+
+// CheckKeyFilePermissions checks that the given private key file is only
+// accessible by the current user: it must be owned by the current user and
+// not readable or writable by group or others, and its parent directory must
+// not be writable by group or others unless it has the sticky bit set. Problems are returned as *PermissionError. On
+// Windows, where file modes don't reflect ACLs, this always succeeds.
+func CheckKeyFilePermissions(filename string) error {
+	return checkKeyFilePermissions(filename, PermissionsRefuse)
+}
+
+// LoadPKFromFileWithPermissions is like LoadPKFromFile, but first checks the
+// file's permissions according to the given policy.
+func LoadPKFromFileWithPermissions(filename string, policy PermissionPolicy) (*PrivateKey, error) {
+	if err := checkKeyFilePermissions(filename, policy); err != nil {
+		return nil, err
+	}
+	return LoadPKFromFile(filename)
+}
+
+func checkKeyFilePermissions(filename string, policy PermissionPolicy) error {
+	if policy == PermissionsIgnore {
+		return nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(filename, info); err != nil {
+		return err
+	}
+	if mode := info.Mode().Perm(); checkModes && mode&0077 != 0 {
+		if policy != PermissionsRepair {
+			return &PermissionError{Path: filename, Mode: mode, Problem: "accessible by group or others"}
+		}
+		log.Debugf("Restricting permissions on %s from %v to 0600", filename, mode)
+		if err := os.Chmod(filename, 0600); err != nil {
+			return &PermissionError{Path: filename, Mode: mode, Problem: "unable to restrict permissions to 0600", Err: err}
+		}
+	}
+
+	dir := filepath.Dir(filename)
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	// A directory that others can write to lets them replace the key, unless
+	// the sticky bit prevents them from touching our files.
+	if mode := dirInfo.Mode(); checkModes && mode.Perm()&0022 != 0 && mode&os.ModeSticky == 0 {
+		return &PermissionError{Path: dir, Mode: mode, Problem: "directory writable by group or others"}
+	}
+	return nil
+}
+
+// permissionChecker is implemented by Stores that can check the permissions of
+// their entries.
+type permissionChecker interface {
+	checkPermissions(name string, policy PermissionPolicy) error
+}
+
+func (s *DirStore) checkPermissions(name string, policy PermissionPolicy) error {
+	return checkKeyFilePermissions(s.path(name), policy)
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package keyman
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFilePermissions(t *testing.T) {
+	dir := t.TempDir()
+	if !assert.NoError(t, os.Chmod(dir, 0700)) {
+		return
+	}
+	pkfile := filepath.Join(dir, "pk.pem")
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, pk.WriteToFile(pkfile)) {
+		return
+	}
+	assert.NoError(t, CheckKeyFilePermissions(pkfile))
+
+	// Overwriting must restore 0600
+	assert.NoError(t, os.Chmod(pkfile, 0644))
+	assert.NoError(t, pk.WriteToFile(pkfile))
+	info, _ := os.Stat(pkfile)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Writer should enforce 0600")
+
+	assert.NoError(t, os.Chmod(pkfile, 0644))
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsRefuse)
+	var permErr *PermissionError
+	if assert.True(t, errors.As(err, &permErr), "World readable key should be refused") {
+		assert.Equal(t, pkfile, permErr.Path)
+	}
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsIgnore)
+	assert.NoError(t, err)
+
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsRepair)
+	assert.NoError(t, err)
+	info, _ = os.Stat(pkfile)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Loader should repair permissions")
+
+	_, _, err = StoredPKAndCertIn(NewDirStore(dir), "pk.pem", "cert.pem", &PKAndCertOptions{CommonName: "Test", KeyPermissions: PermissionsRefuse})
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.Chmod(dir, 0777))
+	defer os.Chmod(dir, 0700)
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsRepair)
+	if assert.True(t, errors.As(err, &permErr), "Key in world writable directory should be refused") {
+		assert.Equal(t, dir, permErr.Path)
+	}
+	_, _, err = StoredPKAndCertIn(NewDirStore(dir), "pk.pem", "cert.pem", &PKAndCertOptions{CommonName: "Test", KeyPermissions: PermissionsRefuse})
+	assert.True(t, errors.As(err, &permErr), "Load-or-create should refuse insecure key")
+
+	assert.NoError(t, os.Chmod(dir, 0770))
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsRefuse)
+	assert.True(t, errors.As(err, &permErr), "Key in group writable directory should be refused")
+	assert.NoError(t, os.Chmod(dir, os.ModeSticky|0777))
+	_, err = LoadPKFromFileWithPermissions(pkfile, PermissionsRefuse)
+	assert.NoError(t, err, "Sticky directory should be accepted")
+}
+
+func TestPermissionErrorUnwraps(t *testing.T) {
+	err := error(&PermissionError{Path: "pk.pem", Mode: 0644, Problem: "unable to restrict permissions to 0600", Err: os.ErrPermission})
+	assert.True(t, errors.Is(err, os.ErrPermission), "Repair failure should be available to errors.Is")
+	assert.Contains(t, err.Error(), os.ErrPermission.Error())
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	checkModes = true
+)
+
+func checkOwner(filename string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if euid := os.Geteuid(); int(stat.Uid) != euid {
+		return &PermissionError{Path: filename, Mode: info.Mode(), Problem: fmt.Sprintf("owned by uid %d instead of %d", stat.Uid, euid)}
+	}
+	return nil
+}
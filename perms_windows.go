@@ -0,0 +1,14 @@
+package keyman
+
+import (
+	"os"
+)
+
+const (
+	// File modes on Windows don't reflect who can access a file
+	checkModes = false
+)
+
+func checkOwner(filename string, info os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,308 @@
+package keyman
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultRunner runs the external commands of TrustStores that don't have
+	// their own Runner. It can be replaced, e.g. with an AuditRunner wrapping
+	// it.
+	DefaultRunner Runner = ExecRunner{}
+)
+
+const (
+	// RedactedArg replaces secret arguments of Commands when they're
+	// displayed, audited or encoded as JSON.
+	RedactedArg = "<redacted>"
+)
+
+// Command is an external command run by keyman, like certutil or security.
+type Command struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	// Prompt, if set, means that the command needs to be run with elevated
+	// privileges, using Prompt when asking the user for permission.
+	Prompt string `json:"prompt,omitempty"`
+	// Secret are the indexes of Args that are secret, like passwords. They're
+	// replaced with RedactedArg everywhere but when running the command.
+	Secret []int `json:"-"`
+	// Env are additional environment variables of the command, as
+	// "NAME=value". Unlike Args, they aren't visible to other users, so
+	// they're the place for secrets the command can read from its
+	// environment. They're never displayed, audited or encoded as JSON.
+	Env []string `json:"-"`
+}
+
+// Elevated determines whether the command is run with elevated privileges.
+func (c *Command) Elevated() bool {
+	return c.Prompt != ""
+}
+
+// RedactedArgs returns Args with the secret ones replaced by RedactedArg.
+func (c *Command) RedactedArgs() []string {
+	args := append([]string(nil), c.Args...)
+	for _, i := range c.Secret {
+		if i >= 0 && i < len(args) {
+			args[i] = RedactedArg
+		}
+	}
+	return args
+}
+
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.RedactedArgs()...), " ")
+}
+
+// MarshalJSON encodes the command with its secret arguments redacted.
+func (c *Command) MarshalJSON() ([]byte, error) {
+	type command Command
+	redacted := command(*c)
+	redacted.Args = c.RedactedArgs()
+	return json.Marshal(&redacted)
+}
+
+// Runner runs external commands. Every command run by keyman's TrustStores is
+// issued through a Runner.
+type Runner interface {
+	// Run runs the command until it completes or the context is done,
+	// returning its combined output. See runCommand for how the context is
+	// handled.
+	Run(ctx context.Context, cmd *Command) ([]byte, error)
+
+	// LookPath finds the named command, failing with exec.ErrNotFound if it's
+	// not installed.
+	LookPath(name string) (string, error)
+}
+
+// runnerOr returns runner, or DefaultRunner if it's nil.
+func runnerOr(runner Runner) Runner {
+	if runner == nil {
+		return DefaultRunner
+	}
+	return runner
+}
+
+/*******************************************************************************
+ * Exec Runner
+ ******************************************************************************/
+
+// ExecRunner runs commands as processes, elevating privileges with elevate on
+// macOS and Windows, or pkexec on Linux unless running as root.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, cmd *Command) ([]byte, error) {
+	out, err := runCommand(ctx, execCommand(cmd))
+	if err != nil && cmd.Elevated() && usesPkexec() && exitCode(err) == pkexecDismissedExitCode {
+		err = &Error{Op: "elevate privileges for " + cmd.Name, Kind: ErrElevationDeclined, Err: err}
+	}
+	return out, err
+}
+
+// envFromStdinScript is a shell script that exports the "NAME=value" lines
+// read from stdin before running the command given as its arguments.
+const envFromStdinScript = `while IFS= read -r v; do export "$v"; done; exec "$0" "$@"`
+
+// execCommand builds the process for the given command, elevating it if
+// necessary. pkexec clears the environment, so Env is passed to elevated
+// commands on stdin and exported by a shell, rather than on the command line
+// where other users could see it.
+func execCommand(cmd *Command) *exec.Cmd {
+	if len(cmd.Env) > 0 && cmd.Elevated() && usesPkexec() {
+		c := exec.Command("pkexec", append([]string{"/bin/sh", "-c", envFromStdinScript, cmd.Name}, cmd.Args...)...)
+		c.Stdin = strings.NewReader(strings.Join(cmd.Env, "\n") + "\n")
+		return c
+	}
+	c := elevatedIfNecessary(cmd.Prompt)(cmd.Name, cmd.Args...)
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	return c
+}
+
+// usesPkexec determines whether elevated commands are run with pkexec.
+func usesPkexec() bool {
+	return runtime.GOOS == "linux" && os.Geteuid() != 0
+}
+
+func (ExecRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+/*******************************************************************************
+ * Audit Runner
+ ******************************************************************************/
+
+// AuditRecord records a command run by an AuditRunner.
+type AuditRecord struct {
+	Time     time.Time     `json:"time"`
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Elevated bool          `json:"elevated"`
+	Duration time.Duration `json:"duration"`
+	// Error is the error running the command, if any
+	Error string `json:"error,omitempty"`
+}
+
+// AuditRunner is a Runner that records every command it runs, and whether it
+// was elevated, as JSON lines, before returning the result of the wrapped
+// Runner.
+type AuditRunner struct {
+	runner Runner
+	w      io.Writer
+	mx     sync.Mutex
+}
+
+// NewAuditRunner constructs an AuditRunner that runs commands with the given
+// Runner (nil for DefaultRunner) and records them to w. To audit all commands,
+// replace the DefaultRunner, e.g.
+//
+//	keyman.DefaultRunner = keyman.NewAuditRunner(keyman.DefaultRunner, auditLog)
+func NewAuditRunner(runner Runner, w io.Writer) *AuditRunner {
+	return &AuditRunner{runner: runnerOr(runner), w: w}
+}
+
+func (r *AuditRunner) Run(ctx context.Context, cmd *Command) ([]byte, error) {
+	start := time.Now()
+	out, err := r.runner.Run(ctx, cmd)
+	record := &AuditRecord{
+		Time:     start,
+		Command:  cmd.Name,
+		Args:     cmd.RedactedArgs(),
+		Elevated: cmd.Elevated(),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, jsonErr := json.Marshal(record)
+	if jsonErr != nil {
+		log.Debugf("Unable to encode audit record: %v", jsonErr)
+		return out, err
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if _, writeErr := r.w.Write(append(line, '\n')); writeErr != nil {
+		log.Debugf("Unable to write audit record: %v", writeErr)
+	}
+	return out, err
+}
+
+func (r *AuditRunner) LookPath(name string) (string, error) {
+	return r.runner.LookPath(name)
+}
+
+/*******************************************************************************
+ * Fake Runner
+ ******************************************************************************/
+
+// FakeRunner is a Runner that records the commands it's asked to run and
+// returns scripted results, for use in tests. Commands without a scripted
+// result succeed without output.
+type FakeRunner struct {
+	commands []*Command
+	scripts  []*fakeScript
+	missing  map[string]bool
+	mx       sync.Mutex
+}
+
+type fakeScript struct {
+	name string
+	args []string
+	out  []byte
+	err  error
+}
+
+// NewFakeRunner constructs a FakeRunner with no scripted results.
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{missing: make(map[string]bool)}
+}
+
+// On scripts the output and error of commands with the given name whose
+// arguments start with the given ones. Later scripts take precedence over
+// earlier ones.
+func (r *FakeRunner) On(name string, args []string, out string, err error) *FakeRunner {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.scripts = append(r.scripts, &fakeScript{name: name, args: args, out: []byte(out), err: err})
+	return r
+}
+
+// Missing makes the named commands appear not to be installed.
+func (r *FakeRunner) Missing(names ...string) *FakeRunner {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, name := range names {
+		r.missing[name] = true
+	}
+	return r
+}
+
+// Commands returns the commands run so far.
+func (r *FakeRunner) Commands() []*Command {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]*Command(nil), r.commands...)
+}
+
+// CommandLines returns the commands run so far as strings, prefixed with
+// "[elevated] " if they were elevated.
+func (r *FakeRunner) CommandLines() []string {
+	var lines []string
+	for _, cmd := range r.Commands() {
+		line := cmd.String()
+		if cmd.Elevated() {
+			line = "[elevated] " + line
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (r *FakeRunner) Run(ctx context.Context, cmd *Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.commands = append(r.commands, &Command{Name: cmd.Name, Args: append([]string(nil), cmd.Args...), Prompt: cmd.Prompt, Secret: cmd.Secret, Env: append([]string(nil), cmd.Env...)})
+	if r.missing[cmd.Name] {
+		return nil, &exec.Error{Name: cmd.Name, Err: exec.ErrNotFound}
+	}
+	for i := len(r.scripts) - 1; i >= 0; i-- {
+		script := r.scripts[i]
+		if script.matches(cmd) {
+			return script.out, script.err
+		}
+	}
+	return nil, nil
+}
+
+func (r *FakeRunner) LookPath(name string) (string, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.missing[name] {
+		return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	return "/fake/bin/" + name, nil
+}
+
+func (s *fakeScript) matches(cmd *Command) bool {
+	if s.name != cmd.Name || len(s.args) > len(cmd.Args) {
+		return false
+	}
+	for i, arg := range s.args {
+		if cmd.Args[i] != arg {
+			return false
+		}
+	}
+	return true
+}
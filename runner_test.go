@@ -0,0 +1,249 @@
+package keyman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commandLines returns the command lines run by the given runner, replacing
+// the names of temp files with <temp>.
+func commandLines(runner *FakeRunner) []string {
+	lines := runner.CommandLines()
+	for i, line := range lines {
+		var args []string
+		for _, arg := range strings.Split(line, " ") {
+			if strings.HasPrefix(arg, os.TempDir()) {
+				arg = "<temp>"
+			}
+			args = append(args, arg)
+		}
+		lines[i] = strings.Join(args, " ")
+	}
+	return lines
+}
+
+func TestFakeRunner(t *testing.T) {
+	ctx := context.Background()
+	runner := NewFakeRunner().
+		On("tool", []string{"list"}, "all", nil).
+		On("tool", []string{"list", "one"}, "one", nil).
+		On("tool", []string{"fail"}, "oops", errors.New("failed")).
+		Missing("absent")
+
+	out, err := runner.Run(ctx, &Command{Name: "tool", Args: []string{"list", "one"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(out), "Latest matching script should win")
+	out, err = runner.Run(ctx, &Command{Name: "tool", Args: []string{"list", "two"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "all", string(out))
+	out, err = runner.Run(ctx, &Command{Name: "tool", Args: []string{"fail"}, Prompt: "Please"})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, "oops", string(out))
+	out, err = runner.Run(ctx, &Command{Name: "tool", Args: []string{"other"}})
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	_, err = runner.Run(ctx, &Command{Name: "absent"})
+	assert.True(t, errors.Is(err, exec.ErrNotFound))
+	_, err = runner.LookPath("absent")
+	assert.True(t, errors.Is(err, exec.ErrNotFound))
+	_, err = runner.LookPath("tool")
+	assert.NoError(t, err)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = runner.Run(canceled, &Command{Name: "tool"})
+	assert.True(t, IsCanceled(err))
+
+	assert.Equal(t, []string{"tool list one", "tool list two", "[elevated] tool fail", "tool other", "absent"}, runner.CommandLines())
+}
+
+func TestAuditRunner(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	runner := NewAuditRunner(NewFakeRunner().On("security", []string{"delete-certificate"}, "", errors.New("declined")), &buf)
+	_, err := runner.Run(ctx, &Command{Name: "security", Args: []string{"find-certificate", "-c", "Test Root"}})
+	assert.NoError(t, err)
+	_, err = runner.Run(ctx, &Command{Name: "security", Args: []string{"delete-certificate", "-c", "Test Root"}, Prompt: "Please"})
+	assert.EqualError(t, err, "declined")
+
+	var records []*AuditRecord
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		record := &AuditRecord{}
+		if !assert.NoError(t, decoder.Decode(record)) {
+			return
+		}
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "security", records[0].Command)
+		assert.Equal(t, []string{"find-certificate", "-c", "Test Root"}, records[0].Args)
+		assert.False(t, records[0].Elevated)
+		assert.Empty(t, records[0].Error)
+		assert.True(t, records[1].Elevated)
+		assert.Equal(t, "declined", records[1].Error)
+	}
+}
+
+func TestJavaTrustStoreRedactsPassword(t *testing.T) {
+	ctx := context.Background()
+	const password = "keystore-s3cret"
+	cert := testRoot(t, "Test Root")
+	fake := NewFakeRunner()
+	var audit bytes.Buffer
+	store := NewJavaTrustStore("/etc/keystore", password, "Please")
+	store.Runner = NewAuditRunner(fake, &audit)
+
+	_, err := store.List(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Add(ctx, cert))
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	if assert.Len(t, fake.Commands(), 5) {
+		for _, cmd := range fake.Commands() {
+			assert.NotContains(t, cmd.Args, password, "The password should not be on the command line")
+			assert.Equal(t, []string{"KEYMAN_STOREPASS=" + password}, cmd.Env, "keytool should be given the password")
+		}
+	}
+	assert.NotContains(t, audit.String(), password)
+	record := &AuditRecord{}
+	if assert.NoError(t, json.NewDecoder(&audit).Decode(record)) {
+		assert.Equal(t, []string{"-list", "-rfc", "-keystore", "/etc/keystore", "-storepass:env", "KEYMAN_STOREPASS"}, record.Args)
+	}
+	for _, line := range fake.CommandLines() {
+		assert.NotContains(t, line, password)
+	}
+
+	data, err := json.Marshal(PlanTrust(ctx, cert, []TrustStore{store}, nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, string(data), password)
+	plan := &TrustPlan{}
+	if assert.NoError(t, json.Unmarshal(data, plan)) && assert.Len(t, plan.Stores, 1) && assert.Len(t, plan.Stores[0].Actions, 1) {
+		assert.Contains(t, plan.Stores[0].Actions[0].Command.Args, "-storepass:env")
+	}
+}
+
+func TestExecRunnerPassesEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a POSIX shell")
+	}
+	ctx := context.Background()
+	out, err := ExecRunner{}.Run(ctx, &Command{Name: "sh", Args: []string{"-c", `printf %s "$KEYMAN_TEST"`}, Env: []string{"KEYMAN_TEST=s3cret value"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s3cret value", string(out))
+	}
+
+	// Elevated commands get their environment on stdin from pkexec
+	cmd := exec.Command("/bin/sh", "-c", envFromStdinScript, "sh", "-c", `printf %s "$KEYMAN_TEST"`)
+	cmd.Stdin = strings.NewReader("KEYMAN_TEST=s3cret value\n")
+	out, err = cmd.Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s3cret value", string(out))
+	}
+}
+
+func TestJavaTrustStoreRemove(t *testing.T) {
+	ctx := context.Background()
+	runner := NewFakeRunner()
+	store := NewJavaTrustStore("/etc/keystore", "", "")
+	store.Runner = runner
+	runner.On("keytool", []string{"-list", "-alias", "keyman-test_root"}, "", errors.New("exit status 1"))
+	assert.NoError(t, store.Remove(ctx, "Test Root"), "Missing alias should not be an error")
+	for _, cmd := range runner.Commands() {
+		assert.NotEqual(t, "-delete", cmd.Args[0], "Missing alias should not be deleted")
+	}
+
+	runner = NewFakeRunner()
+	store.Runner = runner
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	if assert.Len(t, runner.Commands(), 3) {
+		assert.Equal(t, []string{"-delete", "-alias", "keyman-test_root"}, runner.Commands()[2].Args[:3])
+	}
+
+	// A keystore that can't be read isn't mistaken for a missing alias
+	runner = NewFakeRunner().On("keytool", []string{"-list"}, "", errors.New("exit status 1"))
+	store.Runner = runner
+	assert.Error(t, store.Remove(ctx, "Test Root"))
+}
+
+func TestKeychainTrustStoreCommands(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	runner := NewFakeRunner()
+	store := NewKeychainTrustStore("/Library/Keychains/System.keychain", "Please")
+	store.Runner = runner
+
+	runner.On("security", []string{"find-certificate", "-a", "-p", "-c"}, string(cert.PEMEncoded()), nil)
+	installed, err := store.Contains(ctx, cert)
+	assert.NoError(t, err)
+	assert.True(t, installed)
+
+	assert.NoError(t, store.Add(ctx, cert))
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	assert.Equal(t, []string{
+		"security find-certificate -a -p -c Test Root /Library/Keychains/System.keychain",
+		"[elevated] security add-trusted-cert -d -k /Library/Keychains/System.keychain <temp>",
+		"security verify-cert -c <temp>",
+		"security find-certificate -c Test Root /Library/Keychains/System.keychain",
+		"[elevated] security delete-certificate -c Test Root /Library/Keychains/System.keychain",
+	}, commandLines(runner))
+}
+
+func TestWindowsTrustStoreCommands(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	runner := NewFakeRunner().On("certimporter.exe", []string{"find"}, "", errors.New("exit status 1"))
+	store := NewWindowsTrustStore("ROOT", "Please")
+	store.Importer = "certimporter.exe"
+	store.Runner = runner
+
+	if runtime.GOOS != "windows" {
+		_, err := store.Contains(ctx, cert)
+		assert.True(t, errors.Is(err, ErrNotSupported))
+	}
+	assert.NoError(t, store.Add(ctx, cert))
+	assert.NoError(t, store.Remove(ctx, "Test Root"), "Removing missing certificate should succeed")
+	runner.On("certimporter.exe", []string{"find"}, "", nil)
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	assert.Equal(t, []string{
+		"[elevated] certimporter.exe add ROOT <temp>",
+		"certimporter.exe find ROOT Test Root",
+		"certimporter.exe find ROOT Test Root",
+		"[elevated] certimporter.exe delete ROOT Test Root",
+	}, commandLines(runner))
+}
+
+func TestNSSTrustStoreCommands(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	runner := NewFakeRunner().On("certutil", []string{"-d", "dbm:/profile", "-L", "-n"}, string(cert.PEMEncoded()), nil)
+	store := NewNSSTrustStore("dbm:/profile")
+	store.Runner = runner
+
+	installed, err := store.Contains(ctx, cert)
+	assert.NoError(t, err)
+	assert.True(t, installed)
+	assert.NoError(t, store.Add(ctx, cert))
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	assert.Equal(t, []string{
+		"certutil -d dbm:/profile -L -n Test Root -a",
+		"certutil -d dbm:/profile -A -t C,, -n Test Root -i <temp>",
+		"certutil -d dbm:/profile -L -n Test Root",
+		"certutil -d dbm:/profile -D -n Test Root",
+	}, commandLines(runner))
+
+	runner = NewFakeRunner().Missing("certutil")
+	store.Runner = runner
+	assert.True(t, errors.Is(store.Add(ctx, cert), ErrTrustToolMissing))
+}
@@ -0,0 +1,205 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// maxScanFileSize bounds the files that ScanForExpiring will read, to
+	// avoid loading large unrelated files into memory.
+	maxScanFileSize = 1024 * 1024
+)
+
+// ExpiringCertificate describes a certificate found by ScanForExpiring.
+type ExpiringCertificate struct {
+	// Path is the file containing the certificate
+	Path string `json:"path"`
+	// Index is the position of the certificate within a bundle
+	Index       int       `json:"index"`
+	Subject     string    `json:"subject"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	NotAfter    time.Time `json:"notAfter"`
+	// KeyPath is the private key file whose public key matches the
+	// certificate, if one was found
+	KeyPath string `json:"keyPath,omitempty"`
+
+	Certificate *Certificate `json:"-"`
+}
+
+// ExpiryNotifier is told about expiring certificates.
+type ExpiryNotifier interface {
+	NotifyExpiring(certs []*ExpiringCertificate) error
+}
+
+// ExpiryNotifierFunc adapts a function to an ExpiryNotifier.
+type ExpiryNotifierFunc func(certs []*ExpiringCertificate) error
+
+func (f ExpiryNotifierFunc) NotifyExpiring(certs []*ExpiringCertificate) error {
+	return f(certs)
+}
+
+// WebhookNotifier is an ExpiryNotifier that POSTs expiring certificates to a
+// URL as a JSON array.
+type WebhookNotifier struct {
+	URL string
+	// Client is used to make the request, defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) NotifyExpiring(certs []*ExpiringCertificate) error {
+	body, err := json.Marshal(certs)
+	if err != nil {
+		return err
+	}
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to notify webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %v", resp.Status)
+	}
+	return nil
+}
+
+// ScanForExpiring walks the directory tree at dir and returns every
+// certificate that expires within the given duration from now (including
+// those that have already expired), sorted by expiry. Certificates are found
+// in PEM files, bundles and DER files. Private keys in the tree, including
+// every key in files that contain several, are matched to the certificates
+// issued for them; if several files contain the same key, the first one by
+// path is reported. Paths that can't be read are skipped.
+func ScanForExpiring(dir string, within time.Duration) ([]*ExpiringCertificate, error) {
+	return defaultGenerator.ScanForExpiring(dir, within)
+}
+
+// ScanForExpiring is like the package level ScanForExpiring, but measures
+// expiry from the Generator's Clock.
+func (g *Generator) ScanForExpiring(dir string, within time.Duration) ([]*ExpiringCertificate, error) {
+	deadline := g.Now().Add(within)
+	var certs []*ExpiringCertificate
+	keys := make(map[string][]*PrivateKey)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// Keep scanning the rest of the tree
+			log.Debugf("Unable to scan %s: %v", path, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() > maxScanFileSize {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Debugf("Unable to read %s: %v", path, err)
+			return nil
+		}
+		found, foundKeys := certsAndKeysIn(data)
+		if len(foundKeys) > 0 {
+			keys[path] = foundKeys
+		}
+		for i, cert := range found {
+			if !cert.ExpiresBefore(deadline) {
+				continue
+			}
+			x := cert.X509()
+			expiring := &ExpiringCertificate{
+				Path:        path,
+				Index:       i,
+				Subject:     x.Subject.String(),
+				DNSNames:    x.DNSNames,
+				NotAfter:    x.NotAfter,
+				Certificate: cert,
+			}
+			for _, ip := range x.IPAddresses {
+				expiring.IPAddresses = append(expiring.IPAddresses, ip.String())
+			}
+			certs = append(certs, expiring)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to scan %s: %w", dir, err)
+	}
+
+	// Match keys in a stable order, so that the same key found in several
+	// files is always reported at the same path
+	keyPaths := make([]string, 0, len(keys))
+	for path := range keys {
+		keyPaths = append(keyPaths, path)
+	}
+	sort.Strings(keyPaths)
+	for _, cert := range certs {
+		cert.KeyPath = keyPathFor(cert.Certificate, keyPaths, keys)
+	}
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter) })
+	return certs, nil
+}
+
+// ScanAndNotify is like ScanForExpiring, but also tells the given notifier
+// about expiring certificates, if any.
+func ScanAndNotify(dir string, within time.Duration, notifier ExpiryNotifier) ([]*ExpiringCertificate, error) {
+	certs, err := ScanForExpiring(dir, within)
+	if err != nil || len(certs) == 0 {
+		return certs, err
+	}
+	return certs, notifier.NotifyExpiring(certs)
+}
+
+// keyPathFor returns the first of keyPaths containing a key that matches cert,
+// if any.
+func keyPathFor(cert *Certificate, keyPaths []string, keys map[string][]*PrivateKey) string {
+	for _, path := range keyPaths {
+		for _, key := range keys[path] {
+			if cert.MatchesKey(key) {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// certsAndKeysIn finds the certificates and private keys contained in the
+// given file data, which may be PEM or DER encoded.
+func certsAndKeysIn(data []byte) (certs []*Certificate, keys []*PrivateKey) {
+	if !bytes.Contains(data, []byte("-----BEGIN ")) {
+		if cert, err := LoadCertificateFromDERBytes(data); err == nil {
+			certs = append(certs, cert)
+		}
+		return
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return
+		}
+		switch block.Type {
+		case PEM_HEADER_CERTIFICATE:
+			if cert, err := bytesToCert(block.Bytes); err == nil {
+				certs = append(certs, cert)
+			}
+		case PEM_HEADER_PRIVATE_KEY:
+			if pk, err := LoadPKFromPEMBytes(pem.EncodeToMemory(block)); err == nil {
+				keys = append(keys, pk)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package keyman
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanForExpiring(t *testing.T) {
+	dir := t.TempDir()
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	soon, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Soon", "soon.example.com", "127.0.0.1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	later, err := pk.TLSCertificateFor(time.Now().Add(10*ONE_WEEK), true, nil, "Test Org", "Later")
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherCert, err := other.TLSCertificateFor(time.Now().Add(-time.Hour), true, nil, "Test Org", "Expired")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "keys"), 0700))
+	assert.NoError(t, pk.WriteToFile(filepath.Join(dir, "keys", "pk.pem")))
+	assert.NoError(t, soon.WriteToDERFile(filepath.Join(dir, "soon.der")))
+	bundle := append(later.PEMEncoded(), otherCert.PEMEncoded()...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bundle.pem"), bundle, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a cert"), 0644))
+	// Copies of the key are matched in a stable order
+	assert.NoError(t, pk.WriteToFile(filepath.Join(dir, "keys", "pk.pem.bak")))
+	assert.NoError(t, pk.WriteToFile(filepath.Join(dir, "pk-copy.pem")))
+	// Every key in a file with several keys is matched
+	third, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "keys.pem"), append(other.PEMEncoded(), third.PEMEncoded()...), 0600))
+
+	certs, err := ScanForExpiring(dir, TWO_WEEKS)
+	if !assert.NoError(t, err) || !assert.Len(t, certs, 2) {
+		return
+	}
+	assert.Equal(t, "CN=Expired,O=Test Org", certs[0].Subject)
+	assert.Equal(t, filepath.Join(dir, "bundle.pem"), certs[0].Path)
+	assert.Equal(t, 1, certs[0].Index)
+	assert.Equal(t, filepath.Join(dir, "keys.pem"), certs[0].KeyPath, "Key shouldn't be hidden by a later key in the same file")
+
+	assert.Equal(t, filepath.Join(dir, "soon.der"), certs[1].Path)
+	assert.Equal(t, []string{"soon.example.com", "Soon"}, certs[1].DNSNames)
+	assert.Equal(t, []string{"127.0.0.1"}, certs[1].IPAddresses)
+	assert.Equal(t, filepath.Join(dir, "keys", "pk.pem"), certs[1].KeyPath)
+
+	_, err = ScanForExpiring(filepath.Join(dir, "missing"), TWO_WEEKS)
+	assert.Error(t, err, "Scanning a missing directory should fail")
+}
+
+func TestScanSkipsUnreadableDirectories(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Root can read directories regardless of their mode")
+	}
+	dir := t.TempDir()
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Soon")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cert.WriteToFile(filepath.Join(dir, "cert.pem")))
+	locked := filepath.Join(dir, "locked")
+	assert.NoError(t, os.Mkdir(locked, 0700))
+	assert.NoError(t, cert.WriteToFile(filepath.Join(locked, "cert.pem")))
+	assert.NoError(t, os.Chmod(locked, 0000))
+	defer os.Chmod(locked, 0700)
+	if _, err := ioutil.ReadDir(locked); err == nil {
+		t.Skip("Mode 0000 doesn't prevent reading directories here")
+	}
+
+	certs, err := ScanForExpiring(dir, TWO_WEEKS)
+	if assert.NoError(t, err, "Unreadable directories shouldn't stop the scan") && assert.Len(t, certs, 1) {
+		assert.Equal(t, filepath.Join(dir, "cert.pem"), certs[0].Path)
+	}
+}
+
+func TestScanAndNotifyWebhook(t *testing.T) {
+	dir := t.TempDir()
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Soon")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cert.WriteToFile(filepath.Join(dir, "cert.pem")))
+
+	var received []*ExpiringCertificate
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{URL: server.URL, Client: server.Client()}
+	certs, err := ScanAndNotify(dir, TWO_WEEKS, notifier)
+	if assert.NoError(t, err) && assert.Len(t, received, 1) {
+		assert.Len(t, certs, 1)
+		assert.Equal(t, "CN=Soon,O=Test Org", received[0].Subject)
+	}
+
+	_, err = ScanAndNotify(dir, TWO_WEEKS, &WebhookNotifier{URL: server.URL + "/missing", Client: &http.Client{Transport: failingTransport{}}})
+	assert.Error(t, err, "Webhook failure should be reported")
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error", Body: http.NoBody, Request: req}, nil
+}
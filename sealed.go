@@ -0,0 +1,621 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFScrypt derives the master key from a passphrase using scrypt
+	KDFScrypt = "scrypt"
+	// KDFArgon2id derives the master key from a passphrase using Argon2id
+	KDFArgon2id = "argon2id"
+	// KDFKeyFile reads the master key from a key file
+	KDFKeyFile = "keyfile"
+
+	// KeystoreMetaName is the name of the entry in which a SealedStore keeps
+	// the information needed to recover its master key.
+	KeystoreMetaName = ".keyman-keystore"
+
+	// keystorePendingName is the entry in which an unfinished reseal is
+	// recorded, until all entries have been resealed.
+	keystorePendingName = KeystoreMetaName + ".pending"
+
+	sealMagic     = "KMSEAL"
+	sealVersion1  = 1
+	sealHeaderLen = len(sealMagic) + 1
+
+	masterKeySize = 32
+	saltSize      = 16
+
+	// sealCheckName is used as the associated data for the sealed check value
+	// in the keystore metadata, which detects wrong passphrases. The rest of
+	// the metadata is appended to it, so that it can't be tampered with.
+	sealCheckName = "\x00keyman-check"
+
+	// The key derivation parameters are read from the keystore metadata before
+	// they can be authenticated, so they're capped to keep a tampered keystore
+	// from using unbounded memory or time.
+	maxKDFMemory     = 1 << 30
+	maxScryptN       = 1 << 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	maxArgon2Time    = 16
+	maxArgon2Memory  = maxKDFMemory >> 10
+	maxArgon2Threads = 64
+)
+
+var (
+	// DefaultKDFParams are used for new passphrase protected keystores.
+	DefaultKDFParams = KDFParams{
+		Algorithm: KDFScrypt,
+		ScryptN:   1 << 15,
+		ScryptR:   8,
+		ScryptP:   1,
+	}
+
+	// ErrWrongPassphrase is returned when a keystore can't be opened with the
+	// given passphrase or key file.
+	ErrWrongPassphrase = errors.New("Wrong passphrase or key file")
+)
+
+// KDFParams controls how a master key is derived from a passphrase. Keystores
+// whose parameters would use more than 1 GiB of memory can't be opened.
+type KDFParams struct {
+	// Algorithm is KDFScrypt or KDFArgon2id
+	Algorithm string `json:"algorithm"`
+
+	ScryptN int `json:"scryptN,omitempty"`
+	ScryptR int `json:"scryptR,omitempty"`
+	ScryptP int `json:"scryptP,omitempty"`
+
+	// Argon2Memory is in KiB
+	Argon2Time    uint32 `json:"argon2Time,omitempty"`
+	Argon2Memory  uint32 `json:"argon2Memory,omitempty"`
+	Argon2Threads uint8  `json:"argon2Threads,omitempty"`
+}
+
+// keystoreMeta is stored in the clear under KeystoreMetaName, and
+// authenticated by the master key through Check.
+type keystoreMeta struct {
+	Version int       `json:"version"`
+	KDF     KDFParams `json:"kdf"`
+	Salt    []byte    `json:"salt,omitempty"`
+	Check   []byte    `json:"check"`
+}
+
+// pendingReseal records a reseal that's in progress, so that it can be
+// completed if it's interrupted. The old and new master keys are each sealed
+// with the other one, so that the keystore can be opened with either the old
+// or the new passphrase until it's completed.
+type pendingReseal struct {
+	// Meta is the new metadata
+	Meta *keystoreMeta `json:"meta"`
+	// NewKey is the new master key, sealed with the old one
+	NewKey []byte `json:"newKey"`
+	// OldKey is the old master key, sealed with the new one
+	OldKey []byte `json:"oldKey"`
+}
+
+// SealedStore is a Store that encrypts every entry with a master key before
+// handing it to an underlying Store, so that private keys are never written in
+// the clear. Entries are sealed with AES-256-GCM behind a versioned header,
+// with the entry name as associated data so that sealed entries can't be
+// swapped for one another.
+type SealedStore struct {
+	backing Store
+	key     []byte
+	aead    cipher.AEAD
+	meta    *keystoreMeta
+}
+
+// OpenSealedStore opens the keystore kept in the given backing Store using
+// the given passphrase. If the backing Store doesn't contain a keystore yet,
+// a new one is initialized using params (DefaultKDFParams if nil).
+func OpenSealedStore(backing Store, passphrase []byte, params *KDFParams) (*SealedStore, error) {
+	unlock, err := lockStore(backing, KeystoreMetaName, DefaultLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := loadKeystoreMeta(backing)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		if params == nil {
+			params = &DefaultKDFParams
+		}
+		meta, key, err := newPassphraseMeta(rand.Reader, passphrase, *params)
+		if err != nil {
+			return nil, err
+		}
+		return initSealedStore(backing, meta, key)
+	}
+	return openSealedStore(backing, meta, func(meta *keystoreMeta) ([]byte, error) {
+		if meta.KDF.Algorithm == KDFKeyFile {
+			return nil, &Error{Op: "open keystore", Kind: ErrWrongPassphrase, Err: errors.New("keystore is protected by a key file, not a passphrase")}
+		}
+		return deriveMasterKey(passphrase, meta.Salt, meta.KDF)
+	})
+}
+
+// OpenSealedStoreWithKeyFile is like OpenSealedStore, but reads the master
+// key from the given key file (see GenerateKeyFile).
+func OpenSealedStoreWithKeyFile(backing Store, keyfile string) (*SealedStore, error) {
+	key, err := readKeyFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockStore(backing, KeystoreMetaName, DefaultLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta, err := loadKeystoreMeta(backing)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return initSealedStore(backing, &keystoreMeta{Version: sealVersion1, KDF: KDFParams{Algorithm: KDFKeyFile}}, key)
+	}
+	return openSealedStore(backing, meta, func(meta *keystoreMeta) ([]byte, error) {
+		if meta.KDF.Algorithm != KDFKeyFile {
+			return nil, &Error{Op: "open keystore", Kind: ErrWrongPassphrase, Err: errors.New("keystore is protected by a passphrase, not a key file")}
+		}
+		return key, nil
+	})
+}
+
+// GenerateKeyFile writes a new random master key to the given file.
+func GenerateKeyFile(keyfile string) error {
+	key := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return fmt.Errorf("Unable to generate master key: %w", err)
+	}
+	return writeFileAtomic(keyfile, key, 0600)
+}
+
+// ChangePassphrase re-seals every entry under a master key derived from the
+// new passphrase using params (DefaultKDFParams if nil).
+func (s *SealedStore) ChangePassphrase(newPassphrase []byte, params *KDFParams) error {
+	if params == nil {
+		params = &DefaultKDFParams
+	}
+	meta, key, err := newPassphraseMeta(rand.Reader, newPassphrase, *params)
+	if err != nil {
+		return err
+	}
+	return s.reseal(meta, key)
+}
+
+// ChangeKeyFile re-seals every entry under the master key in the given key
+// file.
+func (s *SealedStore) ChangeKeyFile(keyfile string) error {
+	key, err := readKeyFile(keyfile)
+	if err != nil {
+		return err
+	}
+	return s.reseal(&keystoreMeta{Version: sealVersion1, KDF: KDFParams{Algorithm: KDFKeyFile}}, key)
+}
+
+func (s *SealedStore) Get(name string) ([]byte, error) {
+	sealed, err := s.backing.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(s.aead, name, sealed)
+}
+
+func (s *SealedStore) Put(name string, data []byte) error {
+	return s.PutAll(map[string][]byte{name: data})
+}
+
+// PutAll seals and stores the given entries while holding the lock on the
+// keystore metadata, so that they can't be sealed with a stale master key
+// while the keystore is being resealed.
+func (s *SealedStore) PutAll(entries map[string][]byte) error {
+	return s.putInOrder(nil, entries)
+}
+
+func (s *SealedStore) putInOrder(names []string, entries map[string][]byte) error {
+	unlock, err := lockStore(s.backing, KeystoreMetaName, DefaultLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.checkCurrentLocked(); err != nil {
+		return err
+	}
+
+	sealed := make(map[string][]byte, len(entries))
+	for name, data := range entries {
+		if name == KeystoreMetaName || name == keystorePendingName {
+			return fmt.Errorf("%s is reserved for keystore metadata", name)
+		}
+		var err error
+		if sealed[name], err = seal(s.aead, name, data); err != nil {
+			return err
+		}
+	}
+	if names == nil {
+		return s.backing.PutAll(sealed)
+	}
+	return putInOrder(s.backing, names, sealed)
+}
+
+// completeStaged finishes an interrupted write of the named entry through the
+// backing Store, if it can finish interrupted writes, unsealing the staged
+// data before passing it to accept.
+func (s *SealedStore) completeStaged(name string, accept func(data []byte) bool) (bool, error) {
+	staged, ok := s.backing.(stagedStore)
+	if !ok {
+		return false, nil
+	}
+	return staged.completeStaged(name, func(data []byte) bool {
+		plain, err := unseal(s.aead, name, data)
+		return err == nil && accept(plain)
+	})
+}
+
+func (s *SealedStore) Delete(name string) error {
+	return s.backing.Delete(name)
+}
+
+func (s *SealedStore) List() ([]string, error) {
+	names, err := s.backing.List()
+	if err != nil {
+		return nil, err
+	}
+	result := names[:0]
+	for _, name := range names {
+		if name != KeystoreMetaName && name != keystorePendingName {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// Lock implements Locker by locking the backing Store, if it supports
+// locking.
+func (s *SealedStore) Lock(name string, timeout time.Duration) (func(), error) {
+	return lockStore(s.backing, name, timeout)
+}
+
+func (s *SealedStore) reseal(meta *keystoreMeta, key []byte) error {
+	unlock, err := lockStore(s.backing, KeystoreMetaName, DefaultLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.checkCurrentLocked(); err != nil {
+		return err
+	}
+	return s.resealLocked(meta, key, true)
+}
+
+// checkCurrentLocked checks that the keystore hasn't been resealed by someone
+// else since it was opened, which would make our master key stale. The caller
+// must hold the lock on the metadata.
+func (s *SealedStore) checkCurrentLocked() error {
+	meta, err := loadKeystoreMeta(s.backing)
+	if err != nil {
+		return err
+	}
+	if meta == nil || !bytes.Equal(meta.Check, s.meta.Check) {
+		return fmt.Errorf("Keystore was resealed since it was opened and needs to be reopened")
+	}
+	return nil
+}
+
+// resealLocked writes the given metadata and, if includeEntries is set,
+// re-seals all existing entries under the given key. The resealed entries are
+// written before the metadata, and the reseal is recorded as pending until
+// then, so that an interrupted reseal can be completed when the keystore is
+// opened again. The caller must hold the lock on the metadata.
+func (s *SealedStore) resealLocked(meta *keystoreMeta, key []byte, includeEntries bool) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if meta.Check, err = seal(aead, checkName(meta), nil); err != nil {
+		return err
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if includeEntries {
+		pending := &pendingReseal{Meta: meta}
+		if pending.NewKey, err = seal(s.aead, keystorePendingName, key); err != nil {
+			return err
+		}
+		if pending.OldKey, err = seal(aead, keystorePendingName, s.key); err != nil {
+			return err
+		}
+		pendingBytes, err := json.Marshal(pending)
+		if err != nil {
+			return err
+		}
+		if err := s.backing.Put(keystorePendingName, pendingBytes); err != nil {
+			return fmt.Errorf("Unable to save pending reseal: %w", err)
+		}
+
+		names, err := s.List()
+		if err != nil {
+			return err
+		}
+		entries := make(map[string][]byte, len(names))
+		for _, name := range names {
+			sealed, err := s.backing.Get(name)
+			if err != nil {
+				return fmt.Errorf("Unable to read %s for resealing: %w", name, err)
+			}
+			data, err := unseal(s.aead, name, sealed)
+			if err != nil {
+				// Entries may have been resealed by an interrupted reseal
+				// already
+				if data, err = unseal(aead, name, sealed); err != nil {
+					return fmt.Errorf("Unable to open %s for resealing: %w", name, err)
+				}
+			}
+			if entries[name], err = seal(aead, name, data); err != nil {
+				return err
+			}
+		}
+		if err := s.backing.PutAll(entries); err != nil {
+			return fmt.Errorf("Unable to save resealed keystore: %w", err)
+		}
+	}
+
+	if err := s.backing.Put(KeystoreMetaName, metaBytes); err != nil {
+		return fmt.Errorf("Unable to save keystore metadata: %w", err)
+	}
+	if includeEntries {
+		if err := s.backing.Delete(keystorePendingName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove pending reseal: %w", err)
+		}
+	}
+	s.key, s.aead, s.meta = key, aead, meta
+	return nil
+}
+
+func initSealedStore(backing Store, meta *keystoreMeta, key []byte) (*SealedStore, error) {
+	s := &SealedStore{backing: backing}
+	if err := s.resealLocked(meta, key, false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSealedStore opens the keystore with the given metadata, using keyFor to
+// find the master key for metadata. If a reseal was interrupted, the keystore
+// can be opened with either the old or the new master key, and the reseal is
+// completed. The caller must hold the lock on the metadata.
+func openSealedStore(backing Store, meta *keystoreMeta, keyFor func(meta *keystoreMeta) ([]byte, error)) (*SealedStore, error) {
+	s, err := sealedStoreFor(backing, meta, keyFor)
+	pending, pendingErr := loadPendingReseal(backing)
+	if pendingErr != nil {
+		return nil, pendingErr
+	}
+	if pending == nil {
+		return s, err
+	}
+	if bytes.Equal(pending.Meta.Check, meta.Check) {
+		// The reseal was interrupted after saving the new metadata
+		if err == nil {
+			if err := backing.Delete(keystorePendingName); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("Unable to remove pending reseal: %w", err)
+			}
+		}
+		return s, err
+	}
+
+	var newKey []byte
+	if err == nil {
+		if newKey, err = unseal(s.aead, keystorePendingName, pending.NewKey); err != nil {
+			return nil, fmt.Errorf("Unable to recover master key of pending reseal: %w", err)
+		}
+	} else {
+		// Try the new master key
+		resealed, newErr := sealedStoreFor(backing, pending.Meta, keyFor)
+		if newErr != nil {
+			return nil, err
+		}
+		oldKey, oldErr := unseal(resealed.aead, keystorePendingName, pending.OldKey)
+		if oldErr != nil {
+			return nil, fmt.Errorf("Unable to recover master key of pending reseal: %w", oldErr)
+		}
+		if s, err = sealedStoreFor(backing, meta, func(*keystoreMeta) ([]byte, error) { return oldKey, nil }); err != nil {
+			return nil, err
+		}
+		newKey = resealed.key
+	}
+	log.Debugf("Completing interrupted reseal of keystore")
+	if err := s.resealLocked(pending.Meta, newKey, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sealedStoreFor constructs a SealedStore for the given metadata, checking
+// that the master key found by keyFor is the right one.
+func sealedStoreFor(backing Store, meta *keystoreMeta, keyFor func(meta *keystoreMeta) ([]byte, error)) (*SealedStore, error) {
+	key, err := keyFor(meta)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unseal(aead, checkName(meta), meta.Check); err != nil {
+		return nil, &Error{Op: "open keystore", Kind: ErrWrongPassphrase}
+	}
+	return &SealedStore{backing: backing, key: key, aead: aead, meta: meta}, nil
+}
+
+func loadPendingReseal(backing Store) (*pendingReseal, error) {
+	pendingBytes, err := backing.Get(keystorePendingName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read pending reseal: %w", err)
+	}
+	pending := &pendingReseal{}
+	if err := json.Unmarshal(pendingBytes, pending); err != nil {
+		return nil, fmt.Errorf("Unable to decode pending reseal: %w", err)
+	}
+	if pending.Meta == nil {
+		return nil, fmt.Errorf("Pending reseal is missing keystore metadata")
+	}
+	return pending, nil
+}
+
+func loadKeystoreMeta(backing Store) (*keystoreMeta, error) {
+	metaBytes, err := backing.Get(KeystoreMetaName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read keystore metadata: %w", err)
+	}
+	meta := &keystoreMeta{}
+	if err := json.Unmarshal(metaBytes, meta); err != nil {
+		return nil, fmt.Errorf("Unable to decode keystore metadata: %w", err)
+	}
+	if meta.Version != sealVersion1 {
+		return nil, fmt.Errorf("Unsupported keystore version %d", meta.Version)
+	}
+	return meta, nil
+}
+
+// checkName returns the name under which the check value of the given
+// metadata is sealed, which binds the version, key derivation parameters and
+// salt to the master key.
+func checkName(meta *keystoreMeta) string {
+	header, _ := json.Marshal(&keystoreMeta{Version: meta.Version, KDF: meta.KDF, Salt: meta.Salt})
+	return sealCheckName + string(header)
+}
+
+func newPassphraseMeta(random io.Reader, passphrase []byte, params KDFParams) (*keystoreMeta, []byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, nil, fmt.Errorf("Unable to generate salt: %w", err)
+	}
+	key, err := deriveMasterKey(passphrase, salt, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &keystoreMeta{Version: sealVersion1, KDF: params, Salt: salt}, key, nil
+}
+
+func deriveMasterKey(passphrase []byte, salt []byte, params KDFParams) ([]byte, error) {
+	if err := checkKDFParams(params); err != nil {
+		return nil, err
+	}
+	switch params.Algorithm {
+	case KDFScrypt:
+		key, err := scrypt.Key(passphrase, salt, params.ScryptN, params.ScryptR, params.ScryptP, masterKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to derive master key: %w", err)
+		}
+		return key, nil
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, masterKeySize), nil
+	}
+	return nil, fmt.Errorf("Unsupported key derivation function %q", params.Algorithm)
+}
+
+// checkKDFParams checks that params are within the limits on memory and time
+// that we're willing to spend on deriving a master key.
+func checkKDFParams(params KDFParams) error {
+	switch params.Algorithm {
+	case KDFScrypt:
+		if params.ScryptN <= 1 || params.ScryptN > maxScryptN ||
+			params.ScryptR <= 0 || params.ScryptR > maxScryptR ||
+			params.ScryptP <= 0 || params.ScryptP > maxScryptP ||
+			128*params.ScryptN*params.ScryptR > maxKDFMemory {
+			return fmt.Errorf("Invalid or excessive scrypt parameters N=%d r=%d p=%d", params.ScryptN, params.ScryptR, params.ScryptP)
+		}
+	case KDFArgon2id:
+		if params.Argon2Time == 0 || params.Argon2Time > maxArgon2Time ||
+			params.Argon2Memory == 0 || params.Argon2Memory > maxArgon2Memory ||
+			params.Argon2Threads == 0 || params.Argon2Threads > maxArgon2Threads {
+			return fmt.Errorf("Invalid or excessive Argon2id parameters time=%d memory=%d threads=%d", params.Argon2Time, params.Argon2Memory, params.Argon2Threads)
+		}
+	}
+	return nil
+}
+
+func readKeyFile(keyfile string) ([]byte, error) {
+	key, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read key file %s: %w", keyfile, err)
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("Key file %s should contain %d bytes, not %d", keyfile, masterKeySize, len(key))
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data as: magic | version | nonce | ciphertext, using the
+// header and name as associated data.
+func seal(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	return sealFrom(rand.Reader, aead, name, data)
+}
+
+// sealFrom is like seal, but draws the nonce from the given entropy source.
+func sealFrom(random io.Reader, aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	out := make([]byte, sealHeaderLen+aead.NonceSize(), sealHeaderLen+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, sealMagic)
+	out[len(sealMagic)] = sealVersion1
+	nonce := out[sealHeaderLen:]
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %w", err)
+	}
+	return aead.Seal(out, nonce, data, sealAD(out[:sealHeaderLen], name)), nil
+}
+
+func unseal(aead cipher.AEAD, name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealHeaderLen+aead.NonceSize() || !bytes.HasPrefix(sealed, []byte(sealMagic)) {
+		return nil, fmt.Errorf("%s is not a sealed keystore entry", name)
+	}
+	if version := sealed[len(sealMagic)]; version != sealVersion1 {
+		return nil, fmt.Errorf("%s is sealed with unsupported version %d", name, version)
+	}
+	nonce := sealed[sealHeaderLen : sealHeaderLen+aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, sealed[sealHeaderLen+aead.NonceSize():], sealAD(sealed[:sealHeaderLen], name))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open sealed entry %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func sealAD(header []byte, name string) []byte {
+	return append(append([]byte(nil), header...), name...)
+}
@@ -0,0 +1,203 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	// cheap parameters to keep tests fast
+	testKDFParams = &KDFParams{Algorithm: KDFScrypt, ScryptN: 1 << 10, ScryptR: 8, ScryptP: 1}
+)
+
+func TestSealedStore(t *testing.T) {
+	backing := NewMemStore()
+	store, err := OpenSealedStore(backing, []byte("secret"), testKDFParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	pk, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	raw, err := backing.Get("pk.pem")
+	if assert.NoError(t, err) {
+		assert.False(t, bytes.Contains(raw, []byte("PRIVATE KEY")), "Private key should not be stored in the clear")
+		assert.True(t, bytes.HasPrefix(raw, []byte(sealMagic)), "Sealed entry should have header")
+	}
+	names, _ := store.List()
+	assert.Equal(t, []string{"cert.pem", "pk.pem"}, names, "Metadata should not be listed")
+
+	_, err = OpenSealedStore(backing, []byte("wrong"), nil)
+	assert.True(t, errors.Is(err, ErrWrongPassphrase), "Wrong passphrase should be detected")
+
+	// Swapping sealed entries must be detected
+	certRaw, _ := backing.Get("cert.pem")
+	assert.NoError(t, backing.PutAll(map[string][]byte{"pk.pem": certRaw, "cert.pem": raw}))
+	_, err = store.Get("pk.pem")
+	assert.Error(t, err, "Swapped entry should not open")
+	assert.NoError(t, backing.PutAll(map[string][]byte{"pk.pem": raw, "cert.pem": certRaw}))
+
+	argon := &KDFParams{Algorithm: KDFArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	if !assert.NoError(t, store.ChangePassphrase([]byte("new secret"), argon)) {
+		return
+	}
+	_, err = OpenSealedStore(backing, []byte("secret"), nil)
+	assert.True(t, errors.Is(err, ErrWrongPassphrase), "Old passphrase should no longer work")
+
+	reopened, err := OpenSealedStore(backing, []byte("new secret"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pk2, cert2, err := StoredPKAndCertIn(reopened, "pk.pem", "cert.pem", &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded(), "Key should survive passphrase change")
+		assert.Equal(t, cert.PEMEncoded(), cert2.PEMEncoded(), "Cert should survive passphrase change")
+	}
+
+	keyfile := filepath.Join(t.TempDir(), "master.key")
+	if !assert.NoError(t, GenerateKeyFile(keyfile)) {
+		return
+	}
+	if !assert.NoError(t, reopened.ChangeKeyFile(keyfile)) {
+		return
+	}
+	_, err = OpenSealedStore(backing, []byte("new secret"), nil)
+	assert.True(t, errors.Is(err, ErrWrongPassphrase), "Passphrase should no longer work")
+	withKeyFile, err := OpenSealedStoreWithKeyFile(backing, keyfile)
+	if assert.NoError(t, err) {
+		pk3, err := LoadPKFromStore(withKeyFile, "pk.pem")
+		if assert.NoError(t, err) {
+			assert.Equal(t, pk.PEMEncoded(), pk3.PEMEncoded())
+		}
+	}
+
+	otherKeyfile := filepath.Join(t.TempDir(), "other.key")
+	assert.NoError(t, GenerateKeyFile(otherKeyfile))
+	_, err = OpenSealedStoreWithKeyFile(backing, otherKeyfile)
+	assert.True(t, errors.Is(err, ErrWrongPassphrase), "Wrong key file should be detected")
+}
+
+func TestSealedStoreTamperedMetadata(t *testing.T) {
+	backing := NewMemStore()
+	_, err := OpenSealedStore(backing, []byte("secret"), testKDFParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	original, _ := backing.Get(KeystoreMetaName)
+	tamper := func(update func(meta *keystoreMeta)) {
+		meta := &keystoreMeta{}
+		if !assert.NoError(t, json.Unmarshal(original, meta)) {
+			return
+		}
+		update(meta)
+		metaBytes, _ := json.Marshal(meta)
+		assert.NoError(t, backing.Put(KeystoreMetaName, metaBytes))
+	}
+
+	tamper(func(meta *keystoreMeta) { meta.KDF.ScryptN = 1 << 30 })
+	_, err = OpenSealedStore(backing, []byte("secret"), nil)
+	assert.Error(t, err, "Excessive scrypt parameters should be refused")
+	assert.False(t, errors.Is(err, ErrWrongPassphrase), "Excessive parameters should be refused before deriving a key")
+
+	tamper(func(meta *keystoreMeta) {
+		meta.KDF = KDFParams{Algorithm: KDFArgon2id, Argon2Time: 1, Argon2Memory: 1 << 24, Argon2Threads: 1}
+	})
+	_, err = OpenSealedStore(backing, []byte("secret"), nil)
+	assert.Error(t, err, "Excessive Argon2id parameters should be refused")
+
+	// Parameters that don't change the derived key are still bound to it
+	tamper(func(meta *keystoreMeta) { meta.KDF.Argon2Time = 1 })
+	_, err = OpenSealedStore(backing, []byte("secret"), nil)
+	assert.True(t, errors.Is(err, ErrWrongPassphrase), "Tampered metadata should not open")
+
+	assert.NoError(t, backing.Put(KeystoreMetaName, original))
+	_, err = OpenSealedStore(backing, []byte("secret"), nil)
+	assert.NoError(t, err)
+}
+
+// failingStore is a MemStore that fails to put the named entry.
+type failingStore struct {
+	*MemStore
+	failPut string
+}
+
+func (s *failingStore) Put(name string, data []byte) error {
+	if name == s.failPut {
+		return errors.New("Injected failure")
+	}
+	return s.MemStore.Put(name, data)
+}
+
+func TestSealedStoreInterruptedReseal(t *testing.T) {
+	for _, passphrase := range []string{"old secret", "new secret"} {
+		backing := &failingStore{MemStore: NewMemStore()}
+		store, err := OpenSealedStore(backing, []byte("old secret"), testKDFParams)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pk, _, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName"})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// Fail after resealing the entries but before saving the new metadata
+		backing.failPut = KeystoreMetaName
+		assert.Error(t, store.ChangePassphrase([]byte("new secret"), testKDFParams))
+		backing.failPut = ""
+
+		reopened, err := OpenSealedStore(backing, []byte(passphrase), nil)
+		if !assert.NoError(t, err, "Interrupted reseal should open with %v", passphrase) {
+			continue
+		}
+		pk2, err := LoadPKFromStore(reopened, "pk.pem")
+		if assert.NoError(t, err) {
+			assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded(), "Key should survive interrupted reseal")
+		}
+		_, err = backing.Get(keystorePendingName)
+		assert.True(t, os.IsNotExist(err), "Reseal should be completed on open")
+		_, err = OpenSealedStore(backing, []byte("old secret"), nil)
+		assert.True(t, errors.Is(err, ErrWrongPassphrase), "Old passphrase should no longer work once completed")
+		_, err = OpenSealedStore(backing, []byte("new secret"), nil)
+		assert.NoError(t, err)
+
+		// Writing with the stale master key must fail
+		assert.Error(t, store.Put("other.pem", []byte("data")), "Put with stale master key should fail")
+	}
+}
+
+func TestSealedStoreCompletesInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSealedStore(NewDirStore(dir), []byte("secret"), testKDFParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	opts := &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName"}
+	if _, _, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts); !assert.NoError(t, err) {
+		return
+	}
+	pk, cert, err := StoredPKAndCertIn(NewMemStore(), "pk.pem", "cert.pem", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Simulate a crash after replacing the key but before replacing the cert
+	sealedPK, _ := seal(store.aead, "pk.pem", pk.PEMEncoded())
+	sealedCert, _ := seal(store.aead, "cert.pem", cert.PEMEncoded())
+	assert.NoError(t, writeFileAtomic(filepath.Join(dir, "pk.pem"), sealedPK, 0600))
+	staged := atomicFile{name: filepath.Join(dir, "cert.pem"), data: sealedCert, perm: 0600}
+	assert.NoError(t, staged.stage())
+
+	pk2, cert2, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded())
+		assert.Equal(t, cert.DER(), cert2.DER(), "Staged cert should complete the pair")
+	}
+}
@@ -0,0 +1,365 @@
+package keyman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+const (
+	sqliteHeader     = "SQLite format 3\x00"
+	sqliteHeaderSize = 100
+
+	sqliteInteriorTablePage = 0x05
+	sqliteLeafTablePage     = 0x0d
+)
+
+var (
+	errSQLiteCorrupt = errors.New("Corrupt SQLite database")
+)
+
+// sqliteDB is a minimal read-only reader for SQLite 3 database files, just
+// enough to scan the tables of NSS databases without cgo or external
+// binaries. Only the main database file is read, so changes that haven't been
+// checkpointed from a write-ahead log yet aren't seen.
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	// usable is the page size without the space reserved at the end of each
+	// page
+	usable int
+}
+
+// openSQLite reads the SQLite database in the given file.
+func openSQLite(filename string) (*sqliteDB, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseSQLite(data)
+}
+
+func parseSQLite(data []byte) (*sqliteDB, error) {
+	if len(data) < sqliteHeaderSize || string(data[:len(sqliteHeader)]) != sqliteHeader {
+		return nil, fmt.Errorf("Not an SQLite database: %w", errSQLiteCorrupt)
+	}
+	pageSize := int(binary.BigEndian.Uint16(data[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("Invalid page size %d: %w", pageSize, errSQLiteCorrupt)
+	}
+	usable := pageSize - int(data[20])
+	if usable < 480 {
+		return nil, fmt.Errorf("Invalid reserved space: %w", errSQLiteCorrupt)
+	}
+	// 0 means that the database is empty, 1 is UTF-8
+	if encoding := binary.BigEndian.Uint32(data[56:]); encoding > 1 {
+		return nil, fmt.Errorf("Unsupported text encoding %d", encoding)
+	}
+	return &sqliteDB{data: data, pageSize: pageSize, usable: usable}, nil
+}
+
+// rows calls fn with each row of the named table, keyed by column name, in
+// rowid order.
+func (db *sqliteDB) rows(table string, fn func(row map[string]interface{}) error) error {
+	root, columns, rowidColumn, err := db.table(table)
+	if err != nil {
+		return err
+	}
+	return db.scanTable(root, func(rowid int64, values []interface{}) error {
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if i < len(values) {
+				row[column] = values[i]
+			} else {
+				// Columns added after the row was written are NULL
+				row[column] = nil
+			}
+		}
+		if rowidColumn >= 0 {
+			row[columns[rowidColumn]] = rowid
+		}
+		return fn(row)
+	})
+}
+
+// table looks up the root page and column names of the named table in the
+// schema. rowidColumn is the index of the INTEGER PRIMARY KEY column, which
+// is stored as the rowid, or -1.
+func (db *sqliteDB) table(name string) (root uint32, columns []string, rowidColumn int, err error) {
+	found := false
+	err = db.scanTable(1, func(rowid int64, values []interface{}) error {
+		if found || len(values) < 5 {
+			return nil
+		}
+		typ, _ := values[0].(string)
+		tableName, _ := values[1].(string)
+		if typ != "table" || !strings.EqualFold(tableName, name) {
+			return nil
+		}
+		page, _ := values[3].(int64)
+		sql, _ := values[4].(string)
+		if page <= 0 || page > math.MaxUint32 {
+			return fmt.Errorf("Invalid root page for table %s: %w", name, errSQLiteCorrupt)
+		}
+		found = true
+		root = uint32(page)
+		columns, rowidColumn = sqliteColumns(sql)
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("No table %s in SQLite database", name)
+	}
+	return
+}
+
+// scanTable calls fn with the rowid and values of each row in the table
+// b-tree with the given root page.
+func (db *sqliteDB) scanTable(root uint32, fn func(rowid int64, values []interface{}) error) error {
+	return db.scanPage(root, make(map[uint32]bool), fn)
+}
+
+func (db *sqliteDB) scanPage(n uint32, visited map[uint32]bool, fn func(rowid int64, values []interface{}) error) error {
+	if visited[n] {
+		return fmt.Errorf("Page %d referenced twice: %w", n, errSQLiteCorrupt)
+	}
+	visited[n] = true
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	header := 0
+	if n == 1 {
+		header = sqliteHeaderSize
+	}
+	typ := page[header]
+	cellPointers := header + 8
+	if typ == sqliteInteriorTablePage {
+		cellPointers = header + 12
+	} else if typ != sqliteLeafTablePage {
+		return fmt.Errorf("Page %d is not a table page: %w", n, errSQLiteCorrupt)
+	}
+	numCells := int(binary.BigEndian.Uint16(page[header+3:]))
+	if cellPointers+2*numCells > db.usable {
+		return fmt.Errorf("Too many cells on page %d: %w", n, errSQLiteCorrupt)
+	}
+
+	for i := 0; i < numCells; i++ {
+		offset := int(binary.BigEndian.Uint16(page[cellPointers+2*i:]))
+		if offset < cellPointers || offset >= db.usable {
+			return fmt.Errorf("Invalid cell offset on page %d: %w", n, errSQLiteCorrupt)
+		}
+		cell := page[offset:db.usable]
+		if typ == sqliteInteriorTablePage {
+			if len(cell) < 4 {
+				return fmt.Errorf("Truncated cell on page %d: %w", n, errSQLiteCorrupt)
+			}
+			if err := db.scanPage(binary.BigEndian.Uint32(cell), visited, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payloadSize, k := sqliteVarint(cell)
+		if k == 0 {
+			return fmt.Errorf("Truncated cell on page %d: %w", n, errSQLiteCorrupt)
+		}
+		rowid, l := sqliteVarint(cell[k:])
+		if l == 0 {
+			return fmt.Errorf("Truncated cell on page %d: %w", n, errSQLiteCorrupt)
+		}
+		payload, err := db.payload(cell[k+l:], payloadSize)
+		if err != nil {
+			return err
+		}
+		values, err := parseSQLiteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if err := fn(int64(rowid), values); err != nil {
+			return err
+		}
+	}
+
+	if typ == sqliteInteriorTablePage {
+		return db.scanPage(binary.BigEndian.Uint32(page[header+8:]), visited, fn)
+	}
+	return nil
+}
+
+// page returns the page with the given (1 based) number.
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	start := (int64(n) - 1) * int64(db.pageSize)
+	if n == 0 || start+int64(db.pageSize) > int64(len(db.data)) {
+		return nil, fmt.Errorf("Page %d out of range: %w", n, errSQLiteCorrupt)
+	}
+	return db.data[start : start+int64(db.pageSize)], nil
+}
+
+// payload assembles the payload of a table leaf cell, following overflow
+// pages if it doesn't fit on the page.
+func (db *sqliteDB) payload(cell []byte, size uint64) ([]byte, error) {
+	if size > uint64(len(db.data)) {
+		return nil, fmt.Errorf("Invalid payload size: %w", errSQLiteCorrupt)
+	}
+	total := int(size)
+	maxLocal := db.usable - 35
+	if total <= maxLocal {
+		if len(cell) < total {
+			return nil, fmt.Errorf("Truncated payload: %w", errSQLiteCorrupt)
+		}
+		return cell[:total], nil
+	}
+
+	minLocal := (db.usable-12)*32/255 - 23
+	local := minLocal + (total-minLocal)%(db.usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	if len(cell) < local+4 {
+		return nil, fmt.Errorf("Truncated payload: %w", errSQLiteCorrupt)
+	}
+	payload := make([]byte, 0, total)
+	payload = append(payload, cell[:local]...)
+	next := binary.BigEndian.Uint32(cell[local:])
+	for len(payload) < total {
+		page, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = binary.BigEndian.Uint32(page)
+		chunk := page[4:db.usable]
+		if remaining := total - len(payload); len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+	}
+	return payload, nil
+}
+
+// parseSQLiteRecord decodes the values in a record. Integers are returned as
+// int64, floats as float64, text as string and blobs as []byte.
+func parseSQLiteRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := sqliteVarint(payload)
+	if n == 0 || headerSize < uint64(n) || headerSize > uint64(len(payload)) {
+		return nil, fmt.Errorf("Invalid record header: %w", errSQLiteCorrupt)
+	}
+	header := payload[n:headerSize]
+	body := payload[headerSize:]
+
+	var values []interface{}
+	for len(header) > 0 {
+		serialType, n := sqliteVarint(header)
+		if n == 0 {
+			return nil, fmt.Errorf("Invalid record header: %w", errSQLiteCorrupt)
+		}
+		header = header[n:]
+
+		var size uint64
+		switch {
+		case serialType >= 1 && serialType <= 4:
+			size = serialType
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		case serialType >= 12:
+			size = (serialType - 12) / 2
+		case serialType == 10 || serialType == 11:
+			return nil, fmt.Errorf("Reserved serial type %d: %w", serialType, errSQLiteCorrupt)
+		}
+		if size > uint64(len(body)) {
+			return nil, fmt.Errorf("Truncated record: %w", errSQLiteCorrupt)
+		}
+		field := body[:size]
+		body = body[size:]
+
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType <= 6:
+			v := int64(int8(field[0]))
+			for _, b := range field[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(field)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType%2 == 0:
+			values = append(values, append([]byte(nil), field...))
+		default:
+			values = append(values, string(field))
+		}
+	}
+	return values, nil
+}
+
+// sqliteVarint decodes the variable length integer at the start of b,
+// returning it along with its length, which is 0 if b is truncated.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// sqliteColumns parses the column names out of a CREATE TABLE statement,
+// along with the index of the INTEGER PRIMARY KEY column (-1 if none).
+func sqliteColumns(sql string) ([]string, int) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, -1
+	}
+	var definitions []string
+	depth, last := 0, start+1
+	for i := start + 1; i < end; i++ {
+		switch sql[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				definitions = append(definitions, sql[last:i])
+				last = i + 1
+			}
+		}
+	}
+	definitions = append(definitions, sql[last:end])
+
+	var columns []string
+	rowidColumn := -1
+	for _, definition := range definitions {
+		fields := strings.Fields(definition)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			// Table constraints follow the columns
+			continue
+		}
+		upper := strings.ToUpper(strings.Join(fields, " "))
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == "INTEGER" && strings.Contains(upper, "PRIMARY KEY") {
+			rowidColumn = len(columns)
+		}
+		columns = append(columns, strings.Trim(fields[0], "\"`[]"))
+	}
+	return columns, rowidColumn
+}
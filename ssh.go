@@ -0,0 +1,224 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshClockSkew is how far into the past the convenience SSH issuers backdate
+	// certificates to tolerate clocks that are slightly off.
+	sshClockSkew = 5 * time.Minute
+)
+
+var (
+	// DefaultSSHUserExtensions are the extensions that ssh-keygen grants to user
+	// certificates by default.
+	DefaultSSHUserExtensions = map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          "",
+	}
+)
+
+// SSHCertificateTemplate describes an OpenSSH certificate to be signed by a
+// keyman CA key.
+type SSHCertificateTemplate struct {
+	// CertType is either ssh.UserCert or ssh.HostCert
+	CertType uint32
+	// KeyID identifies the certificate in the server's logs
+	KeyID string
+	// Serial is the certificate's serial number. If zero, a random one is
+	// drawn.
+	Serial uint64
+	// Principals are the user names (for user certs) or host names (for host
+	// certs) for which the certificate is valid.
+	Principals []string
+	// ValidAfter is the time from which the certificate is valid. If zero, the
+	// certificate is valid from the beginning of time.
+	ValidAfter time.Time
+	// ValidBefore is the time at which the certificate expires. If zero, the
+	// certificate never expires.
+	ValidBefore time.Time
+	// CriticalOptions such as force-command or source-address
+	CriticalOptions map[string]string
+	// Extensions such as permit-pty
+	Extensions map[string]string
+}
+
+// SSHSigner returns an ssh.Signer backed by this PrivateKey.
+func (key *PrivateKey) SSHSigner() (ssh.Signer, error) {
+	signer, err := ssh.NewSignerFromKey(key.rsaKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create SSH signer: %w", err)
+	}
+	return signer, nil
+}
+
+// SSHPublicKey returns the public half of this PrivateKey as an
+// ssh.PublicKey.
+func (key *PrivateKey) SSHPublicKey() (ssh.PublicKey, error) {
+	pub, err := ssh.NewPublicKey(&key.rsaKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create SSH public key: %w", err)
+	}
+	return pub, nil
+}
+
+/*
+SSHCertificate() generates an OpenSSH certificate for the given public key based
+on the given template, signed by this PrivateKey acting as an SSH certificate
+authority.
+*/
+func (key *PrivateKey) SSHCertificate(template *SSHCertificateTemplate, publicKey ssh.PublicKey) (*ssh.Certificate, error) {
+	return defaultGenerator.SSHCertificate(key, template, publicKey)
+}
+
+// SSHUserCertificateFor generates a user certificate for the given public key
+// that is valid for the given duration and the given principals (user names).
+// The certificate carries DefaultSSHUserExtensions.
+func (key *PrivateKey) SSHUserCertificateFor(publicKey ssh.PublicKey, keyID string, validFor time.Duration, principals ...string) (*ssh.Certificate, error) {
+	return defaultGenerator.SSHUserCertificateFor(key, publicKey, keyID, validFor, principals...)
+}
+
+// SSHHostCertificateFor generates a host certificate for the given public key
+// that is valid for the given duration and the given host names.
+func (key *PrivateKey) SSHHostCertificateFor(publicKey ssh.PublicKey, keyID string, validFor time.Duration, hosts ...string) (*ssh.Certificate, error) {
+	return defaultGenerator.SSHHostCertificateFor(key, publicKey, keyID, validFor, hosts...)
+}
+
+// SSHCertificate is like PrivateKey.SSHCertificate, using the Generator's
+// entropy source for the serial number and signature.
+func (g *Generator) SSHCertificate(key *PrivateKey, template *SSHCertificateTemplate, publicKey ssh.PublicKey) (*ssh.Certificate, error) {
+	if template.CertType != ssh.UserCert && template.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("Unknown SSH certificate type %d", template.CertType)
+	}
+	signer, err := key.SSHSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          template.Serial,
+		CertType:        template.CertType,
+		KeyId:           template.KeyID,
+		ValidPrincipals: template.Principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			CriticalOptions: copyStringMap(template.CriticalOptions),
+			Extensions:      copyStringMap(template.Extensions),
+		},
+	}
+	if cert.Serial == 0 {
+		if cert.Serial, err = g.sshSerial(); err != nil {
+			return nil, err
+		}
+	}
+	if !template.ValidAfter.IsZero() {
+		cert.ValidAfter = uint64(template.ValidAfter.Unix())
+	}
+	if !template.ValidBefore.IsZero() {
+		cert.ValidBefore = uint64(template.ValidBefore.Unix())
+	}
+
+	if err := cert.SignCert(g.rand(), signer); err != nil {
+		return nil, fmt.Errorf("Unable to sign SSH certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// SSHUserCertificateFor is like PrivateKey.SSHUserCertificateFor, using the
+// Generator's Clock and entropy source.
+func (g *Generator) SSHUserCertificateFor(key *PrivateKey, publicKey ssh.PublicKey, keyID string, validFor time.Duration, principals ...string) (*ssh.Certificate, error) {
+	now := g.Now()
+	return g.SSHCertificate(key, &SSHCertificateTemplate{
+		CertType:    ssh.UserCert,
+		KeyID:       keyID,
+		Principals:  principals,
+		ValidAfter:  now.Add(-sshClockSkew),
+		ValidBefore: now.Add(validFor),
+		Extensions:  DefaultSSHUserExtensions,
+	}, publicKey)
+}
+
+// SSHHostCertificateFor is like PrivateKey.SSHHostCertificateFor, using the
+// Generator's Clock and entropy source.
+func (g *Generator) SSHHostCertificateFor(key *PrivateKey, publicKey ssh.PublicKey, keyID string, validFor time.Duration, hosts ...string) (*ssh.Certificate, error) {
+	now := g.Now()
+	return g.SSHCertificate(key, &SSHCertificateTemplate{
+		CertType:    ssh.HostCert,
+		KeyID:       keyID,
+		Principals:  hosts,
+		ValidAfter:  now.Add(-sshClockSkew),
+		ValidBefore: now.Add(validFor),
+	}, publicKey)
+}
+
+// sshSerial draws a random, non-zero 64-bit serial number from the
+// Generator's entropy source.
+func (g *Generator) sshSerial() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(g.rand(), b[:]); err != nil {
+			return 0, fmt.Errorf("Unable to generate serial number: %w", err)
+		}
+		if serial := binary.BigEndian.Uint64(b[:]); serial != 0 {
+			return serial, nil
+		}
+	}
+}
+
+// SSHTrustedUserCAKey returns this PrivateKey's public key in the format
+// expected by sshd's TrustedUserCAKeys file.
+func (key *PrivateKey) SSHTrustedUserCAKey() ([]byte, error) {
+	pub, err := key.SSHPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(pub), nil
+}
+
+// SSHKnownHostsCA returns a known_hosts line that marks this PrivateKey as a
+// @cert-authority for the given host patterns. If no hosts are given, the CA
+// is trusted for all hosts.
+func (key *PrivateKey) SSHKnownHostsCA(hosts ...string) ([]byte, error) {
+	pub, err := key.SSHPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"*"}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("@cert-authority ")
+	buf.WriteString(strings.Join(hosts, ","))
+	buf.WriteByte(' ')
+	buf.Write(ssh.MarshalAuthorizedKey(pub))
+	return buf.Bytes(), nil
+}
+
+// MarshalSSHCertificate encodes the given certificate in the format used by
+// ssh-keygen for id_rsa-cert.pub files.
+func MarshalSSHCertificate(cert *ssh.Certificate) []byte {
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package keyman
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHCertificates(t *testing.T) {
+	ca, err := GeneratePK(2048)
+	if !assert.NoError(t, err, "Unable to generate CA PK") {
+		return
+	}
+	user, err := GeneratePK(2048)
+	if !assert.NoError(t, err, "Unable to generate user PK") {
+		return
+	}
+	userPub, err := user.SSHPublicKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	caPub, err := ca.SSHPublicKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cert, err := ca.SSHUserCertificateFor(userPub, "alice@example", time.Hour, "alice", "deploy")
+	if !assert.NoError(t, err, "Unable to sign user certificate") {
+		return
+	}
+	assert.Equal(t, uint32(ssh.UserCert), cert.CertType)
+	assert.Equal(t, "alice@example", cert.KeyId)
+	assert.Equal(t, []string{"alice", "deploy"}, cert.ValidPrincipals)
+	assert.Contains(t, cert.Extensions, "permit-pty")
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caPub.Marshal())
+		},
+	}
+	_, err = checker.Authenticate(connMetadata("alice"), cert)
+	assert.NoError(t, err, "Certificate should authenticate alice")
+	_, err = checker.Authenticate(connMetadata("mallory"), cert)
+	assert.Error(t, err, "Certificate should not authenticate mallory")
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(MarshalSSHCertificate(cert))
+	if assert.NoError(t, err, "Unable to parse marshaled certificate") {
+		assert.Equal(t, cert.Marshal(), parsed.Marshal())
+	}
+
+	host, err := ca.SSHHostCertificateFor(userPub, "host", time.Hour, "example.com")
+	if assert.NoError(t, err, "Unable to sign host certificate") {
+		assert.NoError(t, checker.CheckCert("example.com", host))
+	}
+
+	_, err = ca.SSHCertificate(&SSHCertificateTemplate{CertType: 3}, userPub)
+	assert.Error(t, err, "Unknown certificate type should be rejected")
+
+	trusted, err := ca.SSHTrustedUserCAKey()
+	if assert.NoError(t, err) {
+		parsedCA, _, _, _, err := ssh.ParseAuthorizedKey(trusted)
+		if assert.NoError(t, err) {
+			assert.Equal(t, caPub.Marshal(), parsedCA.Marshal())
+		}
+	}
+
+	knownHosts, err := ca.SSHKnownHostsCA("*.example.com", "example.com")
+	if assert.NoError(t, err) {
+		marker, hosts, parsedCA, _, _, err := ssh.ParseKnownHosts(knownHosts)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "cert-authority", marker)
+			assert.Equal(t, []string{"*.example.com", "example.com"}, hosts)
+			assert.Equal(t, caPub.Marshal(), parsedCA.Marshal())
+		}
+	}
+}
+
+type connMetadata string
+
+func (c connMetadata) User() string          { return string(c) }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return nil }
+func (c connMetadata) LocalAddr() net.Addr   { return nil }
+
+func TestSSHCertificateGenerator(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	gen := &Generator{Clock: FixedClock(now)}
+	ca, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	userPub, err := ca.SSHPublicKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert1, err := gen.SSHUserCertificateFor(ca, userPub, "alice", time.Hour, "alice")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert2, err := gen.SSHUserCertificateFor(ca, userPub, "alice", time.Hour, "alice")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, cert1.Serial, cert2.Serial, "Serials should be random even though the time is fixed")
+	assert.Equal(t, uint64(now.Add(-sshClockSkew).Unix()), cert1.ValidAfter)
+	assert.Equal(t, uint64(now.Add(time.Hour).Unix()), cert1.ValidBefore)
+}
@@ -0,0 +1,301 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrReadOnly is returned when trying to modify a read-only Store.
+	ErrReadOnly = errors.New("Store is read-only")
+)
+
+// Store is a place where keys and certificates are kept, addressed by name.
+// Get and Delete return an error satisfying os.IsNotExist when the named entry
+// doesn't exist.
+type Store interface {
+	// Get returns the contents of the named entry.
+	Get(name string) ([]byte, error)
+
+	// Put stores data under the given name, atomically replacing any existing
+	// entry of that name.
+	Put(name string, data []byte) error
+
+	// PutAll stores all of the given entries, replacing any existing entries
+	// of the same names. Each entry is replaced atomically, but Stores like
+	// DirStore can't replace several entries as a unit; they write all of
+	// them before replacing any, and then replace them one at a time.
+	PutAll(entries map[string][]byte) error
+
+	// Delete removes the named entry.
+	Delete(name string) error
+
+	// List returns the names of all entries in the Store, sorted.
+	List() ([]string, error)
+}
+
+// orderedStore is implemented by Stores that replace the entries written by
+// PutAll one at a time, to let callers choose the order.
+type orderedStore interface {
+	putInOrder(names []string, entries map[string][]byte) error
+}
+
+// stagedStore is implemented by Stores that can finish interrupted writes.
+type stagedStore interface {
+	// completeStaged replaces the named entry with data that was staged for
+	// it by an interrupted write, if accepted, indicating whether it did.
+	completeStaged(name string, accept func(data []byte) bool) (bool, error)
+}
+
+// putInOrder stores the given entries like PutAll. Stores that can't replace
+// them as a unit replace them in the order of names, which must list all of
+// them.
+func putInOrder(store Store, names []string, entries map[string][]byte) error {
+	if ordered, ok := store.(orderedStore); ok {
+		return ordered.putInOrder(names, entries)
+	}
+	return store.PutAll(entries)
+}
+
+/*******************************************************************************
+ * Directory Store
+ ******************************************************************************/
+
+// DirStore is a Store backed by a directory on the local filesystem. Names are
+// paths relative to the directory. A DirStore with an empty directory
+// resolves names relative to the working directory, and also accepts absolute
+// paths. Entries are written atomically with mode 0600.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore constructs a DirStore rooted at the given directory.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+func (s *DirStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *DirStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+func (s *DirStore) Put(name string, data []byte) error {
+	return s.PutAll(map[string][]byte{name: data})
+}
+
+// PutAll replaces the entries in the order of their names.
+func (s *DirStore) PutAll(entries map[string][]byte) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return s.putInOrder(names, entries)
+}
+
+func (s *DirStore) putInOrder(names []string, entries map[string][]byte) error {
+	files := make([]atomicFile, 0, len(entries))
+	for _, name := range names {
+		data, found := entries[name]
+		if !found {
+			continue
+		}
+		path := s.path(name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("Unable to create directory for %s: %w", path, err)
+		}
+		files = append(files, atomicFile{name: path, data: data, perm: 0600})
+	}
+	return writeFilesAtomic(files...)
+}
+
+func (s *DirStore) completeStaged(name string, accept func(data []byte) bool) (bool, error) {
+	return completeStagedFile(s.path(name), accept)
+}
+
+func (s *DirStore) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *DirStore) List() ([]string, error) {
+	root := s.dir
+	if root == "" {
+		root = "."
+	}
+	var names []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), atomicTempPrefix) || strings.HasPrefix(info.Name(), lockFilePrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s: %w", root, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/*******************************************************************************
+ * Memory Store
+ ******************************************************************************/
+
+// MemStore is a Store that keeps everything in memory, useful for tests.
+type MemStore struct {
+	entries map[string][]byte
+	locks   map[string]chan struct{}
+	mx      sync.RWMutex
+}
+
+// NewMemStore constructs an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{entries: make(map[string][]byte)}
+}
+
+func (s *MemStore) Get(name string) ([]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	data, found := s.entries[name]
+	if !found {
+		return nil, notExist("get", name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemStore) Put(name string, data []byte) error {
+	return s.PutAll(map[string][]byte{name: data})
+}
+
+func (s *MemStore) PutAll(entries map[string][]byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for name, data := range entries {
+		s.entries[name] = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+func (s *MemStore) Delete(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, found := s.entries[name]; !found {
+		return notExist("delete", name)
+	}
+	delete(s.entries, name)
+	return nil
+}
+
+func (s *MemStore) List() ([]string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	names := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/*******************************************************************************
+ * fs.FS Store
+ ******************************************************************************/
+
+// FSStore is a read-only Store backed by an fs.FS, for example an embed.FS.
+// Names are slash-separated paths as used by io/fs.
+type FSStore struct {
+	fsys fs.FS
+}
+
+// NewFSStore constructs an FSStore that reads from the given fs.FS.
+func NewFSStore(fsys fs.FS) *FSStore {
+	return &FSStore{fsys: fsys}
+}
+
+func (s *FSStore) Get(name string) ([]byte, error) {
+	return fs.ReadFile(s.fsys, name)
+}
+
+func (s *FSStore) Put(name string, data []byte) error {
+	return ErrReadOnly
+}
+
+func (s *FSStore) PutAll(entries map[string][]byte) error {
+	return ErrReadOnly
+}
+
+func (s *FSStore) Delete(name string) error {
+	return ErrReadOnly
+}
+
+func (s *FSStore) List() ([]string, error) {
+	var names []string
+	err := fs.WalkDir(s.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+/*******************************************************************************
+ * Store Functions
+ ******************************************************************************/
+
+// LoadPKFromStore loads a PEM-encoded PrivateKey from the named entry in the
+// given Store.
+func LoadPKFromStore(store Store, name string) (*PrivateKey, error) {
+	pemBytes, err := store.Get(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Unable to read private key %s from store: %w", name, err)
+	}
+	return LoadPKFromPEMBytes(pemBytes)
+}
+
+// LoadCertificateFromStore loads a PEM-encoded Certificate from the named
+// entry in the given Store.
+func LoadCertificateFromStore(store Store, name string) (*Certificate, error) {
+	pemBytes, err := store.Get(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Unable to read certificate %s from store: %w", name, err)
+	}
+	return LoadCertificateFromPEMBytes(pemBytes)
+}
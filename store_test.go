@@ -0,0 +1,87 @@
+package keyman
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStores(t *testing.T) {
+	for name, store := range map[string]Store{
+		"dir": NewDirStore(t.TempDir()),
+		"mem": NewMemStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.Get("missing")
+			assert.True(t, os.IsNotExist(err), "Missing entry should not exist")
+			assert.True(t, os.IsNotExist(store.Delete("missing")), "Deleting missing entry should fail with not exist")
+
+			assert.NoError(t, store.Put("a", []byte("1")))
+			assert.NoError(t, store.Put("a", []byte("2")), "Put should replace existing entry")
+			assert.NoError(t, store.PutAll(map[string][]byte{"sub/b": []byte("3"), "c": []byte("4")}))
+
+			data, err := store.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, "2", string(data))
+
+			names, err := store.List()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a", "c", "sub/b"}, names)
+
+			assert.NoError(t, store.Delete("a"))
+			names, _ = store.List()
+			assert.Equal(t, []string{"c", "sub/b"}, names)
+		})
+	}
+}
+
+func TestDirStoreMissingDir(t *testing.T) {
+	store := NewDirStore(filepath.Join(t.TempDir(), "missing"))
+	names, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestFSStore(t *testing.T) {
+	store := NewFSStore(fstest.MapFS{
+		"certs/cert.pem": &fstest.MapFile{Data: []byte("cert")},
+		"key.pem":        &fstest.MapFile{Data: []byte("key")},
+	})
+	data, err := store.Get("certs/cert.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, "cert", string(data))
+	_, err = store.Get("missing")
+	assert.True(t, os.IsNotExist(err))
+
+	names, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"certs/cert.pem", "key.pem"}, names)
+
+	assert.Equal(t, ErrReadOnly, store.Put("key.pem", nil))
+	assert.Equal(t, ErrReadOnly, store.Delete("key.pem"))
+}
+
+func TestStoredPKAndCertIn(t *testing.T) {
+	store := NewMemStore()
+	opts := &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName", Hosts: []string{"127.0.0.1"}}
+	pk, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "TestCommonName", cert.X509().Subject.CommonName)
+
+	pk2, cert2, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded(), "Stored PK should be reused")
+		assert.Equal(t, cert.PEMEncoded(), cert2.PEMEncoded(), "Stored cert should be reused")
+	}
+
+	_, err = KeyPairIn(store, "127.0.0.1", "TestCommonName", "pk.pem", "cert.pem")
+	assert.NoError(t, err, "Should be able to load key pair from store")
+
+	_, _, err = StoredPKAndCertIn(NewFSStore(fstest.MapFS{}), "pk.pem", "cert.pem", opts)
+	assert.Error(t, err, "Creating PK in read-only store should fail")
+}
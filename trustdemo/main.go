@@ -15,6 +15,8 @@ const (
 )
 
 func main() {
+	keyman.AddObserver(keyman.StdoutObserver)
+
 	pk, err := keyman.GeneratePK(2048)
 	if err != nil {
 		log.Fatalf("Unable to generate PK: %v", err)
@@ -0,0 +1,191 @@
+package keyman
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// PlannedCertFile stands for the temp file containing the certificate in
+	// the commands of a TrustPlan.
+	PlannedCertFile = "<certificate>"
+)
+
+// TrustActionOp is the kind of change made by a TrustAction.
+type TrustActionOp string
+
+const (
+	// TrustActionCreate creates the TrustStore, e.g. an empty NSS database.
+	TrustActionCreate TrustActionOp = "create"
+
+	// TrustActionAdd adds the certificate.
+	TrustActionAdd TrustActionOp = "add"
+
+	// TrustActionRemove removes a stale certificate with the same common
+	// name.
+	TrustActionRemove TrustActionOp = "remove"
+
+	// TrustActionVerify checks that the certificate is trusted after adding
+	// it, without changing anything.
+	TrustActionVerify TrustActionOp = "verify"
+
+	// TrustActionUpdate rebuilds files derived from the TrustStore, like the
+	// system CA bundle.
+	TrustActionUpdate TrustActionOp = "update"
+)
+
+// TrustAction is one step taken by a TrustStore when adding or removing a
+// certificate.
+type TrustAction struct {
+	Op TrustActionOp `json:"op"`
+	// Command is the external command that's run, if any
+	Command *Command `json:"command,omitempty"`
+	// File is the file that's written or removed without running a command,
+	// if any
+	File string `json:"file,omitempty"`
+	// Elevated is whether the action needs elevated privileges
+	Elevated bool `json:"elevated"`
+}
+
+func commandAction(op TrustActionOp, cmd *Command) *TrustAction {
+	return &TrustAction{Op: op, Command: cmd, Elevated: cmd.Elevated()}
+}
+
+func fileAction(op TrustActionOp, file string) *TrustAction {
+	return &TrustAction{Op: op, File: file}
+}
+
+// TrustPlanner is implemented by TrustStores that can describe the actions
+// taken by their Add and Remove without taking them. The actions are built by
+// the same code that Add and Remove use, and commands are given the
+// certificate as PlannedCertFile.
+type TrustPlanner interface {
+	// PlanAdd describes the actions taken by Add for the given certificate.
+	PlanAdd(cert *Certificate) ([]*TrustAction, error)
+
+	// PlanRemove describes the actions taken by Remove for the given common
+	// name, assuming that the TrustStore contains a certificate with it.
+	PlanRemove(commonName string) ([]*TrustAction, error)
+}
+
+// PlannedCertificate identifies a certificate in a TrustPlan.
+type PlannedCertificate struct {
+	CommonName string    `json:"commonName"`
+	SHA256     string    `json:"sha256"`
+	NotAfter   time.Time `json:"notAfter"`
+}
+
+func plannedCertificate(cert *Certificate) *PlannedCertificate {
+	return &PlannedCertificate{
+		CommonName: cert.X509().Subject.CommonName,
+		SHA256:     sha256Hex(cert.DER()),
+		NotAfter:   cert.X509().NotAfter,
+	}
+}
+
+// TrustPlan describes what InstallTrustedRoot would do, as returned by
+// PlanTrust. It can be encoded as JSON, e.g. to be shown to the user.
+type TrustPlan struct {
+	Certificate *PlannedCertificate `json:"certificate"`
+	// Stores are the plans for each TrustStore, in the order in which they
+	// were given
+	Stores []*TrustStorePlan `json:"stores"`
+	// Elevated is whether any of the actions need elevated privileges
+	Elevated bool `json:"elevated"`
+}
+
+// TrustStorePlan describes what InstallTrustedRoot would do to one TrustStore.
+type TrustStorePlan struct {
+	// Name is the Name of the TrustStore
+	Name string `json:"name"`
+	// Outcome is the expected outcome: TrustInstalled if the certificate
+	// would be installed, TrustFailed if it can't be, e.g. because of a stale
+	// root with RefuseStale, or as reported by InstallTrustedRoot otherwise
+	Outcome TrustOutcome `json:"outcome"`
+	// Reason explains why the TrustStore would be skipped or fail, or was
+	// canceled
+	Reason string `json:"reason,omitempty"`
+	// Replaces are the stale certificates with the same common name that
+	// would be removed
+	Replaces []*PlannedCertificate `json:"replaces,omitempty"`
+	// Actions are the steps that would be taken, in order. TrustStores that
+	// aren't TrustPlanners are described by a single action of each kind.
+	Actions []*TrustAction `json:"actions,omitempty"`
+	// Elevated is whether any of the actions need elevated privileges
+	Elevated bool `json:"elevated"`
+}
+
+// PlanTrust describes what InstallTrustedRoot would do to install cert in each
+// of the given TrustStores with the given options (which may be nil): which
+// TrustStores would be modified, which commands would be run, whether
+// elevated privileges are needed and which certificates would be replaced.
+// TrustStores are only inspected, not modified. Planning shares the checks
+// and decisions of InstallTrustedRoot, so the two don't diverge.
+func PlanTrust(ctx context.Context, cert *Certificate, stores []TrustStore, opts *TrustOptions) *TrustPlan {
+	if opts == nil {
+		opts = &TrustOptions{}
+	}
+	result := &TrustResult{}
+	pending := cert.checkTrustStores(ctx, stores, result)
+
+	plan := &TrustPlan{Certificate: plannedCertificate(cert)}
+	plans := make(map[*TrustTarget]*TrustStorePlan, len(result.Targets))
+	for _, target := range result.Targets {
+		storePlan := &TrustStorePlan{Name: target.Name, Outcome: target.Outcome, Reason: target.Reason}
+		if target.Err != nil {
+			storePlan.Reason = target.Err.Error()
+		}
+		plan.Stores = append(plan.Stores, storePlan)
+		plans[target] = storePlan
+	}
+	for _, p := range pending {
+		storePlan := plans[p.target]
+		cert.planTrustIn(ctx, p.store, opts, storePlan)
+		plan.Elevated = plan.Elevated || storePlan.Elevated
+	}
+	return plan
+}
+
+// planTrustIn plans installing the certificate in the given TrustStore, which
+// is known not to contain it, mirroring installTrustedRootIn.
+func (cert *Certificate) planTrustIn(ctx context.Context, store TrustStore, opts *TrustOptions, plan *TrustStorePlan) {
+	fail := func(outcome TrustOutcome, err error) {
+		plan.Outcome = outcome
+		plan.Reason = err.Error()
+		plan.Actions = nil
+	}
+	if err := ctx.Err(); err != nil {
+		fail(TrustCanceled, err)
+		return
+	}
+	stale, err := cert.rootsToReplaceIn(ctx, store, opts)
+	if err != nil {
+		fail(TrustFailed, err)
+		return
+	}
+
+	planner, _ := store.(TrustPlanner)
+	for _, c := range stale {
+		plan.Replaces = append(plan.Replaces, plannedCertificate(c))
+	}
+	if len(stale) > 0 {
+		actions, err := cert.planStaleRootRemoval(ctx, store, stale)
+		if err != nil {
+			fail(TrustFailed, err)
+			return
+		}
+		plan.Actions = append(plan.Actions, actions...)
+	}
+	actions := []*TrustAction{{Op: TrustActionAdd}}
+	if planner != nil {
+		if actions, err = planner.PlanAdd(cert); err != nil {
+			fail(TrustFailed, err)
+			return
+		}
+	}
+	plan.Actions = append(plan.Actions, actions...)
+	plan.Outcome = TrustInstalled
+	for _, action := range plan.Actions {
+		plan.Elevated = plan.Elevated || action.Elevated
+	}
+}
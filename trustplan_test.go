@@ -0,0 +1,159 @@
+package keyman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanTrust(t *testing.T) {
+	ctx := context.Background()
+	stale := testRoot(t, "Test Root")
+	cert := testRoot(t, "Test Root")
+
+	present := NewFakeTrustStore("present")
+	assert.NoError(t, present.Add(ctx, cert))
+	dir := NewDirTrustStore(filepath.Join(t.TempDir(), "roots"))
+	assert.NoError(t, dir.Add(ctx, stale))
+	runner := NewFakeRunner().
+		On("security", []string{"find-certificate"}, string(stale.PEMEncoded()), nil).
+		On("security", []string{"verify-cert"}, "", errors.New("untrusted"))
+	keychain := NewKeychainTrustStore("/Library/Keychains/System.keychain", "Please")
+	keychain.Runner = runner
+	missing := NewSystemTrustStore(t.TempDir(), "")
+	stores := []TrustStore{present, dir, keychain, missing}
+
+	plan := PlanTrust(ctx, cert, stores, nil)
+	assert.Equal(t, sha256Hex(cert.DER()), plan.Certificate.SHA256)
+	assert.True(t, plan.Elevated)
+	if !assert.Len(t, plan.Stores, 4) {
+		return
+	}
+	assert.Equal(t, TrustAlreadyPresent, plan.Stores[0].Outcome)
+	assert.Empty(t, plan.Stores[0].Actions)
+
+	assert.Equal(t, TrustInstalled, plan.Stores[1].Outcome)
+	assert.False(t, plan.Stores[1].Elevated)
+	if assert.Len(t, plan.Stores[1].Replaces, 1) {
+		assert.Equal(t, sha256Hex(stale.DER()), plan.Stores[1].Replaces[0].SHA256)
+	}
+	assert.Equal(t, []*TrustAction{
+		{Op: TrustActionRemove, File: dir.file("Test Root")},
+		{Op: TrustActionAdd, File: dir.file("Test Root")},
+	}, plan.Stores[1].Actions)
+
+	assert.Equal(t, TrustInstalled, plan.Stores[2].Outcome)
+	assert.True(t, plan.Stores[2].Elevated)
+	assert.Len(t, plan.Stores[2].Replaces, 1)
+	var lines []string
+	for _, action := range plan.Stores[2].Actions {
+		lines = append(lines, string(action.Op)+": "+action.Command.String())
+	}
+	assert.Equal(t, []string{
+		"remove: security delete-certificate -Z " + sha1Hex(stale) + " /Library/Keychains/System.keychain",
+		"add: security add-trusted-cert -d -k /Library/Keychains/System.keychain <certificate>",
+		"verify: security verify-cert -c <certificate>",
+	}, lines)
+
+	assert.Equal(t, TrustSkipped, plan.Stores[3].Outcome)
+	assert.NotEmpty(t, plan.Stores[3].Reason)
+
+	// Planning only inspects the trust stores
+	certs, err := dir.List(ctx)
+	if assert.NoError(t, err) {
+		assert.True(t, containsCert(certs, stale), "Stale root should be left in place")
+		assert.False(t, containsCert(certs, cert), "Root should not be installed")
+	}
+	for _, line := range runner.CommandLines() {
+		assert.False(t, strings.HasPrefix(line, "[elevated]"), "Planning should not run %v", line)
+	}
+
+	// Installing runs the planned changes
+	planned := len(runner.Commands())
+	_, err = cert.InstallTrustedRoot(ctx, []TrustStore{keychain}, nil)
+	assert.NoError(t, err)
+	var expected, ran []string
+	for _, action := range plan.Stores[2].Actions {
+		if action.Elevated {
+			expected = append(expected, action.Command.String())
+		}
+	}
+	for _, cmd := range runner.Commands()[planned:] {
+		if cmd.Elevated() {
+			args := append([]string(nil), cmd.Args...)
+			for i, arg := range args {
+				if strings.HasPrefix(arg, os.TempDir()) {
+					args[i] = PlannedCertFile
+				}
+			}
+			ran = append(ran, (&Command{Name: cmd.Name, Args: args}).String())
+		}
+	}
+	assert.Len(t, ran, 2)
+	assert.Equal(t, expected, ran)
+}
+
+func TestPlanTrustRefuseStale(t *testing.T) {
+	ctx := context.Background()
+	stale := testRoot(t, "Test Root")
+	cert := testRoot(t, "Test Root")
+	store := NewFakeTrustStore("fake")
+	assert.NoError(t, store.Add(ctx, stale))
+	assert.NoError(t, store.Add(ctx, testRoot(t, "Test Root")))
+
+	plan := PlanTrust(ctx, cert, []TrustStore{store}, &TrustOptions{Replace: RefuseStale})
+	if assert.Len(t, plan.Stores, 1) {
+		assert.Equal(t, TrustFailed, plan.Stores[0].Outcome)
+		assert.Contains(t, plan.Stores[0].Reason, ErrStaleRoot.Error())
+		assert.Empty(t, plan.Stores[0].Actions)
+	}
+
+	plan = PlanTrust(ctx, cert, []TrustStore{store}, nil)
+	if assert.Len(t, plan.Stores, 1) {
+		assert.Equal(t, TrustInstalled, plan.Stores[0].Outcome)
+		assert.Len(t, plan.Stores[0].Replaces, 2)
+		assert.Equal(t, []*TrustAction{{Op: TrustActionRemove}, {Op: TrustActionAdd}}, plan.Stores[0].Actions, "Stale roots should be removed at once")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	plan = PlanTrust(canceled, cert, []TrustStore{store}, nil)
+	if assert.Len(t, plan.Stores, 1) {
+		assert.Equal(t, TrustCanceled, plan.Stores[0].Outcome)
+	}
+}
+
+func TestTrustPlanJSON(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	store := NewJavaTrustStore("/etc/keystore", "", "Please")
+	store.Runner = NewFakeRunner()
+
+	plan := PlanTrust(ctx, cert, []TrustStore{store}, nil)
+	data, err := json.Marshal(plan)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded := &TrustPlan{}
+	if !assert.NoError(t, json.Unmarshal(data, decoded)) {
+		return
+	}
+	redata, err := json.Marshal(decoded)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, string(data), string(redata))
+	}
+	if assert.Len(t, decoded.Stores, 1) && assert.Len(t, decoded.Stores[0].Actions, 1) {
+		action := decoded.Stores[0].Actions[0]
+		assert.Equal(t, TrustActionAdd, action.Op)
+		assert.True(t, action.Elevated)
+		assert.Equal(t, "keytool", action.Command.Name)
+		assert.Equal(t, "Please", action.Command.Prompt)
+	}
+	assert.Contains(t, string(data), `"outcome":"installed"`)
+}
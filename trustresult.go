@@ -0,0 +1,153 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TrustOutcome is the outcome of installing or removing a trusted root in one
+// TrustStore.
+type TrustOutcome string
+
+const (
+	// TrustAlreadyPresent means that the TrustStore already contained the
+	// certificate.
+	TrustAlreadyPresent TrustOutcome = "already-present"
+
+	// TrustInstalled means that the certificate was installed.
+	TrustInstalled TrustOutcome = "installed"
+
+	// TrustRemoved means that the certificate was removed, or wasn't there.
+	TrustRemoved TrustOutcome = "removed"
+
+	// TrustFailed means that installing or removing the certificate failed.
+	TrustFailed TrustOutcome = "failed"
+
+	// TrustSkipped means that installing the certificate wasn't attempted,
+	// e.g. because the TrustStore isn't available on this system.
+	TrustSkipped TrustOutcome = "skipped"
+
+	// TrustCanceled means that installing the certificate was interrupted or
+	// not attempted because the context was done.
+	TrustCanceled TrustOutcome = "canceled"
+)
+
+// TrustTarget is the outcome of installing or removing a trusted root in one
+// TrustStore.
+type TrustTarget struct {
+	// Name is the Name of the TrustStore
+	Name    string
+	Outcome TrustOutcome
+	// Err is the failure, if the Outcome is TrustFailed, or the context's
+	// error if it's TrustCanceled
+	Err error
+	// Reason explains why the TrustStore was skipped, if the Outcome is
+	// TrustSkipped
+	Reason string
+}
+
+func (t *TrustTarget) String() string {
+	switch t.Outcome {
+	case TrustFailed, TrustCanceled:
+		return fmt.Sprintf("%v: %v: %v", t.Name, t.Outcome, t.Err)
+	case TrustSkipped:
+		return fmt.Sprintf("%v: %v: %v", t.Name, t.Outcome, t.Reason)
+	}
+	return fmt.Sprintf("%v: %v", t.Name, t.Outcome)
+}
+
+func (t *TrustTarget) cancel(err error) {
+	t.Outcome = TrustCanceled
+	t.Err = err
+}
+
+// TrustResult lists the outcome of installing or removing a trusted root for
+// each TrustStore, in the order in which they were given.
+type TrustResult struct {
+	Targets []*TrustTarget
+
+	// op is the operation reported by Err, opInstall if empty
+	op string
+}
+
+const (
+	opInstall = "install trusted root in"
+	opRemove  = "remove trusted root from"
+)
+
+// Failed returns the targets that failed.
+func (r *TrustResult) Failed() []*TrustTarget {
+	var failed []*TrustTarget
+	for _, target := range r.Targets {
+		if target.Outcome == TrustFailed {
+			failed = append(failed, target)
+		}
+	}
+	return failed
+}
+
+// Canceled returns the targets that were canceled.
+func (r *TrustResult) Canceled() []*TrustTarget {
+	var canceled []*TrustTarget
+	for _, target := range r.Targets {
+		if target.Outcome == TrustCanceled {
+			canceled = append(canceled, target)
+		}
+	}
+	return canceled
+}
+
+// Err returns a *TrustError aggregating all failures and cancellations, or nil
+// if there were none.
+func (r *TrustResult) Err() error {
+	failed := append(r.Failed(), r.Canceled()...)
+	if len(failed) == 0 {
+		return nil
+	}
+	op := r.op
+	if op == "" {
+		op = opInstall
+	}
+	return &TrustError{Op: op, Failed: failed}
+}
+
+// TrustError aggregates the failures of installing or removing a trusted root
+// in several TrustStores. errors.Is and errors.As match the error of any failure, so
+// for example errors.Is(err, ErrElevationDeclined) reports whether any of the
+// TrustStores failed because the user declined elevation, and IsCanceled(err)
+// whether any of them was canceled.
+type TrustError struct {
+	// Op is the operation that failed, e.g. "remove trusted root from"
+	Op string
+	// Failed are the targets that failed or were canceled
+	Failed []*TrustTarget
+}
+
+func (e *TrustError) Error() string {
+	failures := make([]string, 0, len(e.Failed))
+	for _, target := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%v: %v", target.Name, target.Err))
+	}
+	return fmt.Sprintf("Unable to %v %d trust store(s): %v", e.Op, len(e.Failed), strings.Join(failures, "; "))
+}
+
+// Is reports whether the error of any failure matches target.
+func (e *TrustError) Is(target error) bool {
+	for _, failed := range e.Failed {
+		if errors.Is(failed.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of any failure that matches target.
+func (e *TrustError) As(target interface{}) bool {
+	for _, failed := range e.Failed {
+		if errors.As(failed.Err, target) {
+			return true
+		}
+	}
+	return false
+}
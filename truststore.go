@@ -0,0 +1,457 @@
+package keyman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	trustStoreBackends   = make(map[string]TrustStoreBackend)
+	trustStoreBackendsMx sync.RWMutex
+)
+
+// TrustStore is a place where trusted root certificates are installed, like
+// an NSS database, the macOS system keychain or a Java keystore.
+//
+// TrustStores run external commands until the context of an operation is done.
+// Commands are terminated after DefaultTrustTimeout unless the context has a
+// deadline. Errors due to the context can be told apart with IsCanceled.
+type TrustStore interface {
+	// Name identifies the TrustStore, e.g. "nss:sql:/home/user/.pki/nssdb"
+	Name() string
+
+	// List returns the certificates in the TrustStore.
+	List(ctx context.Context) ([]*Certificate, error)
+
+	// Contains checks whether the given certificate is trusted by the
+	// TrustStore.
+	Contains(ctx context.Context, cert *Certificate) (bool, error)
+
+	// Add installs the given certificate as a trusted root.
+	Add(ctx context.Context, cert *Certificate) error
+
+	// Remove removes the certificate with the given common name, if there is
+	// one.
+	Remove(ctx context.Context, commonName string) error
+}
+
+// certRemover is implemented by TrustStores whose Remove deletes only one of
+// several certificates with the same common name, like the macOS keychain and
+// NSS. Stale roots are removed from them one at a time. Other TrustStores
+// remove every match (e.g. DirTrustStore), or can only hold one (e.g. the
+// keytool alias used by JavaTrustStore).
+type certRemover interface {
+	// removeCert removes the given certificate, if it's present.
+	removeCert(ctx context.Context, cert *Certificate) error
+
+	// planRemoveCert describes the actions taken by removeCert.
+	planRemoveCert(ctx context.Context, cert *Certificate) ([]*TrustAction, error)
+}
+
+// TrustStoreBackend finds the TrustStores of one kind that are present on this
+// system. prompt is used when elevating privileges to modify them, if
+// necessary. Backends that aren't available return no TrustStores.
+type TrustStoreBackend func(prompt string) ([]TrustStore, error)
+
+// RegisterTrustStoreBackend registers a TrustStoreBackend under the given
+// name, replacing any existing backend with the same name. The platform
+// backends are registered as "nss" and "system" (Linux), "keychain" (macOS)
+// and "windows" (Windows), and "java" on all platforms.
+func RegisterTrustStoreBackend(name string, backend TrustStoreBackend) {
+	trustStoreBackendsMx.Lock()
+	trustStoreBackends[name] = backend
+	trustStoreBackendsMx.Unlock()
+}
+
+// TrustStoreBackends lists the names of all registered backends.
+func TrustStoreBackends() []string {
+	trustStoreBackendsMx.RLock()
+	defer trustStoreBackendsMx.RUnlock()
+	names := make([]string, 0, len(trustStoreBackends))
+	for name := range trustStoreBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TrustStores finds the TrustStores of the named backends. If no backends are
+// named, the platform defaults used by AddAsTrustedRootIfNeeded are used.
+func TrustStores(prompt string, backends ...string) ([]TrustStore, error) {
+	if len(backends) == 0 {
+		backends = defaultTrustStoreBackends
+	}
+	var stores []TrustStore
+	for _, name := range backends {
+		trustStoreBackendsMx.RLock()
+		backend := trustStoreBackends[name]
+		trustStoreBackendsMx.RUnlock()
+		if backend == nil {
+			return nil, fmt.Errorf("Unknown trust store backend %q", name)
+		}
+		found, err := backend(prompt)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find %s trust stores: %w", name, err)
+		}
+		stores = append(stores, found...)
+	}
+	return stores, nil
+}
+
+// StaticTrustStoreBackend constructs a TrustStoreBackend that always returns
+// the given TrustStores.
+func StaticTrustStoreBackend(stores ...TrustStore) TrustStoreBackend {
+	return func(prompt string) ([]TrustStore, error) {
+		return stores, nil
+	}
+}
+
+// ReplacePolicy determines what happens when installing a trusted root in a
+// TrustStore that contains a different certificate with the same common name,
+// e.g. because the CA was regenerated.
+type ReplacePolicy int
+
+const (
+	// ReplaceStale removes the stale certificates before installing the new
+	// one. This is the default.
+	ReplaceStale ReplacePolicy = iota
+
+	// KeepStale installs the new certificate alongside the stale ones. Some
+	// TrustStores, like NSS databases, don't support multiple certificates
+	// with the same name.
+	KeepStale
+
+	// RefuseStale fails with ErrStaleRoot without modifying the TrustStore.
+	RefuseStale
+)
+
+// TrustOptions configures InstallTrustedRoot, AddAsTrustedRootWith and
+// PlanTrust.
+type TrustOptions struct {
+	// Replace determines how stale certificates with the same common name are
+	// handled.
+	Replace ReplacePolicy
+
+	// InstallAttempted, if provided, will be called on any attempt to modify a
+	// TrustStore with the resulting error (if any).
+	InstallAttempted func(error)
+}
+
+// AddAsTrustedRootIn adds the certificate as a trusted root to each of the
+// given TrustStores that doesn't already contain it, replacing stale
+// certificates with the same common name. If installAttempted is provided it
+// will be called on any attempt to modify a TrustStore with the resulting
+// error (if any). Failures don't stop the remaining TrustStores from being
+// attempted, and are returned together as a *TrustError.
+func (cert *Certificate) AddAsTrustedRootIn(ctx context.Context, stores []TrustStore, installAttempted func(error)) error {
+	return cert.AddAsTrustedRootWith(ctx, stores, &TrustOptions{InstallAttempted: installAttempted})
+}
+
+// AddAsTrustedRootWith is like AddAsTrustedRootIn but allows choosing how
+// stale certificates are handled. opts may be nil.
+func (cert *Certificate) AddAsTrustedRootWith(ctx context.Context, stores []TrustStore, opts *TrustOptions) error {
+	_, err := cert.InstallTrustedRoot(ctx, stores, opts)
+	return err
+}
+
+// InstallTrustedRoot adds the certificate as a trusted root to each of the
+// given TrustStores that doesn't already contain it, attempting every one of
+// them. The result lists the outcome for each TrustStore, and the error, a
+// *TrustError, aggregates all failures. Once the context is done, the
+// remaining TrustStores are marked as canceled. opts may be nil.
+func (cert *Certificate) InstallTrustedRoot(ctx context.Context, stores []TrustStore, opts *TrustOptions) (*TrustResult, error) {
+	result := &TrustResult{}
+	cert.installTrustedRoot(ctx, cert.checkTrustStores(ctx, stores, result), opts)
+	return result, result.Err()
+}
+
+// pendingInstall is a TrustStore that needs the certificate installed, along
+// with its entry in the TrustResult.
+type pendingInstall struct {
+	store  TrustStore
+	target *TrustTarget
+}
+
+// checkTrustStores adds an entry for each of the given TrustStores to the
+// result, recording those that already contain the certificate or aren't
+// available, and returns the others.
+func (cert *Certificate) checkTrustStores(ctx context.Context, stores []TrustStore, result *TrustResult) []*pendingInstall {
+	var pending []*pendingInstall
+	for _, store := range stores {
+		target := &TrustTarget{Name: store.Name()}
+		result.Targets = append(result.Targets, target)
+		if ctx.Err() != nil {
+			target.cancel(ctx.Err())
+			continue
+		}
+		installed, err := store.Contains(ctx, cert)
+		if err == nil && installed {
+			target.Outcome = TrustAlreadyPresent
+			continue
+		}
+		if IsCanceled(err) {
+			target.cancel(err)
+			continue
+		}
+		emitTrust(EventTrustCheckFailed, cert, "", store.Name(), err)
+		if errors.Is(err, ErrNotSupported) || errors.Is(err, ErrTrustToolMissing) {
+			target.Outcome = TrustSkipped
+			target.Reason = err.Error()
+			continue
+		}
+		pending = append(pending, &pendingInstall{store: store, target: target})
+	}
+	return pending
+}
+
+// installTrustedRoot adds the certificate to each of the pending TrustStores,
+// which are known not to contain it, recording the outcomes.
+func (cert *Certificate) installTrustedRoot(ctx context.Context, pending []*pendingInstall, opts *TrustOptions) {
+	if opts == nil {
+		opts = &TrustOptions{}
+	}
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			p.target.cancel(ctx.Err())
+			continue
+		}
+		err := cert.installTrustedRootIn(ctx, p.store, opts)
+		switch {
+		case err == nil:
+			p.target.Outcome = TrustInstalled
+		case IsCanceled(err):
+			p.target.cancel(err)
+		default:
+			p.target.Outcome = TrustFailed
+			p.target.Err = err
+		}
+	}
+}
+
+func (cert *Certificate) installTrustedRootIn(ctx context.Context, store TrustStore, opts *TrustOptions) error {
+	attempted := func(err error) {
+		if opts.InstallAttempted != nil {
+			opts.InstallAttempted(err)
+		}
+	}
+	stale, err := cert.rootsToReplaceIn(ctx, store, opts)
+	if err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		if err := cert.removeStaleRootsFrom(ctx, store, stale); err != nil {
+			attempted(err)
+			return err
+		}
+	}
+	err = store.Add(ctx, cert)
+	emitTrust(EventTrustInstalled, cert, "", store.Name(), err)
+	attempted(err)
+	return err
+}
+
+// rootsToReplaceIn determines which stale certificates need to be removed
+// from the given TrustStore before installing the certificate, according to
+// the ReplacePolicy. It fails with ErrStaleRoot if there are stale
+// certificates that mustn't be replaced.
+func (cert *Certificate) rootsToReplaceIn(ctx context.Context, store TrustStore, opts *TrustOptions) ([]*Certificate, error) {
+	if opts.Replace == KeepStale {
+		return nil, nil
+	}
+	stale, err := cert.staleRootsIn(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 && opts.Replace == RefuseStale {
+		return nil, &Error{Op: "install trusted root in", Path: store.Name(), Kind: ErrStaleRoot}
+	}
+	return stale, nil
+}
+
+// staleRootsIn finds the certificates in the given TrustStore that have the
+// same common name as cert but are different certificates.
+func (cert *Certificate) staleRootsIn(ctx context.Context, store TrustStore) ([]*Certificate, error) {
+	certs, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check %v for stale roots: %w", store.Name(), err)
+	}
+	commonName := cert.X509().Subject.CommonName
+	var stale []*Certificate
+	for _, c := range certs {
+		if c.X509().Subject.CommonName == commonName && !bytes.Equal(c.DER(), cert.DER()) {
+			stale = append(stale, c)
+		}
+	}
+	return stale, nil
+}
+
+// removeStaleRootsFrom removes the given stale roots from the TrustStore, one
+// at a time if it's a certRemover and otherwise all at once by common name.
+func (cert *Certificate) removeStaleRootsFrom(ctx context.Context, store TrustStore, stale []*Certificate) error {
+	if remover, ok := store.(certRemover); ok {
+		for _, c := range stale {
+			err := remover.removeCert(ctx, c)
+			emitTrust(EventTrustRemoved, c, "", store.Name(), err)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		commonName := cert.X509().Subject.CommonName
+		err := store.Remove(ctx, commonName)
+		emitTrust(EventTrustRemoved, nil, commonName, store.Name(), err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planStaleRootRemoval describes how removeStaleRootsFrom removes the given
+// stale roots from the TrustStore.
+func (cert *Certificate) planStaleRootRemoval(ctx context.Context, store TrustStore, stale []*Certificate) ([]*TrustAction, error) {
+	if remover, ok := store.(certRemover); ok {
+		var actions []*TrustAction
+		for _, c := range stale {
+			removal, err := remover.planRemoveCert(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, removal...)
+		}
+		return actions, nil
+	}
+	if planner, ok := store.(TrustPlanner); ok {
+		return planner.PlanRemove(cert.X509().Subject.CommonName)
+	}
+	return []*TrustAction{{Op: TrustActionRemove}}, nil
+}
+
+// DeleteTrustedRootByNameIn removes the root with the given common name from
+// each of the given TrustStores, attempting every one of them. The error, a
+// *TrustError, aggregates all failures.
+func DeleteTrustedRootByNameIn(ctx context.Context, stores []TrustStore, commonName string) error {
+	_, err := RemoveTrustedRoot(ctx, stores, commonName)
+	return err
+}
+
+// RemoveTrustedRoot is like DeleteTrustedRootByNameIn, but also returns the
+// outcome for each TrustStore: TrustRemoved, TrustSkipped if the TrustStore
+// isn't available, TrustFailed or TrustCanceled. Once the context is done, the
+// remaining TrustStores are marked as canceled.
+func RemoveTrustedRoot(ctx context.Context, stores []TrustStore, commonName string) (*TrustResult, error) {
+	result := &TrustResult{op: opRemove}
+	for _, store := range stores {
+		target := &TrustTarget{Name: store.Name()}
+		result.Targets = append(result.Targets, target)
+		if ctx.Err() != nil {
+			target.cancel(ctx.Err())
+			continue
+		}
+		err := store.Remove(ctx, commonName)
+		emitTrust(EventTrustRemoved, nil, commonName, store.Name(), err)
+		switch {
+		case err == nil:
+			target.Outcome = TrustRemoved
+		case IsCanceled(err):
+			target.cancel(err)
+		case errors.Is(err, ErrNotSupported) || errors.Is(err, ErrTrustToolMissing):
+			target.Outcome = TrustSkipped
+			target.Reason = err.Error()
+		default:
+			target.Outcome = TrustFailed
+			target.Err = err
+		}
+	}
+	return result, result.Err()
+}
+
+// containsCert checks whether certs include one with the same DER encoding as
+// cert.
+func containsCert(certs []*Certificate, cert *Certificate) bool {
+	for _, c := range certs {
+		if bytes.Equal(c.DER(), cert.DER()) {
+			return true
+		}
+	}
+	return false
+}
+
+/*******************************************************************************
+ * Fake Trust Store
+ ******************************************************************************/
+
+// FakeTrustStore is a TrustStore kept in memory, for use in tests.
+type FakeTrustStore struct {
+	name  string
+	certs []*Certificate
+	mx    sync.Mutex
+
+	// Err, if set, is returned by Add and Remove.
+	Err error
+}
+
+// NewFakeTrustStore constructs an empty FakeTrustStore with the given name.
+func NewFakeTrustStore(name string) *FakeTrustStore {
+	return &FakeTrustStore{name: name}
+}
+
+func (s *FakeTrustStore) Name() string {
+	return s.name
+}
+
+func (s *FakeTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]*Certificate(nil), s.certs...), nil
+}
+
+func (s *FakeTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return containsCert(s.certs, cert), nil
+}
+
+func (s *FakeTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	if !containsCert(s.certs, cert) {
+		s.certs = append(s.certs, cert)
+	}
+	return nil
+}
+
+func (s *FakeTrustStore) Remove(ctx context.Context, commonName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	kept := s.certs[:0]
+	for _, cert := range s.certs {
+		if cert.X509().Subject.CommonName != commonName {
+			kept = append(kept, cert)
+		}
+	}
+	s.certs = kept
+	return nil
+}
@@ -0,0 +1,123 @@
+package keyman
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// WindowsTrustStore is a TrustStore kept in a Windows system certificate
+// store, managed with certimporter.exe.
+type WindowsTrustStore struct {
+	// StoreName is the name of the certificate store, e.g. ROOT
+	StoreName string
+	// Prompt will be displayed when asking for admin permissions
+	Prompt string
+	// Importer is the path of certimporter.exe, defaults to the bundled one
+	Importer string
+	// Runner runs certimporter.exe, defaults to DefaultRunner
+	Runner Runner
+}
+
+// NewWindowsTrustStore constructs a WindowsTrustStore for the named system
+// certificate store.
+func NewWindowsTrustStore(storeName string, prompt string) *WindowsTrustStore {
+	return &WindowsTrustStore{StoreName: storeName, Prompt: prompt}
+}
+
+func (s *WindowsTrustStore) Name() string {
+	return "windows:" + s.StoreName
+}
+
+// List enumerates the certificate store using crypt32. The store is opened
+// for the current user, which includes the certificates of the local machine.
+// Listing fails with ErrNotSupported on other platforms.
+func (s *WindowsTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	return listCertStore(s.StoreName)
+}
+
+// Contains checks whether the exact certificate is in the store.
+func (s *WindowsTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	certs, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	return containsCert(certs, cert), nil
+}
+
+func (s *WindowsTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	// Create a temp file containing the certificate
+	tempFile, err := ioutil.TempFile("", "tempCert")
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	err = cert.WriteToDERFile(tempFile.Name())
+	if err != nil {
+		return fmt.Errorf("Unable to save certificate to temp file: %w", err)
+	}
+
+	// Add it as a trusted cert
+	out, err := runnerOr(s.Runner).Run(ctx, s.addCommand(tempFile.Name()))
+	if err != nil {
+		return trustCommandError("certimporter.exe", err, out)
+	}
+	return nil
+}
+
+func (s *WindowsTrustStore) Remove(ctx context.Context, commonName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.containsName(ctx, commonName) {
+		return nil
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCommand(commonName))
+	if err != nil {
+		return trustCommandError("certimporter.exe", err, out)
+	}
+	return nil
+}
+
+func (s *WindowsTrustStore) containsName(ctx context.Context, commonName string) bool {
+	// TODO: make sure that passing byte strings of various encodings to the
+	// certimporter program works in different languages/different usernames (
+	// which end up in the temp path, etc.)
+	_, err := runnerOr(s.Runner).Run(ctx, s.command("", "find", s.StoreName, commonName))
+
+	// Consider the certificate found if and only if certimporter.exe exited
+	// with a 0 exit code.  Any non-zero code (cert not found, or error looking
+	// for cert) is treated as the cert not being found.
+	return err == nil
+}
+
+// PlanAdd describes the certimporter.exe command run by Add.
+func (s *WindowsTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionAdd, s.addCommand(PlannedCertFile))}, nil
+}
+
+// PlanRemove describes the certimporter.exe command run by Remove.
+func (s *WindowsTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCommand(commonName))}, nil
+}
+
+// addCommand adds the DER encoded certificate in the given file.
+func (s *WindowsTrustStore) addCommand(certFile string) *Command {
+	return s.command(s.Prompt, "add", s.StoreName, certFile)
+}
+
+func (s *WindowsTrustStore) removeCommand(commonName string) *Command {
+	return s.command(s.Prompt, "delete", s.StoreName, commonName)
+}
+
+// command constructs a certimporter.exe command, elevated with the given
+// prompt if it's not empty.
+func (s *WindowsTrustStore) command(prompt string, args ...string) *Command {
+	importer := s.Importer
+	if importer == "" {
+		importer = certimporterPath()
+	}
+	return &Command{Name: importer, Args: args, Prompt: prompt}
+}
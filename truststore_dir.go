@@ -0,0 +1,110 @@
+package keyman
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DirTrustStore is a TrustStore kept as a directory of PEM files, one per
+// certificate, like the directories used by OpenSSL's -CApath or Go's
+// SSL_CERT_DIR.
+type DirTrustStore struct {
+	Dir string
+}
+
+// NewDirTrustStore constructs a DirTrustStore in the given directory, which is
+// created when the first certificate is added.
+func NewDirTrustStore(dir string) *DirTrustStore {
+	return &DirTrustStore{Dir: dir}
+}
+
+// DirTrustStoreBackend constructs a TrustStoreBackend for the DirTrustStore in
+// the given directory, for registering with RegisterTrustStoreBackend.
+func DirTrustStoreBackend(dir string) TrustStoreBackend {
+	return StaticTrustStoreBackend(NewDirTrustStore(dir))
+}
+
+func (s *DirTrustStore) Name() string {
+	return "dir:" + s.Dir
+}
+
+func (s *DirTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to list %s: %w", s.Dir, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var certs []*Certificate
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		found, err := LoadCertificatesFromPEMBytes(data)
+		if err != nil {
+			log.Debugf("Skipping %s in trust store: %v", entry.Name(), err)
+			continue
+		}
+		certs = append(certs, found...)
+	}
+	return certs, nil
+}
+
+func (s *DirTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	certs, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	return containsCert(certs, cert), nil
+}
+
+func (s *DirTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create trust store directory %s: %w", s.Dir, err)
+	}
+	return writeFileAtomic(s.file(cert.X509().Subject.CommonName), cert.PEMEncoded(), 0644)
+}
+
+func (s *DirTrustStore) Remove(ctx context.Context, commonName string) error {
+	err := os.Remove(s.file(commonName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove %s from trust store: %w", commonName, err)
+	}
+	return nil
+}
+
+// PlanAdd describes the file written by Add.
+func (s *DirTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	return []*TrustAction{fileAction(TrustActionAdd, s.file(cert.X509().Subject.CommonName))}, nil
+}
+
+// PlanRemove describes the file removed by Remove.
+func (s *DirTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	return []*TrustAction{fileAction(TrustActionRemove, s.file(commonName))}, nil
+}
+
+func (s *DirTrustStore) file(commonName string) string {
+	return filepath.Join(s.Dir, safeFileName(commonName)+".pem")
+}
+
+// safeFileName replaces characters that aren't safe in file names.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,162 @@
+package keyman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultJavaKeystorePassword is the JDK's default password for cacerts
+	DefaultJavaKeystorePassword = "changeit"
+
+	// javaStorePassEnv is the environment variable keytool reads the keystore
+	// password from
+	javaStorePassEnv = "KEYMAN_STOREPASS"
+)
+
+func init() {
+	RegisterTrustStoreBackend("java", func(prompt string) ([]TrustStore, error) {
+		if _, err := DefaultRunner.LookPath("keytool"); err != nil {
+			return nil, nil
+		}
+		return []TrustStore{NewJavaTrustStore("", "", prompt)}, nil
+	})
+}
+
+// JavaTrustStore is a TrustStore kept in a Java keystore, by default the JDK's
+// cacerts, which Java applications use instead of the system trust store. It's
+// managed with keytool, which needs to be installed.
+type JavaTrustStore struct {
+	// Keystore is the keystore file, "" for the JDK's cacerts
+	Keystore string
+	// Password is the keystore's password, defaults to
+	// DefaultJavaKeystorePassword
+	Password string
+	// Prompt, if set, is used when elevating privileges to modify the
+	// keystore.
+	Prompt string
+	// Runner runs keytool, defaults to DefaultRunner
+	Runner Runner
+}
+
+// NewJavaTrustStore constructs a JavaTrustStore for the given keystore ("" for
+// the JDK's cacerts) and password ("" for the default).
+func NewJavaTrustStore(keystore string, password string, prompt string) *JavaTrustStore {
+	return &JavaTrustStore{Keystore: keystore, Password: password, Prompt: prompt}
+}
+
+func (s *JavaTrustStore) Name() string {
+	if s.Keystore == "" {
+		return "java:cacerts"
+	}
+	return "java:" + s.Keystore
+}
+
+func (s *JavaTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	out, err := runnerOr(s.Runner).Run(ctx, s.command("", "-list", "-rfc"))
+	if err != nil {
+		return nil, trustCommandError("keytool", err, out)
+	}
+	if !bytes.Contains(out, []byte("-----BEGIN")) {
+		return nil, nil
+	}
+	return LoadCertificatesFromPEMBytes(out)
+}
+
+func (s *JavaTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	certs, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	return containsCert(certs, cert), nil
+}
+
+func (s *JavaTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	tempFileName, err := cert.WriteToTempFile()
+	defer func() {
+		if err := os.Remove(tempFileName); err != nil {
+			log.Debugf("Unable to remove file: %v", err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.addCommand(cert.X509().Subject.CommonName, tempFileName))
+	if err != nil {
+		return trustCommandError("keytool", err, out)
+	}
+	return nil
+}
+
+func (s *JavaTrustStore) Remove(ctx context.Context, commonName string) error {
+	found, err := s.hasAlias(ctx, javaAlias(commonName))
+	if err != nil || !found {
+		return err
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCommand(commonName))
+	if err != nil {
+		return trustCommandError("keytool", err, out)
+	}
+	return nil
+}
+
+// hasAlias checks whether the keystore has an entry with the given alias.
+// keytool fails the same way for a missing alias as for a keystore it can't
+// read, so the keystore is listed first to tell them apart.
+func (s *JavaTrustStore) hasAlias(ctx context.Context, alias string) (bool, error) {
+	runner := runnerOr(s.Runner)
+	if out, err := runner.Run(ctx, s.command("", "-list")); err != nil {
+		return false, trustCommandError("keytool", err, out)
+	}
+	out, err := runner.Run(ctx, s.command("", "-list", "-alias", alias))
+	if err != nil && (IsCanceled(err) || errors.Is(err, ErrTimeout)) {
+		return false, trustCommandError("keytool", err, out)
+	}
+	return err == nil, nil
+}
+
+// PlanAdd describes the keytool command run by Add.
+func (s *JavaTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionAdd, s.addCommand(cert.X509().Subject.CommonName, PlannedCertFile))}, nil
+}
+
+// PlanRemove describes the keytool command run by Remove.
+func (s *JavaTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCommand(commonName))}, nil
+}
+
+func (s *JavaTrustStore) addCommand(commonName string, certFile string) *Command {
+	return s.command(s.Prompt, "-importcert", "-noprompt", "-trustcacerts", "-alias", javaAlias(commonName), "-file", certFile)
+}
+
+func (s *JavaTrustStore) removeCommand(commonName string) *Command {
+	return s.command(s.Prompt, "-delete", "-alias", javaAlias(commonName))
+}
+
+// command builds a keytool command with the given arguments, selecting this
+// keystore. The keystore password is passed in the command's environment
+// rather than its arguments, so that it can't be seen by other users, audited
+// or shown in plans.
+func (s *JavaTrustStore) command(prompt string, command ...string) *Command {
+	args := append([]string(nil), command...)
+	if s.Keystore == "" {
+		args = append(args, "-cacerts")
+	} else {
+		args = append(args, "-keystore", s.Keystore)
+	}
+	password := s.Password
+	if password == "" {
+		password = DefaultJavaKeystorePassword
+	}
+	args = append(args, "-storepass:env", javaStorePassEnv)
+	return &Command{Name: "keytool", Args: args, Prompt: prompt, Env: []string{javaStorePassEnv + "=" + password}}
+}
+
+// javaAlias determines the keystore alias for the given common name. Aliases
+// are case insensitive.
+func javaAlias(commonName string) string {
+	return "keyman-" + strings.ToLower(safeFileName(commonName))
+}
@@ -0,0 +1,170 @@
+package keyman
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// KeychainTrustStore is a TrustStore kept in a macOS keychain, managed with the
+// security command.
+type KeychainTrustStore struct {
+	Keychain string
+	// Prompt will be displayed when asking for admin permissions
+	Prompt string
+	// Runner runs security, defaults to DefaultRunner
+	Runner Runner
+}
+
+// NewKeychainTrustStore constructs a KeychainTrustStore for the given keychain.
+func NewKeychainTrustStore(keychain string, prompt string) *KeychainTrustStore {
+	return &KeychainTrustStore{Keychain: keychain, Prompt: prompt}
+}
+
+func (s *KeychainTrustStore) Name() string {
+	return "keychain:" + s.Keychain
+}
+
+func (s *KeychainTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	out, err := s.security(ctx, "", "find-certificate", "-a", "-p", s.Keychain)
+	if err != nil {
+		return nil, trustCommandError("security", err, out)
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return LoadCertificatesFromPEMBytes(out)
+}
+
+// Contains checks whether the exact certificate is in the keychain, or
+// verifies as trusted anyway.
+func (s *KeychainTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	out, err := s.security(ctx, "", "find-certificate", "-a", "-p", "-c", cert.X509().Subject.CommonName, s.Keychain)
+	if IsCanceled(err) {
+		return false, err
+	}
+	if err == nil && len(out) > 0 {
+		certs, err := LoadCertificatesFromPEMBytes(out)
+		if err != nil {
+			return false, err
+		}
+		if containsCert(certs, cert) {
+			return true, nil
+		}
+	}
+	tempFileName, err := cert.WriteToTempFile()
+	defer func() {
+		if err := os.Remove(tempFileName); err != nil {
+			log.Debugf("Unable to remove file: %v", err)
+		}
+	}()
+	if err != nil {
+		return false, err
+	}
+	// If the certificate verifies successfully it's already a trusted root
+	_, err = runnerOr(s.Runner).Run(ctx, s.verifyCommand(tempFileName))
+	if IsCanceled(err) {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+func (s *KeychainTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	tempFileName, err := cert.WriteToTempFile()
+	defer func() {
+		if err := os.Remove(tempFileName); err != nil {
+			log.Debugf("Unable to remove file: %v", err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Add it as a trusted cert
+	out, err := runnerOr(s.Runner).Run(ctx, s.addCommand(tempFileName))
+	if err != nil {
+		return trustCommandError("security", err, out)
+	}
+
+	out, err = runnerOr(s.Runner).Run(ctx, s.verifyCommand(tempFileName))
+	log.Debugf("%v: %v", out, err)
+	if err != nil {
+		emitTrust(EventTrustCheckFailed, cert, "", s.Name(), trustCommandError("security", err, out))
+	}
+	return nil
+}
+
+func (s *KeychainTrustStore) Remove(ctx context.Context, commonName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.containsName(ctx, commonName) {
+		return nil
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCommand(commonName))
+	if err != nil {
+		return trustCommandError("security", err, out)
+	}
+	return nil
+}
+
+// PlanAdd describes the security commands run by Add, which verifies the
+// certificate after adding it.
+func (s *KeychainTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	return []*TrustAction{
+		commandAction(TrustActionAdd, s.addCommand(PlannedCertFile)),
+		commandAction(TrustActionVerify, s.verifyCommand(PlannedCertFile)),
+	}, nil
+}
+
+// PlanRemove describes the security command run by Remove.
+func (s *KeychainTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCommand(commonName))}, nil
+}
+
+func (s *KeychainTrustStore) addCommand(certFile string) *Command {
+	return &Command{Name: "security", Args: []string{"add-trusted-cert", "-d", "-k", s.Keychain, certFile}, Prompt: s.Prompt}
+}
+
+// verifyCommand succeeds if the certificate in the given file is trusted.
+func (s *KeychainTrustStore) verifyCommand(certFile string) *Command {
+	return &Command{Name: "security", Args: []string{"verify-cert", "-c", certFile}}
+}
+
+func (s *KeychainTrustStore) removeCommand(commonName string) *Command {
+	return &Command{Name: "security", Args: []string{"delete-certificate", "-c", commonName, s.Keychain}, Prompt: s.Prompt}
+}
+
+// removeCert removes the given certificate by its SHA-1 hash, since removing
+// by common name only removes one of several certificates with that name.
+func (s *KeychainTrustStore) removeCert(ctx context.Context, cert *Certificate) error {
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCertCommand(cert))
+	if err != nil {
+		return trustCommandError("security", err, out)
+	}
+	return nil
+}
+
+func (s *KeychainTrustStore) planRemoveCert(ctx context.Context, cert *Certificate) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCertCommand(cert))}, nil
+}
+
+func (s *KeychainTrustStore) removeCertCommand(cert *Certificate) *Command {
+	sum := sha1.Sum(cert.DER())
+	return &Command{Name: "security", Args: []string{"delete-certificate", "-Z", strings.ToUpper(hex.EncodeToString(sum[:])), s.Keychain}, Prompt: s.Prompt}
+}
+
+// containsName checks whether there are one or more certs in the keychain
+// whose common name matches the given one.
+func (s *KeychainTrustStore) containsName(ctx context.Context, commonName string) bool {
+	_, err := s.security(ctx, "", "find-certificate", "-c", commonName, s.Keychain)
+	return err == nil
+}
+
+// security runs the security command, elevating with the given prompt if it's
+// not empty.
+func (s *KeychainTrustStore) security(ctx context.Context, prompt string, args ...string) ([]byte, error) {
+	return runnerOr(s.Runner).Run(ctx, &Command{Name: "security", Args: args, Prompt: prompt})
+}
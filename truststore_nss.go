@@ -0,0 +1,343 @@
+package keyman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// certutilListLine matches a line of certutil -L output, which lists a
+	// nickname followed by its trust attributes, e.g. "My CA    C,,"
+	certutilListLine = regexp.MustCompile(`^(.*?)\s+(\S*,\S*,\S*)$`)
+)
+
+// NSSTrustStore is a TrustStore kept in an NSS database, as used by Firefox,
+// Chrome on Linux and other Mozilla based applications. SQLite databases
+// ("sql:") are read directly, but certutil needs to be installed to modify
+// them and to read legacy ("dbm:") databases.
+type NSSTrustStore struct {
+	// DB is the database directory including its type, e.g.
+	// "sql:/home/user/.pki/nssdb"
+	DB string
+
+	// CreateIfMissing creates an empty SQLite database, accessible only by the
+	// current user, when adding a certificate to a database that doesn't exist
+	// yet. Until then, the database is treated as empty.
+	CreateIfMissing bool
+
+	// Runner runs certutil, defaults to DefaultRunner
+	Runner Runner
+}
+
+// NewNSSTrustStore constructs an NSSTrustStore for the given database.
+func NewNSSTrustStore(db string) *NSSTrustStore {
+	return &NSSTrustStore{DB: db}
+}
+
+func (s *NSSTrustStore) Name() string {
+	return "nss:" + s.DB
+}
+
+func (s *NSSTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	if s.pendingCreation() {
+		return nil, nil
+	}
+	if s.isSQL() {
+		entries, err := ReadNSSCertDB(s.DB)
+		if err != nil {
+			return nil, err
+		}
+		certs := make([]*Certificate, 0, len(entries))
+		for _, entry := range entries {
+			certs = append(certs, entry.Certificate)
+		}
+		return certs, nil
+	}
+
+	entries, err := s.listWithCertutil(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*Certificate
+	for _, entry := range entries {
+		certs = append(certs, entry.Certificate)
+	}
+	return certs, nil
+}
+
+// listWithCertutil lists the certificates in the database along with their
+// nicknames using certutil. Trust attributes aren't included.
+func (s *NSSTrustStore) listWithCertutil(ctx context.Context) ([]*NSSCertificate, error) {
+	out, err := s.certutil(ctx, "-d", s.DB, "-L")
+	if err != nil {
+		return nil, trustCommandError("certutil", err, out)
+	}
+	var entries []*NSSCertificate
+	for _, nickname := range parseCertutilNicknames(out) {
+		out, err := s.certutil(ctx, "-d", s.DB, "-L", "-n", nickname, "-a")
+		if err != nil {
+			return nil, trustCommandError("certutil", err, out)
+		}
+		found, err := LoadCertificatesFromPEMBytes(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range found {
+			entries = append(entries, &NSSCertificate{Nickname: nickname, Certificate: cert})
+		}
+	}
+	return entries, nil
+}
+
+// Contains checks whether the exact certificate is installed under its common
+// name, which is the nickname that Add installs it under. In SQLite databases
+// it also needs to be trusted as a CA for SSL.
+func (s *NSSTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	if s.pendingCreation() {
+		return false, nil
+	}
+	if s.isSQL() {
+		entries, err := ReadNSSCertDB(s.DB)
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			if entry.Trust.TrustedCA() && bytes.Equal(entry.Certificate.DER(), cert.DER()) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	out, err := s.certutil(ctx, "-d", s.DB, "-L", "-n", cert.X509().Subject.CommonName, "-a")
+	if IsCanceled(err) {
+		return false, err
+	} else if err != nil {
+		// certutil fails if there's no certificate with the nickname
+		return false, nil
+	}
+	certs, err := LoadCertificatesFromPEMBytes(out)
+	if err != nil {
+		return false, err
+	}
+	return containsCert(certs, cert), nil
+}
+
+func (s *NSSTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	if s.pendingCreation() {
+		if err := createNSSDB(ctx, runnerOr(s.Runner), s.dir()); err != nil {
+			return err
+		}
+	}
+	tempFileName, err := cert.WriteToTempFile()
+	defer func() {
+		if err := os.Remove(tempFileName); err != nil {
+			log.Debugf("Unable to remove file: %v", err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	// Add it as a trusted cert
+	out, err := runnerOr(s.Runner).Run(ctx, s.addCommand(cert.X509().Subject.CommonName, tempFileName))
+	if err != nil {
+		return trustCommandError("certutil", err, out)
+	}
+	return nil
+}
+
+func (s *NSSTrustStore) Remove(ctx context.Context, commonName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.containsName(ctx, commonName) {
+		return nil
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCommand(commonName))
+	if err != nil {
+		return trustCommandError("certutil", err, out)
+	}
+	return nil
+}
+
+func (s *NSSTrustStore) containsName(ctx context.Context, nickname string) bool {
+	if s.pendingCreation() {
+		return false
+	}
+	if s.isSQL() {
+		entries, err := ReadNSSCertDB(s.DB)
+		if err == nil {
+			for _, entry := range entries {
+				if entry.Nickname == nickname {
+					return true
+				}
+			}
+			return false
+		}
+		log.Debugf("Falling back to certutil: %v", err)
+	}
+	_, err := s.certutil(ctx, "-d", s.DB, "-L", "-n", nickname)
+	return err == nil
+}
+
+// isSQL determines whether the database is SQLite based, and can be read
+// without certutil.
+func (s *NSSTrustStore) isSQL() bool {
+	return strings.HasPrefix(s.DB, "sql:")
+}
+
+func (s *NSSTrustStore) certutil(ctx context.Context, args ...string) ([]byte, error) {
+	return runnerOr(s.Runner).Run(ctx, &Command{Name: "certutil", Args: args})
+}
+
+// PlanAdd describes the certutil commands run by Add, including creating the
+// database if it's missing and CreateIfMissing is set.
+func (s *NSSTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	var actions []*TrustAction
+	if s.pendingCreation() {
+		actions = append(actions, commandAction(TrustActionCreate, createNSSDBCommand(s.dir())))
+	}
+	return append(actions, commandAction(TrustActionAdd, s.addCommand(cert.X509().Subject.CommonName, PlannedCertFile))), nil
+}
+
+// PlanRemove describes the certutil command run by Remove.
+func (s *NSSTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCommand(commonName))}, nil
+}
+
+// addCommand adds the certificate in the given file as a trusted CA.
+// https://code.google.com/p/chromium/wiki/LinuxCertManagement#Add_a_certificate
+func (s *NSSTrustStore) addCommand(nickname string, certFile string) *Command {
+	return &Command{Name: "certutil", Args: []string{"-d", s.DB, "-A", "-t", "C,,", "-n", nickname, "-i", certFile}}
+}
+
+func (s *NSSTrustStore) removeCommand(nickname string) *Command {
+	return &Command{Name: "certutil", Args: []string{"-d", s.DB, "-D", "-n", nickname}}
+}
+
+// removeCert removes the given certificate using the nickname it's listed
+// under. certutil deletes one certificate with the nickname at a time, so
+// this is done once for each stale certificate.
+func (s *NSSTrustStore) removeCert(ctx context.Context, cert *Certificate) error {
+	nickname, err := s.nicknameOf(ctx, cert)
+	if err != nil || nickname == "" {
+		return err
+	}
+	out, err := runnerOr(s.Runner).Run(ctx, s.removeCommand(nickname))
+	if err != nil {
+		return trustCommandError("certutil", err, out)
+	}
+	return nil
+}
+
+func (s *NSSTrustStore) planRemoveCert(ctx context.Context, cert *Certificate) ([]*TrustAction, error) {
+	nickname, err := s.nicknameOf(ctx, cert)
+	if err != nil || nickname == "" {
+		return nil, err
+	}
+	return []*TrustAction{commandAction(TrustActionRemove, s.removeCommand(nickname))}, nil
+}
+
+// nicknameOf finds the nickname of the given certificate in the database, ""
+// if it isn't there.
+func (s *NSSTrustStore) nicknameOf(ctx context.Context, cert *Certificate) (string, error) {
+	if s.pendingCreation() {
+		return "", nil
+	}
+	var entries []*NSSCertificate
+	var err error
+	if s.isSQL() {
+		entries, err = ReadNSSCertDB(s.DB)
+	} else {
+		entries, err = s.listWithCertutil(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if bytes.Equal(entry.Certificate.DER(), cert.DER()) {
+			return entry.Nickname, nil
+		}
+	}
+	return "", nil
+}
+
+// pendingCreation determines whether the database still needs to be created
+// before adding certificates to it.
+func (s *NSSTrustStore) pendingCreation() bool {
+	return s.CreateIfMissing && s.isSQL() && !pathIsFile(filepath.Join(s.dir(), "cert9.db"))
+}
+
+// dir returns the directory of the database.
+func (s *NSSTrustStore) dir() string {
+	return strings.TrimPrefix(strings.TrimPrefix(s.DB, "sql:"), "dbm:")
+}
+
+// missingDirs lists the given directory and those of its parents that don't
+// exist yet, deepest first.
+func missingDirs(dir string) []string {
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			return missing
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			return missing
+		}
+	}
+}
+
+// createNSSDB initializes an empty SQLite NSS database without a password in
+// the given directory. The directory and database files are only accessible by
+// the current user, like when they're created by Chrome.
+func createNSSDB(ctx context.Context, runner Runner, dir string) error {
+	created := missingDirs(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Unable to create NSS database directory %s: %w", dir, err)
+	}
+	out, err := runner.Run(ctx, createNSSDBCommand(dir))
+	if err != nil {
+		// Don't leave empty directories that we created behind
+		for _, d := range created {
+			if err := os.Remove(d); err != nil {
+				log.Debugf("Unable to remove %v: %v", d, err)
+				break
+			}
+		}
+		return trustCommandError("certutil", err, out)
+	}
+	for _, name := range []string{"cert9.db", "key4.db", "pkcs11.txt"} {
+		if err := os.Chmod(filepath.Join(dir, name), 0600); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to restrict permissions of NSS database: %w", err)
+		}
+	}
+	return nil
+}
+
+func createNSSDBCommand(dir string) *Command {
+	return &Command{Name: "certutil", Args: []string{"-d", "sql:" + dir, "-N", "--empty-password"}}
+}
+
+// parseCertutilNicknames parses the nicknames out of the output of
+// certutil -L.
+func parseCertutilNicknames(out []byte) []string {
+	var nicknames []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if strings.HasPrefix(line, "Certificate Nickname") || strings.HasSuffix(line, "SSL,S/MIME,JAR/XPI") {
+			continue
+		}
+		if match := certutilListLine.FindStringSubmatch(line); match != nil && match[1] != "" {
+			nicknames = append(nicknames, match[1])
+		}
+	}
+	return nicknames
+}
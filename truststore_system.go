@@ -0,0 +1,440 @@
+package keyman
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// systemAnchorPrefix prefixes the names of anchor files installed by
+	// keyman, so they're recognizable among other anchors.
+	systemAnchorPrefix = "keyman-"
+
+	// p11KitExtension is the extension of the files in which p11-kit's trust
+	// anchor command stores anchors.
+	p11KitExtension = ".p11-kit"
+)
+
+var (
+	// SystemTrustLayouts are the system trust store layouts recognized by
+	// SystemTrustStore, in order of detection.
+	SystemTrustLayouts = []*SystemTrustLayout{
+		{
+			Name:      "fedora",
+			AnchorDir: "/etc/pki/ca-trust/source/anchors",
+			P11KitDir: "/etc/pki/ca-trust/source",
+			Extension: ".pem",
+			UpdateCommands: [][]string{
+				{"update-ca-trust", "extract"},
+				{"trust", "extract-compat"},
+			},
+		},
+		{
+			Name:      "arch",
+			AnchorDir: "/etc/ca-certificates/trust-source/anchors",
+			P11KitDir: "/etc/ca-certificates/trust-source",
+			Extension: ".pem",
+			UpdateCommands: [][]string{
+				{"update-ca-trust", "extract"},
+				{"trust", "extract-compat"},
+			},
+		},
+		{
+			Name:      "debian",
+			AnchorDir: "/usr/local/share/ca-certificates",
+			// update-ca-certificates only picks up files ending in .crt
+			Extension: ".crt",
+			UpdateCommands: [][]string{
+				{"update-ca-certificates"},
+			},
+		},
+	}
+)
+
+// SystemTrustLayout describes where a Linux distribution keeps locally added
+// trust anchors and how to rebuild its system-wide CA bundle from them.
+type SystemTrustLayout struct {
+	Name      string
+	AnchorDir string
+	// P11KitDir is where p11-kit's trust anchor command stores anchors, for
+	// layouts managed by p11-kit.
+	P11KitDir string
+	Extension string
+	// UpdateCommands are alternative commands that rebuild the bundle. The
+	// first one that's installed is used.
+	UpdateCommands [][]string
+}
+
+// SystemTrustStore installs trusted roots in a Linux distribution's
+// system-wide trust store, which is used by OpenSSL, GnuTLS, curl, Go, Python
+// and most command line tools. Debian-style (update-ca-certificates) and
+// Fedora/Arch-style (update-ca-trust/p11-kit) layouts are supported.
+//
+// On p11-kit layouts, anchors are stored and removed with trust anchor if the
+// trust tool is installed, which also rebuilds the extracted bundles.
+// Otherwise, anchors are copied to the layout's AnchorDir and the bundle is
+// rebuilt with the layout's UpdateCommands.
+type SystemTrustStore struct {
+	// Root is the root of the filesystem containing the trust store, defaults
+	// to "/". The host's tools only manage the host's trust store, so under
+	// any other Root, anchors are copied into the AnchorDir there and the
+	// bundle isn't rebuilt; run the update command within that root (e.g. in
+	// a chroot) to rebuild it.
+	Root string
+
+	// Prompt, if set, is used when elevating privileges to modify the trust
+	// store. Without a Prompt, the trust store is modified with the current
+	// privileges.
+	Prompt string
+
+	// Runner runs the update commands, defaults to DefaultRunner
+	Runner Runner
+}
+
+// NewSystemTrustStore constructs a SystemTrustStore for the filesystem at the
+// given root ("" for "/"), elevating with the given prompt.
+func NewSystemTrustStore(root string, prompt string) *SystemTrustStore {
+	return &SystemTrustStore{Root: root, Prompt: prompt}
+}
+
+func (s *SystemTrustStore) Name() string {
+	if s.Root == "" {
+		return "system"
+	}
+	return "system:" + s.Root
+}
+
+// List returns the locally added anchors, including those not added by
+// keyman.
+func (s *SystemTrustStore) List(ctx context.Context) ([]*Certificate, error) {
+	layout, err := s.Layout()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := NewDirTrustStore(s.path(layout.AnchorDir)).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.p11KitAnchors(layout)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range stored {
+		certs = append(certs, file.certs...)
+	}
+	return certs, nil
+}
+
+// Layout detects the layout of the system trust store. It fails with
+// ErrTrustToolMissing if none of the SystemTrustLayouts are present.
+func (s *SystemTrustStore) Layout() (*SystemTrustLayout, error) {
+	for _, layout := range SystemTrustLayouts {
+		if stat, err := os.Stat(s.path(layout.AnchorDir)); err == nil && stat.IsDir() {
+			return layout, nil
+		}
+	}
+	return nil, &Error{Op: "find system trust store in", Path: s.path("/"), Kind: ErrTrustToolMissing}
+}
+
+// Contains checks whether the given certificate is installed as an anchor.
+func (s *SystemTrustStore) Contains(ctx context.Context, cert *Certificate) (bool, error) {
+	certs, err := s.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	return containsCert(certs, cert), nil
+}
+
+// Add installs the given certificate as an anchor and rebuilds the system
+// CA bundle.
+func (s *SystemTrustStore) Add(ctx context.Context, cert *Certificate) error {
+	layout, err := s.Layout()
+	if err != nil {
+		return err
+	}
+	if s.usesP11Kit(layout) {
+		tempFileName, err := cert.WriteToTempFile()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(tempFileName); err != nil {
+				log.Debugf("Unable to remove file: %v", err)
+			}
+		}()
+		return s.run(ctx, s.storeCommand(tempFileName))
+	}
+	anchor := s.path(s.anchorFile(layout, cert.X509().Subject.CommonName))
+	if s.elevate() {
+		tempFileName, err := cert.WriteToTempFile()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(tempFileName); err != nil {
+				log.Debugf("Unable to remove file: %v", err)
+			}
+		}()
+		if err := s.run(ctx, s.installCommand(tempFileName, anchor)); err != nil {
+			return err
+		}
+	} else if err := writeFileAtomic(anchor, cert.PEMEncoded(), 0644); err != nil {
+		return err
+	}
+	return s.update(ctx, layout)
+}
+
+// Remove removes the anchors installed for the given common name, if any, and
+// rebuilds the system CA bundle.
+func (s *SystemTrustStore) Remove(ctx context.Context, commonName string) error {
+	layout, err := s.Layout()
+	if err != nil {
+		return err
+	}
+	if s.usesP11Kit(layout) {
+		stored, err := s.p11KitAnchorsFor(layout, commonName)
+		if err != nil {
+			return err
+		}
+		for _, file := range stored {
+			if err := s.run(ctx, s.unstoreCommand(file)); err != nil {
+				return err
+			}
+		}
+	}
+	anchor := s.path(s.anchorFile(layout, commonName))
+	if _, err := os.Stat(anchor); os.IsNotExist(err) {
+		return nil
+	}
+	if s.elevate() {
+		if err := s.run(ctx, s.removeCommand(anchor)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(anchor); err != nil {
+		return fmt.Errorf("Unable to remove %s: %w", anchor, err)
+	}
+	return s.update(ctx, layout)
+}
+
+// PlanAdd describes how Add installs the anchor, with a command if privileges
+// need to be elevated, and the command that rebuilds the system CA bundle.
+func (s *SystemTrustStore) PlanAdd(cert *Certificate) ([]*TrustAction, error) {
+	layout, err := s.Layout()
+	if err != nil {
+		return nil, err
+	}
+	if s.usesP11Kit(layout) {
+		return []*TrustAction{commandAction(TrustActionAdd, s.storeCommand(PlannedCertFile))}, nil
+	}
+	anchor := s.path(s.anchorFile(layout, cert.X509().Subject.CommonName))
+	action := fileAction(TrustActionAdd, anchor)
+	if s.elevate() {
+		action = commandAction(TrustActionAdd, s.installCommand(PlannedCertFile, anchor))
+	}
+	return s.planUpdate(layout, action)
+}
+
+// PlanRemove describes how Remove removes the anchors and the command that
+// rebuilds the system CA bundle.
+func (s *SystemTrustStore) PlanRemove(commonName string) ([]*TrustAction, error) {
+	layout, err := s.Layout()
+	if err != nil {
+		return nil, err
+	}
+	var actions []*TrustAction
+	if s.usesP11Kit(layout) {
+		stored, err := s.p11KitAnchorsFor(layout, commonName)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range stored {
+			actions = append(actions, commandAction(TrustActionRemove, s.unstoreCommand(file)))
+		}
+		if _, err := os.Stat(s.path(s.anchorFile(layout, commonName))); os.IsNotExist(err) {
+			return actions, nil
+		}
+	}
+	anchor := s.path(s.anchorFile(layout, commonName))
+	action := fileAction(TrustActionRemove, anchor)
+	if s.elevate() {
+		action = commandAction(TrustActionRemove, s.removeCommand(anchor))
+	}
+	return s.planUpdate(layout, append(actions, action)...)
+}
+
+// planUpdate appends the update command for the given layout to the given
+// actions, unless the bundle isn't rebuilt (see Root).
+func (s *SystemTrustStore) planUpdate(layout *SystemTrustLayout, actions ...*TrustAction) ([]*TrustAction, error) {
+	if !s.isHostRoot() {
+		return actions, nil
+	}
+	update, err := s.updateCommand(layout)
+	if err != nil {
+		return nil, err
+	}
+	return append(actions, commandAction(TrustActionUpdate, update)), nil
+}
+
+// update runs the first installed update command for the given layout, unless
+// the bundle isn't rebuilt (see Root).
+func (s *SystemTrustStore) update(ctx context.Context, layout *SystemTrustLayout) error {
+	if !s.isHostRoot() {
+		log.Debugf("Not rebuilding system trust store bundle in %s", s.Root)
+		return nil
+	}
+	cmd, err := s.updateCommand(layout)
+	if err != nil {
+		return err
+	}
+	return s.run(ctx, cmd)
+}
+
+// updateCommand finds the first installed update command for the given
+// layout.
+func (s *SystemTrustStore) updateCommand(layout *SystemTrustLayout) (*Command, error) {
+	for _, command := range layout.UpdateCommands {
+		if _, err := runnerOr(s.Runner).LookPath(command[0]); err == nil {
+			return s.command(command[0], command[1:]...), nil
+		}
+	}
+	return nil, &Error{Op: "find command to update system trust store", Path: layout.Name, Kind: ErrTrustToolMissing}
+}
+
+// installCommand installs the certificate in the given file as the given
+// anchor, used when privileges need to be elevated.
+func (s *SystemTrustStore) installCommand(certFile string, anchor string) *Command {
+	return s.command("install", "-m", "0644", certFile, anchor)
+}
+
+// removeCommand removes the given anchor, used when privileges need to be
+// elevated.
+func (s *SystemTrustStore) removeCommand(anchor string) *Command {
+	return s.command("rm", "-f", anchor)
+}
+
+// storeCommand stores the certificate in the given file as an anchor using
+// p11-kit.
+func (s *SystemTrustStore) storeCommand(certFile string) *Command {
+	return s.command("trust", "anchor", "--store", certFile)
+}
+
+// unstoreCommand removes the anchor stored by p11-kit in the given file.
+func (s *SystemTrustStore) unstoreCommand(file string) *Command {
+	return s.command("trust", "anchor", "--remove", file)
+}
+
+// usesP11Kit determines whether anchors are managed with p11-kit's trust tool
+// for the given layout.
+func (s *SystemTrustStore) usesP11Kit(layout *SystemTrustLayout) bool {
+	if layout.P11KitDir == "" || !s.isHostRoot() {
+		return false
+	}
+	_, err := runnerOr(s.Runner).LookPath("trust")
+	return err == nil
+}
+
+// p11KitAnchorFile is a file in which p11-kit stored anchors.
+type p11KitAnchorFile struct {
+	path  string
+	certs []*Certificate
+}
+
+// p11KitAnchors finds the anchors that p11-kit stored for the given layout.
+// The files are in p11-kit's format, which embeds the PEM encoded
+// certificate.
+func (s *SystemTrustStore) p11KitAnchors(layout *SystemTrustLayout) ([]*p11KitAnchorFile, error) {
+	if layout.P11KitDir == "" {
+		return nil, nil
+	}
+	dir := s.path(layout.P11KitDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to list %s: %w", dir, err)
+	}
+	var files []*p11KitAnchorFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), p11KitExtension) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := LoadCertificatesFromPEMBytes(data)
+		if err != nil {
+			log.Debugf("Skipping %s in trust store: %v", path, err)
+			continue
+		}
+		files = append(files, &p11KitAnchorFile{path: path, certs: certs})
+	}
+	return files, nil
+}
+
+// p11KitAnchorsFor finds the files in which p11-kit stored anchors with the
+// given common name.
+func (s *SystemTrustStore) p11KitAnchorsFor(layout *SystemTrustLayout, commonName string) ([]string, error) {
+	stored, err := s.p11KitAnchors(layout)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range stored {
+		for _, cert := range file.certs {
+			if cert.X509().Subject.CommonName == commonName {
+				paths = append(paths, file.path)
+				break
+			}
+		}
+	}
+	return paths, nil
+}
+
+// command constructs a command that's elevated if necessary.
+func (s *SystemTrustStore) command(name string, args ...string) *Command {
+	cmd := &Command{Name: name, Args: args}
+	if s.elevate() {
+		cmd.Prompt = s.Prompt
+	}
+	return cmd
+}
+
+func (s *SystemTrustStore) run(ctx context.Context, cmd *Command) error {
+	out, err := runnerOr(s.Runner).Run(ctx, cmd)
+	if err != nil {
+		return trustCommandError(cmd.Name, err, out)
+	}
+	return nil
+}
+
+// elevate determines whether privileges need to be elevated to modify the
+// trust store.
+func (s *SystemTrustStore) elevate() bool {
+	return s.Prompt != "" && os.Geteuid() != 0
+}
+
+// isHostRoot determines whether the trust store is the host's own, which the
+// host's tools manage.
+func (s *SystemTrustStore) isHostRoot() bool {
+	return s.Root == "" || filepath.Clean(s.Root) == "/"
+}
+
+func (s *SystemTrustStore) path(name string) string {
+	if s.Root == "" {
+		return name
+	}
+	return filepath.Join(s.Root, name)
+}
+
+// anchorFile determines the name of the anchor file for the given common
+// name.
+func (s *SystemTrustStore) anchorFile(layout *SystemTrustLayout, commonName string) string {
+	return filepath.Join(layout.AnchorDir, systemAnchorPrefix+safeFileName(commonName)+layout.Extension)
+}
@@ -0,0 +1,197 @@
+package keyman
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSystemTrustStore constructs a SystemTrustStore rooted in a temp
+// directory containing the given anchor dir, which records the commands it
+// runs instead of running them. The given tools appear not to be installed.
+func fakeSystemTrustStore(t *testing.T, anchorDir string, missing ...string) (*SystemTrustStore, *FakeRunner) {
+	root := t.TempDir()
+	if anchorDir != "" {
+		if !assert.NoError(t, os.MkdirAll(filepath.Join(root, anchorDir), 0755)) {
+			t.FailNow()
+		}
+	}
+	runner := NewFakeRunner().Missing(missing...)
+	store := NewSystemTrustStore(root, "")
+	store.Runner = runner
+	return store, runner
+}
+
+func TestSystemTrustStore(t *testing.T) {
+	ctx := context.Background()
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Test Root/1")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Under an alternate root, anchors are copied but the host's bundle isn't
+	// rebuilt
+	for _, test := range []struct {
+		layout string
+		anchor string
+	}{
+		{"debian", "/usr/local/share/ca-certificates/keyman-Test_Root_1.crt"},
+		{"fedora", "/etc/pki/ca-trust/source/anchors/keyman-Test_Root_1.pem"},
+		{"arch", "/etc/ca-certificates/trust-source/anchors/keyman-Test_Root_1.pem"},
+	} {
+		t.Run(test.layout, func(t *testing.T) {
+			store, runner := fakeSystemTrustStore(t, filepath.Dir(test.anchor))
+			layout, err := store.Layout()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, test.layout, layout.Name)
+
+			installed, err := store.Contains(ctx, cert)
+			assert.NoError(t, err)
+			assert.False(t, installed)
+
+			actions, err := store.PlanAdd(cert)
+			if assert.NoError(t, err) && assert.Len(t, actions, 1) {
+				assert.Equal(t, filepath.Join(store.Root, test.anchor), actions[0].File)
+			}
+
+			if !assert.NoError(t, store.Add(ctx, cert)) {
+				return
+			}
+			installed, err = store.Contains(ctx, cert)
+			assert.NoError(t, err)
+			assert.True(t, installed)
+			loaded, err := LoadCertificateFromFile(filepath.Join(store.Root, test.anchor))
+			if assert.NoError(t, err) {
+				assert.Equal(t, cert.DER(), loaded.DER())
+			}
+
+			assert.NoError(t, store.Remove(ctx, "Test Root/1"))
+			_, err = os.Stat(filepath.Join(store.Root, test.anchor))
+			assert.True(t, os.IsNotExist(err), "Anchor should be removed")
+			assert.Empty(t, runner.Commands(), "Host tools should not run against an alternate root")
+		})
+	}
+}
+
+// hostSystemTrustStore constructs a SystemTrustStore for the host's root
+// whose only layout is the given one, with directories relative to a temp
+// directory, and which records the commands it runs instead of running them.
+func hostSystemTrustStore(t *testing.T, layout SystemTrustLayout, missing ...string) (*SystemTrustStore, *FakeRunner) {
+	dir := t.TempDir()
+	layout.AnchorDir = filepath.Join(dir, layout.AnchorDir)
+	if layout.P11KitDir != "" {
+		layout.P11KitDir = filepath.Join(dir, layout.P11KitDir)
+	}
+	if !assert.NoError(t, os.MkdirAll(layout.AnchorDir, 0755)) {
+		t.FailNow()
+	}
+	oldLayouts := SystemTrustLayouts
+	SystemTrustLayouts = []*SystemTrustLayout{&layout}
+	t.Cleanup(func() { SystemTrustLayouts = oldLayouts })
+	runner := NewFakeRunner().Missing(missing...)
+	store := NewSystemTrustStore("", "")
+	store.Runner = runner
+	return store, runner
+}
+
+func TestSystemTrustStoreHostUpdates(t *testing.T) {
+	ctx := context.Background()
+	pk, _ := GeneratePK(1024)
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Test Root")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, test := range []struct {
+		name    string
+		layout  SystemTrustLayout
+		missing []string
+		update  string
+	}{
+		{"debian", *SystemTrustLayouts[2], nil, "update-ca-certificates"},
+		{"fedora without p11-kit", *SystemTrustLayouts[0], []string{"trust"}, "update-ca-trust extract"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store, runner := hostSystemTrustStore(t, test.layout, test.missing...)
+			actions, err := store.PlanAdd(cert)
+			if assert.NoError(t, err) && assert.Len(t, actions, 2) {
+				assert.Equal(t, test.update, actions[1].Command.String())
+			}
+			assert.Empty(t, runner.Commands(), "Planning should not run commands")
+
+			if !assert.NoError(t, store.Add(ctx, cert)) {
+				return
+			}
+			installed, err := store.Contains(ctx, cert)
+			assert.NoError(t, err)
+			assert.True(t, installed)
+			assert.NoError(t, store.Remove(ctx, "Test Root"))
+			assert.Equal(t, []string{test.update, test.update}, runner.CommandLines())
+		})
+	}
+}
+
+func TestSystemTrustStoreP11Kit(t *testing.T) {
+	ctx := context.Background()
+	pk, _ := GeneratePK(1024)
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Test Root")
+	if !assert.NoError(t, err) {
+		return
+	}
+	store, runner := hostSystemTrustStore(t, *SystemTrustLayouts[0])
+	layout, _ := store.Layout()
+
+	actions, err := store.PlanAdd(cert)
+	if assert.NoError(t, err) && assert.Len(t, actions, 1) {
+		assert.Equal(t, "trust anchor --store "+PlannedCertFile, actions[0].Command.String())
+	}
+	if !assert.NoError(t, store.Add(ctx, cert)) {
+		return
+	}
+	lines := runner.CommandLines()
+	if assert.Len(t, lines, 1, "trust anchor should rebuild the bundle itself") {
+		assert.True(t, strings.HasPrefix(lines[0], "trust anchor --store "), lines[0])
+	}
+
+	// Simulate the file that trust anchor --store writes
+	stored := filepath.Join(layout.P11KitDir, "Test_Root.p11-kit")
+	p11KitData := append([]byte("[p11-kit-object-v1]\nclass: certificate\ntrusted: true\n"), cert.PEMEncoded()...)
+	assert.NoError(t, ioutil.WriteFile(stored, p11KitData, 0644))
+	installed, err := store.Contains(ctx, cert)
+	assert.NoError(t, err)
+	assert.True(t, installed, "Anchors stored by p11-kit should be found")
+
+	actions, err = store.PlanRemove("Test Root")
+	if assert.NoError(t, err) && assert.Len(t, actions, 1) {
+		assert.Equal(t, "trust anchor --remove "+stored, actions[0].Command.String())
+	}
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	assert.Equal(t, "trust anchor --remove "+stored, runner.CommandLines()[1])
+	assert.Len(t, runner.CommandLines(), 2)
+}
+
+func TestSystemTrustStoreMissing(t *testing.T) {
+	ctx := context.Background()
+	store, _ := fakeSystemTrustStore(t, "")
+	_, err := store.Layout()
+	assert.True(t, errors.Is(err, ErrTrustToolMissing))
+
+	store, _ = hostSystemTrustStore(t, *SystemTrustLayouts[2], "update-ca-certificates")
+	pk, _ := GeneratePK(1024)
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", "Test Root")
+	if assert.NoError(t, err) {
+		assert.True(t, errors.Is(store.Add(ctx, cert), ErrTrustToolMissing), "Missing update tool should be reported")
+	}
+}
@@ -0,0 +1,382 @@
+package keyman
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRoot(t *testing.T, commonName string) *Certificate {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(ONE_WEEK), true, nil, "Test Org", commonName)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cert
+}
+
+func TestTrustStoreRegistry(t *testing.T) {
+	a, b := NewFakeTrustStore("a"), NewFakeTrustStore("b")
+	RegisterTrustStoreBackend("test-a", StaticTrustStoreBackend(a))
+	RegisterTrustStoreBackend("test-b", StaticTrustStoreBackend(b))
+	assert.Contains(t, TrustStoreBackends(), "test-a")
+	assert.Contains(t, TrustStoreBackends(), "java")
+
+	stores, err := TrustStores("", "test-b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []TrustStore{b}, stores, "Only the chosen backends should be used")
+	}
+	_, err = TrustStores("", "missing")
+	assert.Error(t, err)
+}
+
+func TestAddAsTrustedRootIn(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	dir := NewDirTrustStore(filepath.Join(t.TempDir(), "roots"))
+	fake := NewFakeTrustStore("fake")
+	stores := []TrustStore{dir, fake}
+
+	var attempts []error
+	installAttempted := func(err error) { attempts = append(attempts, err) }
+	observer := &recordingObserver{}
+	defer AddObserver(observer)()
+
+	if !assert.NoError(t, cert.AddAsTrustedRootIn(ctx, stores, installAttempted)) {
+		return
+	}
+	assert.Len(t, attempts, 2)
+	assert.Equal(t, []EventType{EventTrustCheckFailed, EventTrustCheckFailed, EventTrustInstalled, EventTrustInstalled}, observer.types())
+	for _, store := range stores {
+		installed, err := store.Contains(ctx, cert)
+		assert.NoError(t, err)
+		assert.True(t, installed, store.Name())
+		certs, err := store.List(ctx)
+		if assert.NoError(t, err) && assert.Len(t, certs, 1) {
+			assert.Equal(t, cert.DER(), certs[0].DER())
+		}
+	}
+
+	attempts = nil
+	assert.NoError(t, cert.AddAsTrustedRootIn(ctx, stores, installAttempted))
+	assert.Empty(t, attempts, "Installed cert should not be installed again")
+
+	assert.NoError(t, DeleteTrustedRootByNameIn(ctx, stores, "Test Root"))
+	assert.NoError(t, DeleteTrustedRootByNameIn(ctx, stores, "Test Root"), "Removing missing cert should succeed")
+	for _, store := range stores {
+		installed, _ := store.Contains(ctx, cert)
+		assert.False(t, installed, store.Name())
+	}
+
+	failure := errors.New("failed")
+	fake.Err = failure
+	err := cert.AddAsTrustedRootIn(ctx, []TrustStore{fake, dir}, installAttempted)
+	assert.True(t, errors.Is(err, failure))
+	installed, _ := dir.Contains(ctx, cert)
+	assert.True(t, installed, "Should continue after a failure")
+}
+
+func TestInstallTrustedRootResult(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	present := NewFakeTrustStore("present")
+	assert.NoError(t, present.Add(ctx, cert))
+	locked := NewFakeTrustStore("locked")
+	locked.Err = &Error{Op: "run certutil command", Kind: ErrTrustStoreLocked}
+	declined := NewFakeTrustStore("declined")
+	declined.Err = &Error{Op: "run pkexec command", Kind: ErrElevationDeclined}
+	unavailable := NewSystemTrustStore(t.TempDir(), "")
+	fresh := NewFakeTrustStore("fresh")
+
+	var attempts []error
+	result, err := cert.InstallTrustedRoot(ctx, []TrustStore{present, locked, unavailable, declined, fresh}, &TrustOptions{
+		InstallAttempted: func(err error) { attempts = append(attempts, err) },
+	})
+	assert.Len(t, attempts, 3)
+	if !assert.Len(t, result.Targets, 5) {
+		return
+	}
+	var outcomes []TrustOutcome
+	for _, target := range result.Targets {
+		outcomes = append(outcomes, target.Outcome)
+	}
+	assert.Equal(t, []TrustOutcome{TrustAlreadyPresent, TrustFailed, TrustSkipped, TrustFailed, TrustInstalled}, outcomes)
+	assert.Equal(t, "locked", result.Targets[1].Name)
+	assert.Equal(t, locked.Err, result.Targets[1].Err)
+	assert.NotEmpty(t, result.Targets[2].Reason)
+	assert.Len(t, result.Failed(), 2)
+
+	assert.True(t, errors.Is(err, ErrTrustStoreLocked))
+	assert.True(t, errors.Is(err, ErrElevationDeclined))
+	assert.False(t, errors.Is(err, ErrTrustToolMissing), "Skipped targets are not failures")
+	var keymanErr *Error
+	if assert.True(t, errors.As(err, &keymanErr)) {
+		assert.Equal(t, ErrTrustStoreLocked, keymanErr.Kind)
+	}
+	var trustErr *TrustError
+	if assert.True(t, errors.As(err, &trustErr)) {
+		assert.Len(t, trustErr.Failed, 2)
+		assert.Contains(t, err.Error(), "Unable to install trusted root in 2 trust store(s)")
+		assert.Contains(t, err.Error(), "locked: ")
+		assert.Contains(t, err.Error(), "declined: ")
+	}
+	installed, _ := fresh.Contains(ctx, cert)
+	assert.True(t, installed, "Failures should not stop later targets")
+
+	result, err = cert.InstallTrustedRoot(ctx, []TrustStore{present}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, result.Err())
+}
+
+func TestRemoveTrustedRootAttemptsEveryStore(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	failing := NewFakeTrustStore("failing")
+	failing.Err = ErrElevationDeclined
+	first, last := NewFakeTrustStore("first"), NewFakeTrustStore("last")
+	for _, store := range []*FakeTrustStore{first, last} {
+		assert.NoError(t, store.Add(ctx, cert))
+	}
+	unsupported := NewFakeTrustStore("unsupported")
+	unsupported.Err = ErrNotSupported
+
+	result, err := RemoveTrustedRoot(ctx, []TrustStore{first, failing, unsupported, last}, "Test Root")
+	assert.True(t, errors.Is(err, ErrElevationDeclined))
+	var trustErr *TrustError
+	if assert.True(t, errors.As(err, &trustErr)) && assert.Len(t, trustErr.Failed, 1) {
+		assert.Equal(t, "failing", trustErr.Failed[0].Name)
+		assert.Contains(t, trustErr.Error(), "Unable to remove trusted root from 1 trust store(s)")
+	}
+	var outcomes []TrustOutcome
+	for _, target := range result.Targets {
+		outcomes = append(outcomes, target.Outcome)
+	}
+	assert.Equal(t, []TrustOutcome{TrustRemoved, TrustFailed, TrustSkipped, TrustRemoved}, outcomes)
+	for _, store := range []*FakeTrustStore{first, last} {
+		installed, _ := store.Contains(ctx, cert)
+		assert.False(t, installed, "Root should be removed from %v after a failure", store.Name())
+	}
+}
+
+func TestAddAsTrustedRootReplacesStale(t *testing.T) {
+	ctx := context.Background()
+	stale := testRoot(t, "Test Root")
+	cert := testRoot(t, "Test Root")
+	other := testRoot(t, "Other Root")
+	dir := NewDirTrustStore(filepath.Join(t.TempDir(), "roots"))
+	fake := NewFakeTrustStore("fake")
+	stores := []TrustStore{dir, fake}
+	for _, store := range stores {
+		assert.NoError(t, store.Add(ctx, stale))
+		assert.NoError(t, store.Add(ctx, other))
+		installed, err := store.Contains(ctx, cert)
+		assert.NoError(t, err)
+		assert.False(t, installed, "Different cert with same name should not count as installed in %v", store.Name())
+	}
+	// Several stale roots with the same name are removed at once
+	assert.NoError(t, fake.Add(ctx, testRoot(t, "Test Root")))
+
+	err := cert.AddAsTrustedRootWith(ctx, stores, &TrustOptions{Replace: RefuseStale})
+	assert.True(t, errors.Is(err, ErrStaleRoot))
+	installed, _ := dir.Contains(ctx, stale)
+	assert.True(t, installed, "Refusing should leave the stale root in place")
+
+	observer := &recordingObserver{}
+	defer AddObserver(observer)()
+	if !assert.NoError(t, cert.AddAsTrustedRootIn(ctx, stores, nil)) {
+		return
+	}
+	assert.Equal(t, []EventType{
+		EventTrustCheckFailed, EventTrustCheckFailed,
+		EventTrustRemoved, EventTrustInstalled,
+		EventTrustRemoved, EventTrustInstalled,
+	}, observer.types())
+	for _, store := range stores {
+		certs, err := store.List(ctx)
+		if assert.NoError(t, err) {
+			assert.True(t, containsCert(certs, cert), store.Name())
+			assert.True(t, containsCert(certs, other), "Roots with other names should be kept in %v", store.Name())
+			assert.False(t, containsCert(certs, stale), "Stale root should be replaced in %v", store.Name())
+		}
+	}
+
+	kept := NewFakeTrustStore("kept")
+	assert.NoError(t, kept.Add(ctx, stale))
+	assert.NoError(t, cert.AddAsTrustedRootWith(ctx, []TrustStore{kept}, &TrustOptions{Replace: KeepStale}))
+	certs, _ := kept.List(ctx)
+	assert.Len(t, certs, 2)
+}
+
+func sha1Hex(cert *Certificate) string {
+	sum := sha1.Sum(cert.DER())
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestReplaceSeveralStaleRoots(t *testing.T) {
+	ctx := context.Background()
+	stale1 := testRoot(t, "Test Root")
+	stale2 := testRoot(t, "Test Root")
+	cert := testRoot(t, "Test Root")
+	bothStale := string(stale1.PEMEncoded()) + string(stale2.PEMEncoded())
+
+	keychainRunner := NewFakeRunner().
+		On("security", []string{"find-certificate"}, bothStale, nil).
+		On("security", []string{"verify-cert"}, "", errors.New("untrusted"))
+	keychain := NewKeychainTrustStore("/Library/Keychains/System.keychain", "")
+	keychain.Runner = keychainRunner
+
+	nssRunner := NewFakeRunner().
+		On("certutil", []string{"-d", "/nssdb", "-L"}, "Certificate Nickname    Trust Attributes\n\nTest Root    C,,\n", nil).
+		On("certutil", []string{"-d", "/nssdb", "-L", "-n", "Test Root", "-a"}, bothStale, nil)
+	nss := NewNSSTrustStore("/nssdb")
+	nss.Runner = nssRunner
+
+	removals := func(runner *FakeRunner, command string) []string {
+		var lines []string
+		for _, line := range runner.CommandLines() {
+			if strings.Contains(line, command) {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+	plan := PlanTrust(ctx, cert, []TrustStore{keychain, nss}, nil)
+	if assert.Len(t, plan.Stores, 2) {
+		assert.Len(t, plan.Stores[0].Replaces, 2)
+		assert.Len(t, plan.Stores[0].Actions, 4, "Each stale root should be removed, then the root added and verified")
+		assert.Len(t, plan.Stores[1].Actions, 3, "Each stale root should be removed, then the root added")
+	}
+
+	_, err := cert.InstallTrustedRoot(ctx, []TrustStore{keychain, nss}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"security delete-certificate -Z " + sha1Hex(stale1) + " /Library/Keychains/System.keychain",
+		"security delete-certificate -Z " + sha1Hex(stale2) + " /Library/Keychains/System.keychain",
+	}, removals(keychainRunner, "delete-certificate"))
+	assert.Equal(t, []string{
+		"certutil -d /nssdb -D -n Test Root",
+		"certutil -d /nssdb -D -n Test Root",
+	}, removals(nssRunner, " -D "))
+}
+
+func TestStaleRootsUnlistable(t *testing.T) {
+	ctx := context.Background()
+	cert := testRoot(t, "Test Root")
+	runner := NewFakeRunner().
+		On("security", []string{"find-certificate", "-a", "-p", "/Library/Keychains/System.keychain"}, "", errors.New("exit status 1")).
+		On("security", []string{"verify-cert"}, "", errors.New("untrusted"))
+	keychain := NewKeychainTrustStore("/Library/Keychains/System.keychain", "")
+	keychain.Runner = runner
+
+	plan := PlanTrust(ctx, cert, []TrustStore{keychain}, &TrustOptions{Replace: RefuseStale})
+	if assert.Len(t, plan.Stores, 1) {
+		assert.Equal(t, TrustFailed, plan.Stores[0].Outcome, "A store that can't be checked for stale roots should fail")
+	}
+	result, err := cert.InstallTrustedRoot(ctx, []TrustStore{keychain}, nil)
+	assert.Error(t, err)
+	if assert.Len(t, result.Targets, 1) {
+		assert.Equal(t, TrustFailed, result.Targets[0].Outcome)
+	}
+	for _, line := range runner.CommandLines() {
+		assert.NotContains(t, line, "add-trusted-cert", "Nothing should be installed")
+	}
+}
+
+func TestNSSTrustStoreCreateIfMissing(t *testing.T) {
+	ctx := context.Background()
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake certutil is a shell script")
+	}
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	fakeCertutil := `#!/bin/sh
+echo "$@" >> ` + log + `
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -d) db="${2#sql:}"; shift ;;
+    -N) touch "$db/cert9.db" "$db/key4.db" "$db/pkcs11.txt" ;;
+  esac
+  shift
+done
+`
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, "certutil"), []byte(fakeCertutil), 0755)) {
+		return
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := filepath.Join(t.TempDir(), ".pki", "nssdb")
+	cert := testRoot(t, "Test Root")
+	store := &NSSTrustStore{DB: "sql:" + dir}
+	installed, err := store.Contains(ctx, cert)
+	assert.Error(t, err, "Missing database should not be created by default")
+	assert.False(t, installed)
+
+	store.CreateIfMissing = true
+	certs, err := store.List(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, certs)
+	installed, err = store.Contains(ctx, cert)
+	assert.NoError(t, err)
+	assert.False(t, installed)
+	assert.NoError(t, store.Remove(ctx, "Test Root"))
+	assert.NoDirExists(t, dir, "Database should only be created when adding")
+
+	if !assert.NoError(t, store.Add(ctx, cert)) {
+		return
+	}
+	stat, err := os.Stat(dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+	}
+	for _, name := range []string{"cert9.db", "key4.db", "pkcs11.txt"} {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0600), stat.Mode().Perm(), name)
+		}
+	}
+	calls, _ := ioutil.ReadFile(log)
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "-d sql:"+dir+" -N --empty-password", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "-d sql:"+dir+" -A -t C,, -n Test Root"), lines[1])
+	}
+}
+
+func TestCreateNSSDBFailure(t *testing.T) {
+	ctx := context.Background()
+	runner := NewFakeRunner().On("certutil", nil, "", errors.New("exit status 1"))
+
+	existing := filepath.Join(t.TempDir(), "profile")
+	assert.NoError(t, os.Mkdir(existing, 0700))
+	assert.Error(t, createNSSDB(ctx, runner, existing))
+	assert.DirExists(t, existing, "Existing directory should be kept")
+
+	parent := t.TempDir()
+	assert.Error(t, createNSSDB(ctx, runner, filepath.Join(parent, ".pki", "nssdb")))
+	assert.NoDirExists(t, filepath.Join(parent, ".pki"), "Created directories should be removed")
+	assert.DirExists(t, parent)
+}
+
+func TestParseCertutilNicknames(t *testing.T) {
+	out := []byte(`
+Certificate Nickname                                         Trust Attributes
+                                                             SSL,S/MIME,JAR/XPI
+
+Lantern                                                      C,,
+My Company Root CA - G2                                      CT,C,C
+`)
+	assert.Equal(t, []string{"Lantern", "My Company Root CA - G2"}, parseCertutilNicknames(out))
+}
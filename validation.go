@@ -0,0 +1,153 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// ValidationDefault applies the default policy for the problem
+	ValidationDefault ValidationPolicy = iota
+	// ValidationFail fails loading with an error
+	ValidationFail
+	// ValidationRegenerate reissues the certificate using the stored key
+	ValidationRegenerate
+	// ValidationWarn logs the problem and uses the stored certificate anyway
+	ValidationWarn
+)
+
+var (
+	// ErrKeyMismatch indicates that a certificate wasn't issued for the key
+	// it's stored with.
+	ErrKeyMismatch = errors.New("Certificate does not match private key")
+
+	// ErrNotCA indicates that a certificate isn't a CA, even though one was
+	// expected.
+	ErrNotCA = errors.New("Certificate is not a CA")
+
+	// ErrHostNotCovered indicates that a certificate's SANs don't cover a
+	// requested host.
+	ErrHostNotCovered = errors.New("Certificate does not cover host")
+
+	// ErrSubjectChanged indicates that a certificate's subject or hosts differ
+	// from the requested ones.
+	ErrSubjectChanged = errors.New("Certificate subject or hosts differ from those requested")
+)
+
+// ValidationPolicy determines what happens when a stored key and certificate
+// fail a consistency check on load.
+type ValidationPolicy int
+
+// ValidationPolicies chooses a ValidationPolicy for each problem that
+// StoredPKAndCertIn checks for.
+type ValidationPolicies struct {
+	// KeyMismatch applies when the certificate's public key doesn't match the
+	// private key. Defaults to ValidationFail.
+	KeyMismatch ValidationPolicy
+	// NotCA applies when a CA was expected but the certificate isn't one.
+	// Defaults to ValidationFail.
+	NotCA ValidationPolicy
+	// HostNotCovered applies when the certificate's SANs don't cover one of
+	// the requested hosts. Defaults to ValidationRegenerate.
+	HostNotCovered ValidationPolicy
+	// SubjectChanged applies when the certificate's organization, common name
+	// or hosts differ from the requested ones, for example because the
+	// listening IP changed. Defaults to ValidationRegenerate.
+	SubjectChanged ValidationPolicy
+}
+
+// MatchesKey indicates whether this Certificate was issued for the public key
+// of the given PrivateKey.
+func (cert *Certificate) MatchesKey(key *PrivateKey) bool {
+	return key.rsaKey.PublicKey.Equal(cert.cert.PublicKey)
+}
+
+// validatePKAndCert checks that the stored PK and cert belong together and
+// match what was requested. It returns an error if a problem's policy is
+// ValidationFail, and indicates whether any problem's policy asks for the
+// certificate to be regenerated.
+func validatePKAndCert(pk *PrivateKey, cert *Certificate, opts *PKAndCertOptions) (regenerate bool, err error) {
+	apply := func(policy ValidationPolicy, def ValidationPolicy, problem error) error {
+		if policy == ValidationDefault {
+			policy = def
+		}
+		switch policy {
+		case ValidationRegenerate:
+			regenerate = true
+		case ValidationWarn:
+			log.Errorf("Using stored certificate despite problem: %v", problem)
+		default:
+			return problem
+		}
+		return nil
+	}
+
+	if !cert.MatchesKey(pk) {
+		if err := apply(opts.Validation.KeyMismatch, ValidationFail, ErrKeyMismatch); err != nil {
+			return false, err
+		}
+	}
+	if opts.ExpectCA && !cert.cert.IsCA {
+		if err := apply(opts.Validation.NotCA, ValidationFail, ErrNotCA); err != nil {
+			return false, err
+		}
+	}
+	for _, host := range opts.Hosts {
+		if host == "" {
+			continue
+		}
+		if cert.cert.VerifyHostname(host) != nil {
+			if err := apply(opts.Validation.HostNotCovered, ValidationRegenerate, fmt.Errorf("%w %s", ErrHostNotCovered, host)); err != nil {
+				return false, err
+			}
+		}
+	}
+	if !matchesRequest(cert, opts) {
+		if err := apply(opts.Validation.SubjectChanged, ValidationRegenerate, ErrSubjectChanged); err != nil {
+			return false, err
+		}
+	}
+	return regenerate, nil
+}
+
+// matchesRequest indicates whether the given certificate has exactly the
+// subject and SANs that would be issued for the given options.
+func matchesRequest(cert *Certificate, opts *PKAndCertOptions) bool {
+	subject := cert.cert.Subject
+	if subject.CommonName != opts.CommonName || len(subject.Organization) != 1 || subject.Organization[0] != opts.Organization {
+		return false
+	}
+
+	dnsNames, ipAddresses := subjectAltNames(opts.CommonName, opts.Hosts)
+	if !sameStrings(dnsNames, cert.cert.DNSNames) {
+		return false
+	}
+	ips := make([]string, 0, len(ipAddresses))
+	for _, ip := range ipAddresses {
+		ips = append(ips, ip.String())
+	}
+	certIPs := make([]string, 0, len(cert.cert.IPAddresses))
+	for _, ip := range cert.cert.IPAddresses {
+		certIPs = append(certIPs, ip.String())
+	}
+	return sameStrings(ips, certIPs)
+}
+
+// sameStrings indicates whether a and b contain the same set of strings,
+// ignoring order and duplicates.
+func sameStrings(a []string, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		if !set[s] {
+			return false
+		}
+	}
+	other := make(map[string]bool, len(b))
+	for _, s := range b {
+		other[s] = true
+	}
+	return len(set) == len(other)
+}
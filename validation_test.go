@@ -0,0 +1,167 @@
+package keyman
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesKey(t *testing.T) {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(TWO_WEEKS), true, nil, "Test Org", "TestCommonName")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cert.MatchesKey(pk))
+	assert.False(t, cert.MatchesKey(other))
+}
+
+func TestStoredPKAndCertValidation(t *testing.T) {
+	pk, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, err := GeneratePK(1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mismatched, err := other.TLSCertificateFor(time.Now().Add(TWO_WEEKS), true, nil, "Test Org", "TestCommonName", "example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	leaf, err := pk.TLSCertificateFor(time.Now().Add(TWO_WEEKS), false, nil, "Test Org", "TestCommonName", "example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	storeWith := func(cert *Certificate) Store {
+		store := NewMemStore()
+		store.PutAll(map[string][]byte{"pk.pem": pk.PEMEncoded(), "cert.pem": cert.PEMEncoded()})
+		return store
+	}
+	load := func(store Store, opts PKAndCertOptions) (*Certificate, error) {
+		opts.Organization, opts.CommonName = "Test Org", "TestCommonName"
+		_, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", &opts)
+		return cert, err
+	}
+
+	_, err = load(storeWith(mismatched), PKAndCertOptions{})
+	assert.True(t, errors.Is(err, ErrKeyMismatch), "Mismatch should fail by default")
+
+	store := storeWith(mismatched)
+	cert, err := load(store, PKAndCertOptions{Validation: ValidationPolicies{KeyMismatch: ValidationRegenerate}})
+	if assert.NoError(t, err) {
+		assert.True(t, cert.MatchesKey(pk), "Regenerated cert should match key")
+		stored, _ := LoadCertificateFromStore(store, "cert.pem")
+		assert.Equal(t, cert.PEMEncoded(), stored.PEMEncoded(), "Regenerated cert should be stored")
+	}
+
+	cert, err = load(storeWith(mismatched), PKAndCertOptions{Hosts: []string{"example.com"}, Validation: ValidationPolicies{KeyMismatch: ValidationWarn}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, mismatched.PEMEncoded(), cert.PEMEncoded(), "Warn should keep stored cert")
+	}
+
+	_, err = load(storeWith(leaf), PKAndCertOptions{ExpectCA: true})
+	assert.True(t, errors.Is(err, ErrNotCA), "Non-CA should fail when CA is expected")
+	cert, err = load(storeWith(leaf), PKAndCertOptions{ExpectCA: true, Validation: ValidationPolicies{NotCA: ValidationRegenerate}})
+	if assert.NoError(t, err) {
+		assert.True(t, cert.X509().IsCA, "Regenerated cert should be a CA")
+	}
+
+	_, err = load(storeWith(leaf), PKAndCertOptions{Hosts: []string{"other.com"}, Validation: ValidationPolicies{HostNotCovered: ValidationFail}})
+	assert.True(t, errors.Is(err, ErrHostNotCovered), "Uncovered host should fail")
+	cert, err = load(storeWith(leaf), PKAndCertOptions{Hosts: []string{"other.com"}, Validation: ValidationPolicies{HostNotCovered: ValidationWarn, SubjectChanged: ValidationWarn}})
+	if assert.NoError(t, err, "Uncovered host should be allowed with warning") {
+		assert.Equal(t, leaf.PEMEncoded(), cert.PEMEncoded())
+	}
+	cert, err = load(storeWith(leaf), PKAndCertOptions{Hosts: []string{"other.com"}})
+	if assert.NoError(t, err) {
+		assert.NoError(t, cert.X509().VerifyHostname("other.com"), "Regenerated cert should cover host by default")
+	}
+}
+
+func TestStoredPKAndCertHostsChange(t *testing.T) {
+	store := NewMemStore()
+	opts := &PKAndCertOptions{Organization: "Test Org", CommonName: "TestCommonName", Hosts: []string{"10.0.0.1", "example.com"}}
+	pk, cert, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Same hosts in a different order keep the stored cert
+	opts.Hosts = []string{"example.com", "10.0.0.1"}
+	_, same, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, cert.PEMEncoded(), same.PEMEncoded())
+	}
+
+	// A changed IP is reissued with the same key
+	opts.Hosts = []string{"10.0.0.2", "example.com"}
+	pk2, reissued, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, pk.PEMEncoded(), pk2.PEMEncoded(), "Key should be kept")
+		assert.NotEqual(t, cert.PEMEncoded(), reissued.PEMEncoded(), "Cert should be reissued")
+		assert.Equal(t, "10.0.0.2", reissued.X509().IPAddresses[0].String())
+		assert.True(t, reissued.MatchesKey(pk))
+	}
+
+	// So is a changed common name, even without hosts
+	opts.CommonName, opts.Hosts = "NewCommonName", nil
+	_, renamed, err := StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "NewCommonName", renamed.X509().Subject.CommonName)
+		assert.Equal(t, []string{"NewCommonName"}, renamed.X509().DNSNames)
+	}
+
+	opts.Organization = "Other Org"
+	opts.Validation.SubjectChanged = ValidationFail
+	_, _, err = StoredPKAndCertIn(store, "pk.pem", "cert.pem", opts)
+	assert.True(t, errors.Is(err, ErrSubjectChanged))
+}
+
+// TestStoredPKAndCertBaseline checks that pairs written by earlier versions,
+// which have an empty DNS SAN when no host was given, are loaded as is.
+func TestStoredPKAndCertBaseline(t *testing.T) {
+	for _, suffix := range []string{"", "-host"} {
+		host := ""
+		if suffix != "" {
+			host = "127.0.0.1"
+		}
+		dir := t.TempDir()
+		pkfile, certfile := filepath.Join(dir, "pk.pem"), filepath.Join(dir, "cert.pem")
+		for src, dst := range map[string]string{"pk" + suffix + ".pem": pkfile, "cert" + suffix + ".pem": certfile} {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", "baseline", src))
+			if !assert.NoError(t, err) {
+				return
+			}
+			if !assert.NoError(t, ioutil.WriteFile(dst, data, 0600)) {
+				return
+			}
+		}
+		original, err := LoadCertificateFromFile(certfile)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		pk, cert, err := StoredPKAndCert(pkfile, certfile, "Lantern", host, "Lantern Test CA")
+		if assert.NoError(t, err, host) {
+			assert.Equal(t, original.DER(), cert.DER(), "Baseline cert for %q should not be reissued", host)
+			assert.True(t, cert.MatchesKey(pk))
+		}
+		stored, err := LoadCertificateFromFile(certfile)
+		if assert.NoError(t, err) {
+			assert.Equal(t, original.DER(), stored.DER(), "Baseline cert for %q should not be rewritten", host)
+		}
+	}
+}